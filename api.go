@@ -0,0 +1,215 @@
+// Copyright 2018 The solid-mon-rpi Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image/color"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"gonum.org/v1/plot/plotter"
+)
+
+// historyView is the response of the history API: the time series of the
+// dashboard panels, over the selected time range.
+type historyView struct {
+	View   string        `json:"view"`
+	Width  float64       `json:"width"` // width of the trend buckets, in seconds (0 for raw samples)
+	Beg    float64       `json:"from"`  // in seconds since the Unix epoch
+	End    float64       `json:"to"`    // in seconds since the Unix epoch
+	Panels []panelSeries `json:"panels"`
+}
+
+type panelSeries struct {
+	Title  string   `json:"title"`
+	Type   string   `json:"type"`
+	Unit   string   `json:"unit"`
+	Min    float64  `json:"min"` // y-axis range (automatic if min == max)
+	Max    float64  `json:"max"`
+	Log    bool     `json:"log"`
+	Series []series `json:"series"`
+}
+
+// series is the time series of a sensor quantity, split into contiguous
+// segments.
+type series struct {
+	Name     string    `json:"name"`
+	Color    string    `json:"color"`
+	Segments []xysJSON `json:"segments"`
+	Lo       []xysJSON `json:"lo,omitempty"` // band of minimum values (trends only)
+	Hi       []xysJSON `json:"hi,omitempty"` // band of maximum values (trends only)
+}
+
+// xysJSON encodes points as a compact array of [x, y] pairs, with x in
+// seconds since the Unix epoch and y null for non-finite values.
+type xysJSON plotter.XYs
+
+func (xys xysJSON) MarshalJSON() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	buf.WriteByte('[')
+	for i, p := range xys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.WriteByte('[')
+		buf.WriteString(strconv.FormatFloat(p.X, 'f', 3, 64))
+		buf.WriteByte(',')
+		switch {
+		case math.IsNaN(p.Y) || math.IsInf(p.Y, 0):
+			// not representable in JSON.
+			buf.WriteString("null")
+		default:
+			buf.WriteString(strconv.FormatFloat(p.Y, 'g', -1, 64))
+		}
+		buf.WriteByte(']')
+	}
+	buf.WriteByte(']')
+	return buf.Bytes(), nil
+}
+
+func segmentsJSON(segs []plotter.XYs) []xysJSON {
+	o := make([]xysJSON, len(segs))
+	for i, seg := range segs {
+		o[i] = xysJSON(seg)
+	}
+	return o
+}
+
+// historyHandler serves the time series displayed by the interactive
+// dashboard charts:
+//
+//	/api/history?view={fast,trend,archive}
+//
+// The fast view holds the raw samples of the fast monitoring window, the
+// trend view the finest trend buckets, and the archive view the coarser
+// (hourly or daily) trend buckets covering the requested time range.
+// The time range and sensors are selected with the from, to, last and
+// sensor query parameters (see parseSelection.)
+func (srv *server) historyHandler(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return errorf(http.StatusMethodNotAllowed, "invalid HTTP request (got=%v, want=%v)", r.Method, http.MethodGet)
+	}
+
+	q := r.URL.Query()
+	sel, err := parseSelection(q)
+	if err != nil {
+		return err
+	}
+
+	hist, err := srv.history()
+	if err != nil {
+		return err
+	}
+
+	view := historyView{View: q.Get("view")}
+	var data timeSeries
+	switch view.View {
+	case "", "fast":
+		view.View = "fast"
+		data = sel.table(hist.fast)
+	case "trend":
+		tbl := sel.trend(hist.trends[0])
+		view.Width = tbl.width.Seconds()
+		data = tbl
+	case "archive":
+		tbl := sel.trend(hist.trends[hist.archive(sel)])
+		view.Width = tbl.width.Seconds()
+		data = tbl
+	default:
+		return errorf(http.StatusBadRequest, "invalid 'view' parameter %q", view.View)
+	}
+
+	beg, end := data.Span()
+	if !sel.beg.IsZero() {
+		beg = sel.beg
+	}
+	if !sel.end.IsZero() {
+		end = sel.end
+	}
+	view.Beg = unixSeconds(beg)
+	view.End = unixSeconds(end)
+
+	panels := srv.panels
+	if len(panels) == 0 {
+		panels = autoPanels(data)
+	}
+	view.Panels = make([]panelSeries, len(panels))
+	for i, panel := range panels {
+		view.Panels[i] = newPanelSeries(panel, srv.colors, data)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	return json.NewEncoder(w).Encode(view)
+}
+
+func newPanelSeries(panel Panel, colors map[string]color.Color, data timeSeries) panelSeries {
+	ps := panelSeries{
+		Title:  panel.Title,
+		Type:   panel.Type.String(),
+		Unit:   panel.Type.Unit(),
+		Min:    panel.Min,
+		Max:    panel.Max,
+		Log:    panel.Log,
+		Series: []series{},
+	}
+
+	labels := data.Labels(panel.Type)
+	sort.Strings(labels)
+	if len(panel.Sensors) > 0 {
+		labels = selectLabels(labels, panel.Sensors)
+	}
+	for _, label := range labels {
+		_, _, segs := data.Segments(panel.Type, label)
+		s := series{
+			Name:     label,
+			Color:    colorHex(colors[label]),
+			Segments: segmentsJSON(segs),
+		}
+		if data, ok := data.(bandSeries); ok {
+			lo, hi := data.Band(panel.Type, label)
+			s.Lo = segmentsJSON(lo)
+			s.Hi = segmentsJSON(hi)
+		}
+		ps.Series = append(ps.Series, s)
+	}
+	return ps
+}
+
+// archive returns the index of the coarser trend table (all but the first
+// one) used to display the selection: the finest one covering its time
+// range (see history.source.)
+func (hist history) archive(sel selection) int {
+	i := hist.source(sel)
+	if i < 1 {
+		i = 1
+	}
+	if i >= len(hist.trends) {
+		i = len(hist.trends) - 1
+	}
+	return i
+}
+
+func unixSeconds(t time.Time) float64 {
+	if t.IsZero() {
+		return 0
+	}
+	return float64(t.UnixNano()) * 1e-9
+}
+
+// colorHex returns the #rrggbb representation of c (black if nil.)
+func colorHex(c color.Color) string {
+	if c == nil {
+		c = color.Black
+	}
+	r, g, b, _ := c.RGBA()
+	return fmt.Sprintf("#%02x%02x%02x", r>>8, g>>8, b>>8)
+}
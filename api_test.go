@@ -0,0 +1,115 @@
+// Copyright 2018 The solid-mon-rpi Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHistoryHandler(t *testing.T) {
+	t0 := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	table := append(newTestTable(t0), newTestTable(t0.Add(10*time.Second))...)
+	// temp-0 failed for a while.
+	for i := 4; i < 10; i++ {
+		table[i].Sensors = table[i].Sensors[1:]
+	}
+	srv := newTestServer(t, table)
+
+	for _, tc := range []struct {
+		url    string
+		code   int
+		view   string
+		panels int
+		segs   int // number of segments of temp-0
+	}{
+		{"/api/history", http.StatusOK, "fast", 2, 2},
+		{"/api/history?view=trend", http.StatusOK, "trend", 2, 2},
+		{"/api/history?view=archive&sensor=temp-0", http.StatusOK, "archive", 1, 2},
+		{"/api/history?view=fast&from=2018-01-01T00:00:07Z", http.StatusOK, "fast", 2, 1},
+		{"/api/history?view=slow", http.StatusBadRequest, "", 0, 0},
+		{"/api/history?last=0s", http.StatusBadRequest, "", 0, 0},
+	} {
+		t.Run(tc.url, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, tc.url, nil)
+			srv.wrap(srv.historyHandler)(w, r)
+			if got, want := w.Code, tc.code; got != want {
+				t.Fatalf("invalid status code: got=%d, want=%d (%s)", got, want, w.Body.String())
+			}
+			if tc.code != http.StatusOK {
+				return
+			}
+
+			var resp struct {
+				View   string `json:"view"`
+				Panels []struct {
+					Type   string `json:"type"`
+					Series []struct {
+						Name     string         `json:"name"`
+						Segments [][][2]float64 `json:"segments"`
+						Lo       [][][2]float64 `json:"lo"`
+					} `json:"series"`
+				} `json:"panels"`
+			}
+			err := json.Unmarshal(w.Body.Bytes(), &resp)
+			if err != nil {
+				t.Fatalf("could not decode response: %+v", err)
+			}
+			if got, want := resp.View, tc.view; got != want {
+				t.Fatalf("invalid view: got=%q, want=%q", got, want)
+			}
+			if got, want := len(resp.Panels), tc.panels; got != want {
+				t.Fatalf("invalid number of panels: got=%d, want=%d", got, want)
+			}
+			s := resp.Panels[0].Series[0]
+			if s.Name != "temp-0" {
+				t.Fatalf("invalid first series: %q", s.Name)
+			}
+			if got, want := len(s.Segments), tc.segs; got != want {
+				t.Fatalf("invalid number of segments: got=%d, want=%d", got, want)
+			}
+			if got, want := len(s.Lo) > 0, tc.view != "fast"; got != want {
+				t.Fatalf("invalid band: got=%v, want=%v", got, want)
+			}
+		})
+	}
+}
+
+func TestHistoryArchive(t *testing.T) {
+	start := time.Date(2018, 1, 1, 10, 23, 17, 0, time.UTC)
+
+	for _, tc := range []struct {
+		name   string
+		uptime time.Duration
+		dt     time.Duration
+		last   time.Duration // 0: no time range
+		want   int
+	}{
+		// server up for less than the time window.
+		{"young-168h", 10 * time.Minute, 2 * time.Second, 168 * time.Hour, 1},
+		{"young-744h", 10 * time.Minute, 2 * time.Second, 744 * time.Hour, 1},
+		{"days-24h", 8 * 24 * time.Hour, time.Minute, 24 * time.Hour, 1},
+		{"months-744h", 40 * 24 * time.Hour, 10 * time.Minute, 744 * time.Hour, 1},
+		{"months-all", 40 * 24 * time.Hour, 10 * time.Minute, 0, 2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			hist := newTestHistory(start, tc.uptime, tc.dt)
+
+			var sel selection
+			if tc.last > 0 {
+				_, end := hist.fast.Span()
+				sel.end = end
+				sel.beg = end.Add(-tc.last)
+			}
+			if got, want := hist.archive(sel), tc.want; got != want {
+				t.Fatalf("invalid archive table: got=%d, want=%d", got, want)
+			}
+		})
+	}
+}
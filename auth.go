@@ -0,0 +1,236 @@
+// Copyright 2018 The solid-mon-rpi Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// role is the access level of an authenticated client.
+type role int
+
+const (
+	roleNone     role = iota
+	roleReader        // read-only access
+	roleOperator      // read-write access (non-GET requests)
+)
+
+func (r role) String() string {
+	switch r {
+	case roleReader:
+		return "reader"
+	case roleOperator:
+		return "operator"
+	}
+	return "none"
+}
+
+func parseRole(s string) (role, error) {
+	switch strings.ToLower(s) {
+	case "reader":
+		return roleReader, nil
+	case "operator":
+		return roleOperator, nil
+	}
+	return roleNone, fmt.Errorf("auth: invalid role %q", s)
+}
+
+// account is a user or an API token allowed to access the server.
+type account struct {
+	name     string
+	role     role
+	hash     [sha256.Size]byte // SHA-256 of the token
+	password []byte            // bcrypt hash of the user password
+}
+
+// credentials holds the accounts allowed to access the server, loaded
+// from a credentials file:
+//
+//	<credentials>
+//		<user  name="alice" role="operator" password="$2y$10$Ko1nc3Y0gJ0Q..."/>
+//		<token name="crate-display" role="reader" secret="sha256:2bb80d537b1d..."/>
+//	</credentials>
+//
+// Users authenticate with HTTP basic auth, and tokens with an
+// "Authorization: Bearer <token>" header.
+// Passwords are stored as bcrypt hashes, and tokens (random secrets, not
+// chosen by humans) as their hex-encoded SHA-256.
+type credentials struct {
+	users  map[string]account
+	tokens map[[sha256.Size]byte]account
+}
+
+// loadCredentials loads the credentials file fname.
+func loadCredentials(fname string) (*credentials, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, fmt.Errorf("auth: could not open credentials file: %w", err)
+	}
+	defer f.Close()
+
+	if fi, err := f.Stat(); err == nil && fi.Mode().Perm()&0077 != 0 {
+		log.Printf("auth: credentials file %q is accessible by other users (mode=%v)", fname, fi.Mode().Perm())
+	}
+
+	var raw struct {
+		XMLName xml.Name `xml:"credentials"`
+		Users   []struct {
+			Name     string `xml:"name,attr"`
+			Role     string `xml:"role,attr"`
+			Password string `xml:"password,attr"`
+		} `xml:"user"`
+		Tokens []struct {
+			Name   string `xml:"name,attr"`
+			Role   string `xml:"role,attr"`
+			Secret string `xml:"secret,attr"`
+		} `xml:"token"`
+	}
+	err = xml.NewDecoder(f).Decode(&raw)
+	if err != nil {
+		return nil, fmt.Errorf("auth: could not decode credentials file %q: %w", fname, err)
+	}
+
+	cred := &credentials{
+		users:  make(map[string]account),
+		tokens: make(map[[sha256.Size]byte]account),
+	}
+	for _, u := range raw.Users {
+		acct, err := newUser(u.Name, u.Role, u.Password)
+		if err != nil {
+			return nil, err
+		}
+		if strings.Contains(acct.name, ":") {
+			return nil, fmt.Errorf("auth: invalid user name %q", acct.name)
+		}
+		if _, dup := cred.users[acct.name]; dup {
+			return nil, fmt.Errorf("auth: duplicate user %q", acct.name)
+		}
+		cred.users[acct.name] = acct
+	}
+	for _, tok := range raw.Tokens {
+		acct, err := newToken(tok.Name, tok.Role, tok.Secret)
+		if err != nil {
+			return nil, err
+		}
+		if _, dup := cred.tokens[acct.hash]; dup {
+			return nil, fmt.Errorf("auth: duplicate token %q", acct.name)
+		}
+		cred.tokens[acct.hash] = acct
+	}
+	if len(cred.users)+len(cred.tokens) == 0 {
+		return nil, fmt.Errorf("auth: no user nor token in credentials file %q", fname)
+	}
+	return cred, nil
+}
+
+func newAccount(name, rstr string) (account, error) {
+	acct := account{name: name}
+	if name == "" {
+		return acct, fmt.Errorf("auth: account with no name")
+	}
+	var err error
+	acct.role, err = parseRole(rstr)
+	if err != nil {
+		return acct, fmt.Errorf("auth: account %q: %w", name, err)
+	}
+	return acct, nil
+}
+
+// newUser returns the account of a user authenticated by the password
+// with the provided bcrypt hash.
+func newUser(name, rstr, password string) (account, error) {
+	acct, err := newAccount(name, rstr)
+	if err != nil {
+		return acct, err
+	}
+	if _, err := bcrypt.Cost([]byte(password)); err != nil {
+		return acct, fmt.Errorf("auth: account %q: password is not a bcrypt hash", name)
+	}
+	acct.password = []byte(password)
+	return acct, nil
+}
+
+// newToken returns the account of an API token with the provided
+// hex-encoded SHA-256 hash.
+func newToken(name, rstr, secret string) (account, error) {
+	acct, err := newAccount(name, rstr)
+	if err != nil {
+		return acct, err
+	}
+	v, ok := strings.CutPrefix(secret, "sha256:")
+	if !ok {
+		return acct, fmt.Errorf("auth: account %q: secret is not a sha256: hash", name)
+	}
+	raw, err := hex.DecodeString(v)
+	if err != nil || len(raw) != sha256.Size {
+		return acct, fmt.Errorf("auth: account %q: invalid sha256 hash", name)
+	}
+	copy(acct.hash[:], raw)
+	return acct, nil
+}
+
+// authenticate returns the account of the client issuing the request.
+func (cred *credentials) authenticate(r *http.Request) (account, error) {
+	if user, pass, ok := r.BasicAuth(); ok {
+		acct, ok := cred.users[user]
+		if !ok || bcrypt.CompareHashAndPassword(acct.password, []byte(pass)) != nil {
+			// do not tell clients which user names exist.
+			log.Printf("auth: invalid credentials for user %q from %s", user, r.RemoteAddr)
+			return account{}, errorf(http.StatusUnauthorized, "invalid credentials")
+		}
+		return acct, nil
+	}
+
+	if v := r.Header.Get("Authorization"); v != "" {
+		scheme, tok, _ := strings.Cut(v, " ")
+		if !strings.EqualFold(scheme, "Bearer") {
+			return account{}, errorf(http.StatusUnauthorized, "unsupported authorization scheme %q", scheme)
+		}
+		acct, ok := cred.tokens[sha256.Sum256([]byte(strings.TrimSpace(tok)))]
+		if !ok {
+			return account{}, errorf(http.StatusUnauthorized, "invalid token")
+		}
+		return acct, nil
+	}
+
+	return account{}, errorf(http.StatusUnauthorized, "authentication required")
+}
+
+// authorize checks the client issuing the request is allowed to.
+// Reading (GET and HEAD requests) requires the reader role, anything else
+// the operator role.
+// Everything is allowed when the server has no credentials.
+func (srv *server) authorize(r *http.Request) error {
+	if srv.creds == nil {
+		return nil
+	}
+	acct, err := srv.creds.authenticate(r)
+	if err != nil {
+		return err
+	}
+
+	need := roleReader
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+	default:
+		need = roleOperator
+	}
+	if acct.role < need {
+		return errorf(
+			http.StatusForbidden, "%q (%v) is not allowed to %s %s",
+			acct.name, acct.role, r.Method, r.URL.Path,
+		)
+	}
+	return nil
+}
@@ -0,0 +1,302 @@
+// Copyright 2018 The solid-mon-rpi Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func hashPassword(t *testing.T, password string) string {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(hash)
+}
+
+func writeCredentials(t *testing.T, content string) string {
+	t.Helper()
+	fname := filepath.Join(t.TempDir(), "credentials.xml")
+	err := os.WriteFile(fname, []byte(content), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fname
+}
+
+func TestLoadCredentials(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		content string
+		err     string
+	}{
+		{
+			name: "ok",
+			content: fmt.Sprintf(`<credentials>
+	<user name="alice" role="operator" password=%q/>
+	<token name="display" role="reader" secret=%q/>
+</credentials>`, hashPassword(t, "s3cr3t"), hashSecret("tok")),
+		},
+		{
+			name:    "empty",
+			content: `<credentials></credentials>`,
+			err:     "no user nor token",
+		},
+		{
+			name:    "invalid-role",
+			content: fmt.Sprintf(`<credentials><user name="bob" role="admin" password=%q/></credentials>`, hashPassword(t, "x")),
+			err:     `invalid role "admin"`,
+		},
+		{
+			name:    "plain-password",
+			content: `<credentials><user name="bob" role="reader" password="x"/></credentials>`,
+			err:     "not a bcrypt hash",
+		},
+		{
+			name:    "sha256-password",
+			content: fmt.Sprintf(`<credentials><user name="bob" role="reader" password=%q/></credentials>`, hashSecret("x")),
+			err:     "not a bcrypt hash",
+		},
+		{
+			name:    "plain-token",
+			content: `<credentials><token name="t" role="reader" secret="x"/></credentials>`,
+			err:     "not a sha256: hash",
+		},
+		{
+			name:    "invalid-hash",
+			content: `<credentials><token name="t" role="reader" secret="sha256:abcd"/></credentials>`,
+			err:     "invalid sha256 hash",
+		},
+		{
+			name: "duplicate-user",
+			content: fmt.Sprintf(`<credentials>
+	<user name="bob" role="reader" password=%q/>
+	<user name="bob" role="operator" password=%q/>
+</credentials>`, hashPassword(t, "x"), hashPassword(t, "y")),
+			err: `duplicate user "bob"`,
+		},
+		{
+			name:    "no-name",
+			content: fmt.Sprintf(`<credentials><token role="reader" secret=%q/></credentials>`, hashSecret("x")),
+			err:     "account with no name",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := loadCredentials(writeCredentials(t, tc.content))
+			switch {
+			case tc.err == "" && err != nil:
+				t.Fatalf("could not load credentials: %+v", err)
+			case tc.err != "" && err == nil:
+				t.Fatalf("expected an error")
+			case tc.err != "" && !strings.Contains(err.Error(), tc.err):
+				t.Fatalf("invalid error: got=%q, want=%q", err, tc.err)
+			}
+		})
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	creds, err := loadCredentials(writeCredentials(t, fmt.Sprintf(`<credentials>
+	<user name="alice" role="operator" password=%q/>
+	<user name="bob" role="reader" password=%q/>
+	<token name="display" role="reader" secret=%q/>
+	<token name="ctl" role="operator" secret=%q/>
+</credentials>`,
+		hashPassword(t, "alice-pass"), hashPassword(t, "bob-pass"),
+		hashSecret("reader-token"), hashSecret("operator-token"),
+	)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &server{creds: creds}
+	ts := httptest.NewServer(srv.wrap(func(w http.ResponseWriter, r *http.Request) error {
+		_, err := w.Write([]byte("ok"))
+		return err
+	}))
+	defer ts.Close()
+
+	for _, tc := range []struct {
+		name   string
+		method string
+		auth   func(req *http.Request)
+		code   int
+	}{
+		{
+			name:   "anonymous",
+			method: http.MethodGet,
+			code:   http.StatusUnauthorized,
+		},
+		{
+			name:   "reader-get",
+			method: http.MethodGet,
+			auth:   func(req *http.Request) { req.SetBasicAuth("bob", "bob-pass") },
+			code:   http.StatusOK,
+		},
+		{
+			name:   "reader-head",
+			method: http.MethodHead,
+			auth:   func(req *http.Request) { req.SetBasicAuth("bob", "bob-pass") },
+			code:   http.StatusOK,
+		},
+		{
+			name:   "reader-post",
+			method: http.MethodPost,
+			auth:   func(req *http.Request) { req.SetBasicAuth("bob", "bob-pass") },
+			code:   http.StatusForbidden,
+		},
+		{
+			name:   "operator-post",
+			method: http.MethodPost,
+			auth:   func(req *http.Request) { req.SetBasicAuth("alice", "alice-pass") },
+			code:   http.StatusOK,
+		},
+		{
+			name:   "bad-password",
+			method: http.MethodGet,
+			auth:   func(req *http.Request) { req.SetBasicAuth("alice", "bob-pass") },
+			code:   http.StatusUnauthorized,
+		},
+		{
+			name:   "unknown-user",
+			method: http.MethodGet,
+			auth:   func(req *http.Request) { req.SetBasicAuth("eve", "alice-pass") },
+			code:   http.StatusUnauthorized,
+		},
+		{
+			name:   "reader-token",
+			method: http.MethodGet,
+			auth:   func(req *http.Request) { req.Header.Set("Authorization", "Bearer reader-token") },
+			code:   http.StatusOK,
+		},
+		{
+			name:   "reader-token-delete",
+			method: http.MethodDelete,
+			auth:   func(req *http.Request) { req.Header.Set("Authorization", "Bearer reader-token") },
+			code:   http.StatusForbidden,
+		},
+		{
+			name:   "operator-token-put",
+			method: http.MethodPut,
+			auth:   func(req *http.Request) { req.Header.Set("Authorization", "bearer operator-token") },
+			code:   http.StatusOK,
+		},
+		{
+			name:   "bad-token",
+			method: http.MethodGet,
+			auth:   func(req *http.Request) { req.Header.Set("Authorization", "Bearer nope") },
+			code:   http.StatusUnauthorized,
+		},
+		{
+			name:   "bad-scheme",
+			method: http.MethodGet,
+			auth:   func(req *http.Request) { req.Header.Set("Authorization", "Digest reader-token") },
+			code:   http.StatusUnauthorized,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := http.NewRequest(tc.method, ts.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.auth != nil {
+				tc.auth(req)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got, want := resp.StatusCode, tc.code; got != want {
+				t.Fatalf("invalid status code: got=%d, want=%d", got, want)
+			}
+			hdr := resp.Header.Get("WWW-Authenticate")
+			if got, want := hdr != "", tc.code == http.StatusUnauthorized; got != want {
+				t.Fatalf("invalid WWW-Authenticate header: %q", hdr)
+			}
+			// user names are not disclosed to unauthenticated clients.
+			if tc.code == http.StatusUnauthorized && (bytes.Contains(body, []byte("alice")) || bytes.Contains(body, []byte("eve"))) {
+				t.Fatalf("user name leaked: %q", body)
+			}
+		})
+	}
+}
+
+func TestAuthorizeRoutes(t *testing.T) {
+	creds, err := loadCredentials(writeCredentials(t, fmt.Sprintf(
+		`<credentials><token name="display" role="reader" secret=%q/></credentials>`,
+		hashSecret("reader-token"),
+	)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &server{
+		creds:   creds,
+		dataReg: newRegistry(),
+		health:  newHealth(time.Second, nil),
+		stats:   newDAQStats(time.Second),
+	}
+	mux := http.NewServeMux()
+	srv.routes(mux)
+
+	for _, tc := range []struct {
+		url   string
+		token string
+		code  int
+	}{
+		// health and readiness probes need no credentials.
+		{"/healthz", "", http.StatusOK},
+		{"/readyz", "", http.StatusServiceUnavailable},
+		{"/api/stats", "", http.StatusUnauthorized},
+		{"/api/stats", "reader-token", http.StatusOK},
+	} {
+		t.Run(tc.url+"-"+tc.token, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tc.url, nil)
+			if tc.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tc.token)
+			}
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, req)
+			if got, want := rec.Code, tc.code; got != want {
+				t.Fatalf("invalid status code: got=%d, want=%d (%s)", got, want, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestAuthorizeDisabled(t *testing.T) {
+	srv := &server{}
+	for _, method := range []string{http.MethodGet, http.MethodPost} {
+		req := httptest.NewRequest(method, "/", nil)
+		if err := srv.authorize(req); err != nil {
+			t.Fatalf("%s: unexpected error: %+v", method, err)
+		}
+	}
+}
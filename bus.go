@@ -0,0 +1,302 @@
+// Copyright 2018 The solid-mon-rpi Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-daq/smbus"
+	"github.com/sbinet-solid/solid-mon-rpi/sensors"
+)
+
+// defaultRecover is the default number of consecutive failed acquisitions
+// after which a bus is recovered.
+const defaultRecover = 5
+
+// i2cBus is an I2C bus, with its multiplexer and sensors.
+// Each bus is driven by its own goroutine.
+type i2cBus struct {
+	id    int   // SMBus ID number (/dev/i2c-[ID])
+	addr  uint8 // SMBus address of the I2C multiplexer
+	descr []sensors.Descr
+	conn  *smbus.Conn
+	sched []schedule
+	slack time.Duration // tolerance on the acquisition ticker jitter (see schedule.due)
+
+	recover  int   // consecutive failed acquisitions before recovering the bus (0: never)
+	failures int   // consecutive failed acquisitions
+	resets   int64 // multiplexer resets issued by the successful reopenings
+
+	open func() (*smbus.Conn, error)                                 // opens the bus and resets its multiplexer
+	read func(*smbus.Conn, *sensors.Device) (sensors.Sensors, error) // reads a sensor
+
+	tick chan time.Time // acquisition requests
+}
+
+// schedule tracks when a sensor should be polled next.
+type schedule struct {
+	dev   *sensors.Device
+	every time.Duration
+	next  time.Time
+}
+
+// busData is the result of an acquisition on a given bus.
+type busData struct {
+	bus  *i2cBus
+	data sensors.Sensors
+	errs []sensorError // sensors which could not be read
+
+	dur     time.Duration // duration of the acquisition
+	timings []readTiming  // timing of each sensor reading
+
+	recovery *busRecovery // recovery of the bus following the acquisition, if any
+	resets   int64        // multiplexer resets issued by the recovery
+}
+
+// busRecovery is the outcome of the recovery of a bus.
+type busRecovery struct {
+	failures int   // consecutive failed acquisitions which triggered the recovery
+	err      error // error recovering the bus, if any
+}
+
+// err returns the errors of the acquisition, if any.
+func (v busData) err() error {
+	errs := make([]error, len(v.errs))
+	for i, e := range v.errs {
+		errs[i] = e
+	}
+	return errors.Join(errs...)
+}
+
+// errBusClosed is the error reading a sensor while its bus could not be
+// reopened.
+var errBusClosed = errors.New("bus closed")
+
+// sensorError is the error reading a sensor.
+type sensorError struct {
+	name string
+	err  error
+}
+
+func (e sensorError) Error() string { return fmt.Sprintf("sensor %q: %v", e.name, e.err) }
+func (e sensorError) Unwrap() error { return e.err }
+
+func newBus(cfg BusConfig, freq time.Duration) (*i2cBus, error) {
+	conn, err := smbus.Open(cfg.ID, cfg.Addr)
+	if err != nil {
+		return nil, fmt.Errorf(
+			"error opening SMBus connection (id=%d addr=0x%x): %v",
+			cfg.ID,
+			cfg.Addr,
+			err,
+		)
+	}
+
+	bus := &i2cBus{
+		id:      cfg.ID,
+		addr:    cfg.Addr,
+		descr:   cfg.Sensors,
+		conn:    conn,
+		sched:   make([]schedule, len(cfg.Sensors)),
+		recover: cfg.Recover,
+		tick:    make(chan time.Time),
+	}
+	switch {
+	case bus.recover == 0:
+		bus.recover = defaultRecover
+	case bus.recover < 0:
+		bus.recover = 0
+	}
+	bus.open = func() (*smbus.Conn, error) {
+		conn, err := smbus.Open(bus.id, bus.addr)
+		if err != nil {
+			return nil, err
+		}
+		// deselect all the channels of the multiplexer.
+		err = conn.WriteReg(bus.addr, 0x04, 0)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("could not reset multiplexer: %w", err)
+		}
+		return conn, nil
+	}
+	bus.read = func(conn *smbus.Conn, dev *sensors.Device) (sensors.Sensors, error) {
+		return dev.Read(conn, bus.addr)
+	}
+	for i, descr := range bus.descr {
+		every := descr.Descr().Interval
+		if every == 0 {
+			every = freq
+		}
+		bus.sched[i] = schedule{dev: sensors.NewDevice(descr), every: every}
+	}
+
+	return bus, nil
+}
+
+func (bus *i2cBus) String() string {
+	return fmt.Sprintf("/dev/i2c-%d", bus.id)
+}
+
+// period returns the shortest polling interval of the bus sensors.
+func (bus *i2cBus) period() time.Duration {
+	var min time.Duration
+	for _, s := range bus.sched {
+		if min == 0 || s.every < min {
+			min = s.every
+		}
+	}
+	return min
+}
+
+// run acquires data from the bus sensors each time it receives a tick,
+// until the tick channel is closed.
+// Only the sensors whose polling interval has elapsed are read.
+// Sensors are read one after the other, as they share the bus.
+// Buses failing repeatedly are recovered (see i2cBus.recovery.)
+func (bus *i2cBus) run(out chan<- busData) {
+	defer func() {
+		if bus.conn != nil {
+			bus.conn.Close()
+		}
+	}()
+
+	for now := range bus.tick {
+		start := time.Now()
+		data, errs, timings := bus.acquire(now)
+		dur := time.Since(start)
+		resets := bus.resets
+		recovery := bus.recovery(data, errs)
+		out <- busData{
+			bus:      bus,
+			data:     data,
+			errs:     errs,
+			dur:      dur,
+			timings:  timings,
+			recovery: recovery,
+			resets:   bus.resets - resets,
+		}
+	}
+}
+
+// recovery tracks the consecutive failed acquisitions of the bus, and
+// recovers it once there are too many of them: a device holding the bus
+// (e.g. SDA held low) makes every transaction fail until the bus is reset.
+//
+// The connection to the bus is closed and reopened, and the multiplexer
+// reset.
+// The device driver handles, bound to the previous connection, are
+// re-opened (and the chips re-initialized) on their next reading.
+// Recovery is attempted again after as many failed acquisitions, as long
+// as the bus is failing.
+func (bus *i2cBus) recovery(data sensors.Sensors, errs []sensorError) *busRecovery {
+	switch {
+	case len(data.Sensors) > 0:
+		bus.failures = 0
+		return nil
+	case len(errs) == 0:
+		// no sensor due.
+		return nil
+	}
+	bus.failures++
+	if bus.recover <= 0 || bus.failures%bus.recover != 0 {
+		return nil
+	}
+	return &busRecovery{failures: bus.failures, err: bus.reopen()}
+}
+
+// reopen closes and reopens the connection to the bus.
+func (bus *i2cBus) reopen() error {
+	if bus.conn != nil {
+		bus.conn.Close()
+		bus.conn = nil
+	}
+	conn, err := bus.open()
+	if err != nil {
+		return fmt.Errorf("could not reopen bus %v: %w", bus, err)
+	}
+	bus.resets++
+	bus.conn = conn
+	return nil
+}
+
+// acquire reads the sensors due at the provided time, and returns their
+// readings, the errors of the ones which could not be read and the timing
+// of each reading.
+func (bus *i2cBus) acquire(now time.Time) (sensors.Sensors, []sensorError, []readTiming) {
+	var (
+		vs      []sensors.Sensors
+		errs    []sensorError
+		timings []readTiming
+	)
+	for i := range bus.sched {
+		s := &bus.sched[i]
+		if !s.due(now, bus.slack) {
+			continue
+		}
+		if bus.conn == nil {
+			errs = append(errs, sensorError{name: s.dev.Name(), err: errBusClosed})
+			continue
+		}
+		inits, xfers := s.dev.Inits(), s.dev.Transactions()
+		start := time.Now()
+		v, err := bus.read(bus.conn, s.dev)
+		timings = append(timings, readTiming{
+			name:   s.dev.Name(),
+			dur:    time.Since(start),
+			failed: err != nil,
+			init:   s.dev.Inits() > inits,
+			xfers:  s.dev.Transactions() - xfers,
+		})
+		if err != nil {
+			errs = append(errs, sensorError{name: s.dev.Name(), err: err})
+			continue
+		}
+		vs = append(vs, v)
+	}
+
+	if len(vs) == 0 && len(errs) > 0 {
+		return sensors.Sensors{}, errs, timings
+	}
+	return merge(now.UTC(), vs), errs, timings
+}
+
+// due returns whether the sensor should be polled at the provided time,
+// and schedules its next polling one interval after it.
+// The slack accounts for the jitter of the acquisition ticker: a sensor is
+// never polled more than slack before its interval has elapsed.
+// Intervals which are not a multiple of the acquisition period are thus
+// rounded up to the next tick.
+func (s *schedule) due(now time.Time, slack time.Duration) bool {
+	if now.Add(slack).Before(s.next) {
+		return false
+	}
+	s.next = now.Add(s.every)
+	return true
+}
+
+// merge merges multiple sensors data snapshots (acquired from different
+// sensors or buses) into a single one.
+func merge(ts time.Time, vs []sensors.Sensors) sensors.Sensors {
+	n := 0
+	for _, v := range vs {
+		n += len(v.Sensors)
+	}
+
+	data := sensors.Sensors{
+		Timestamp: ts,
+		Sensors:   make([]sensors.Data, 0, n),
+		Labels:    make(map[string][]sensors.Type, n),
+	}
+	for _, v := range vs {
+		data.Sensors = append(data.Sensors, v.Sensors...)
+		for k, types := range v.Labels {
+			data.Labels[k] = append(data.Labels[k], types...)
+		}
+	}
+	return data
+}
@@ -0,0 +1,173 @@
+// Copyright 2018 The solid-mon-rpi Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/go-daq/smbus"
+	"github.com/sbinet-solid/solid-mon-rpi/sensors"
+)
+
+func TestSchedule(t *testing.T) {
+	const (
+		tick  = 500 * time.Millisecond
+		slack = tick / 10
+	)
+	t0 := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for _, tc := range []struct {
+		name  string
+		every time.Duration
+		want  int
+	}{
+		{"fast", tick, 20},
+		{"slow", 2 * time.Second, 5},
+		// not a multiple of the tick: rounded up to 3 ticks.
+		{"odd", 1200 * time.Millisecond, 7},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var (
+				s    = schedule{every: tc.every}
+				n    int
+				last time.Time
+			)
+			for i := 0; i < 20; i++ {
+				// add some jitter to the ticker.
+				jitter := time.Duration(i%3-1) * 10 * time.Millisecond
+				now := t0.Add(time.Duration(i)*tick + jitter)
+				if !s.due(now, slack) {
+					continue
+				}
+				if n > 0 && now.Sub(last) < tc.every-slack {
+					t.Fatalf("sensor polled too early: got=%v, want=%v", now.Sub(last), tc.every)
+				}
+				n++
+				last = now
+			}
+			if n != tc.want {
+				t.Fatalf("invalid number of polls: got=%d, want=%d", n, tc.want)
+			}
+		})
+	}
+}
+
+func TestBusRecovery(t *testing.T) {
+	var (
+		nopen   int
+		openErr error
+		readErr error
+	)
+	bus := &i2cBus{
+		id:   1,
+		conn: new(smbus.Conn),
+		sched: []schedule{{
+			dev:   sensors.NewDevice(&sensors.DescrAT30TSE{DescrBase: sensors.DescrBase{Name: "temp-1"}}),
+			every: time.Second,
+		}},
+		recover: 3,
+		open: func() (*smbus.Conn, error) {
+			nopen++
+			if openErr != nil {
+				return nil, openErr
+			}
+			return new(smbus.Conn), nil
+		},
+		read: func(conn *smbus.Conn, dev *sensors.Device) (sensors.Sensors, error) {
+			if readErr != nil {
+				return sensors.Sensors{}, readErr
+			}
+			return sensors.Sensors{
+				Sensors: []sensors.Data{{Name: dev.Name(), Type: sensors.Temperature, Value: 20}},
+				Labels:  map[string][]sensors.Type{dev.Name(): {sensors.Temperature}},
+			}, nil
+		},
+	}
+
+	now := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	step := func() *busRecovery {
+		t.Helper()
+		data, errs, _ := bus.acquire(now)
+		now = now.Add(time.Second)
+		return bus.recovery(data, errs)
+	}
+
+	readErr = fmt.Errorf("i/o error")
+	for i := 1; i <= 6; i++ {
+		rec := step()
+		switch i % 3 {
+		case 0:
+			if rec == nil || rec.err != nil || rec.failures != i {
+				t.Fatalf("acquisition #%d: invalid recovery: %+v", i, rec)
+			}
+		default:
+			if rec != nil {
+				t.Fatalf("acquisition #%d: unexpected recovery: %+v", i, rec)
+			}
+		}
+	}
+	if nopen != 2 || bus.resets != 2 {
+		t.Fatalf("invalid number of bus reopenings: %d (resets=%d)", nopen, bus.resets)
+	}
+
+	// bus back to normal.
+	readErr = nil
+	if rec := step(); rec != nil || bus.failures != 0 {
+		t.Fatalf("unexpected recovery: %+v (failures=%d)", rec, bus.failures)
+	}
+	_, _, timings := bus.acquire(now.Add(-time.Second))
+	if len(timings) != 0 {
+		t.Fatalf("unexpected timings of sensors not due: %+v", timings)
+	}
+	readErr = fmt.Errorf("i/o error")
+	_, _, timings = bus.acquire(now)
+	if len(timings) != 1 || timings[0].name != "temp-1" || !timings[0].failed {
+		t.Fatalf("invalid timings: %+v", timings)
+	}
+	now = now.Add(time.Second)
+
+	// bus could not be reopened.
+	readErr = fmt.Errorf("i/o error")
+	openErr = fmt.Errorf("no such device")
+	step()
+	step()
+	if rec := step(); rec == nil || rec.err == nil {
+		t.Fatalf("expected a recovery error: %+v", rec)
+	}
+	if bus.conn != nil {
+		t.Fatalf("expected a closed bus")
+	}
+	data, errs, timings := bus.acquire(now)
+	if len(errs) != 1 || errs[0].err != errBusClosed {
+		t.Fatalf("invalid errors: %+v", errs)
+	}
+	if len(timings) != 0 {
+		t.Fatalf("unexpected timings of unread sensors: %+v", timings)
+	}
+	now = now.Add(time.Second)
+	bus.recovery(data, errs)
+
+	// bus eventually reopened.
+	openErr = nil
+	readErr = nil
+	step()
+	if rec := step(); rec == nil || rec.err != nil || bus.conn == nil {
+		t.Fatalf("invalid recovery: %+v", rec)
+	}
+	if rec := step(); rec != nil || bus.failures != 0 {
+		t.Fatalf("unexpected recovery: %+v (failures=%d)", rec, bus.failures)
+	}
+
+	// recovery disabled.
+	bus.recover = 0
+	readErr = fmt.Errorf("i/o error")
+	for i := 0; i < 10; i++ {
+		if rec := step(); rec != nil {
+			t.Fatalf("unexpected recovery: %+v", rec)
+		}
+	}
+}
@@ -7,6 +7,9 @@ package main
 import (
 	"encoding/xml"
 	"fmt"
+	"image/color"
+	"math"
+	"strconv"
 	"strings"
 	"time"
 
@@ -14,56 +17,398 @@ import (
 )
 
 type Config struct {
-	XMLName xml.Name        `xml:"data"`
-	Sensors []sensors.Descr `xml:"sensor"`
+	XMLName xml.Name          `xml:"data"`
+	Sensors []sensors.Descr   `xml:"sensor"`
+	Buses   []BusConfig       `xml:"bus"`
+	Derived []sensors.Derived `xml:"derived"`
+	Dash    Dashboard         `xml:"dashboard"`
 	Freq    time.Duration
 }
 
+// Dashboard describes the layout of the monitoring plots.
+type Dashboard struct {
+	Panels []Panel
+	Colors map[string]color.Color // colors of the sensors, by name
+}
+
+// Panel describes a monitoring plot, displaying a quantity for a group of
+// sensors.
+type Panel struct {
+	Title   string
+	Type    sensors.Type
+	Sensors []string // sensors to display (all sensors of that type if empty)
+	Min     float64  // y-axis range (automatic if Min == Max)
+	Max     float64
+	Log     bool // whether to use a logarithmic y-axis
+}
+
+// BusConfig describes an I2C bus, its multiplexer and the sensors
+// attached to it.
+type BusConfig struct {
+	ID      int   // SMBus ID number (/dev/i2c-[ID])
+	Addr    uint8 // SMBus address of the I2C multiplexer (0: use default)
+	Recover int   // consecutive failed acquisitions before recovering the bus (0: default, <0: never)
+	Sensors []sensors.Descr
+}
+
 func (cfg *Config) UnmarshalXML(dec *xml.Decoder, start xml.StartElement) error {
 	cfg.XMLName = start.Name
 
-	tokType := func(attrs []xml.Attr) string {
-		for _, attr := range attrs {
-			if attr.Name.Local == "type" {
-				return attr.Value
+	// decode inner elements
+	for {
+		t, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		switch tt := t.(type) {
+		case xml.StartElement:
+			switch tt.Name.Local {
+			case "bus":
+				var bus BusConfig
+				err = dec.DecodeElement(&bus, &tt)
+				if err != nil {
+					return err
+				}
+				cfg.Buses = append(cfg.Buses, bus)
+			case "derived":
+				var d sensors.Derived
+				err = dec.DecodeElement(&d, &tt)
+				if err != nil {
+					return err
+				}
+				cfg.Derived = append(cfg.Derived, d)
+			case "dashboard":
+				err = dec.DecodeElement(&cfg.Dash, &tt)
+				if err != nil {
+					return err
+				}
+			default:
+				descr, err := decodeSensor(dec, tt)
+				if err != nil {
+					return err
+				}
+				cfg.Sensors = append(cfg.Sensors, descr)
+			}
+		case xml.EndElement:
+			if tt == start.End() {
+				return nil
 			}
 		}
-		return "???"
+	}
+}
+
+func (bus *BusConfig) UnmarshalXML(dec *xml.Decoder, start xml.StartElement) error {
+	for _, attr := range start.Attr {
+		switch attr.Name.Local {
+		case "id":
+			v, err := strconv.Atoi(attr.Value)
+			if err != nil {
+				return fmt.Errorf("config: invalid bus id %q: %w", attr.Value, err)
+			}
+			bus.ID = v
+		case "addr":
+			v, err := strconv.ParseUint(attr.Value, 0, 64)
+			if err != nil {
+				return fmt.Errorf("config: invalid bus address %q: %w", attr.Value, err)
+			}
+			if v > math.MaxUint8 {
+				return fmt.Errorf("config: bus address value overflows uint8 (got=%v)", v)
+			}
+			bus.Addr = uint8(v)
+		case "recover":
+			v, err := strconv.Atoi(attr.Value)
+			if err != nil || v < 0 {
+				return fmt.Errorf("config: invalid bus recover threshold %q", attr.Value)
+			}
+			if v == 0 {
+				v = -1 // never recover.
+			}
+			bus.Recover = v
+		}
 	}
 
-	// decode inner elements
 	for {
 		t, err := dec.Token()
 		if err != nil {
 			return err
 		}
-		var descr sensors.Descr
 		switch tt := t.(type) {
 		case xml.StartElement:
-			switch tname := strings.ToLower(tokType(tt.Attr)); tname {
-			case "at30tse":
-				descr = new(sensors.DescrAT30TSE)
-			case "adc101x":
-				descr = new(sensors.DescrADC101x)
-			case "hts221":
-				descr = new(sensors.DescrHTS221)
-			case "onboard":
-				descr = new(sensors.DescrOnBoard)
-			case "bme280":
-				descr = new(sensors.DescrBME280)
-			default:
-				return fmt.Errorf("sensors: invalid type %q", tname)
-			}
-			err = dec.DecodeElement(descr, &tt)
+			descr, err := decodeSensor(dec, tt)
 			if err != nil {
 				return err
 			}
-			cfg.Sensors = append(cfg.Sensors, descr)
+			bus.Sensors = append(bus.Sensors, descr)
 		case xml.EndElement:
 			if tt == start.End() {
 				return nil
 			}
 		}
 	}
+}
+
+func (dash *Dashboard) UnmarshalXML(dec *xml.Decoder, start xml.StartElement) error {
+	var raw struct {
+		Panels []struct {
+			Title   string `xml:"title,attr"`
+			Type    string `xml:"type,attr"`
+			Min     string `xml:"ymin,attr"`
+			Max     string `xml:"ymax,attr"`
+			Log     bool   `xml:"log,attr"`
+			Sensors []struct {
+				Name  string `xml:"name,attr"`
+				Color string `xml:"color,attr"`
+			} `xml:"sensor"`
+		} `xml:"panel"`
+	}
+	err := dec.DecodeElement(&raw, &start)
+	if err != nil {
+		return err
+	}
+
+	parseFloat := func(v string) (float64, error) {
+		if v == "" {
+			return 0, nil
+		}
+		return strconv.ParseFloat(v, 64)
+	}
+
+	dash.Panels = make([]Panel, len(raw.Panels))
+	dash.Colors = make(map[string]color.Color)
+	for i, rp := range raw.Panels {
+		p := &dash.Panels[i]
+		p.Title = rp.Title
+		p.Type, err = sensors.ParseType(rp.Type)
+		if err != nil {
+			return fmt.Errorf("config: invalid dashboard panel %q: %w", rp.Title, err)
+		}
+		if p.Title == "" {
+			p.Title = p.Type.Title()
+		}
+		p.Min, err = parseFloat(rp.Min)
+		if err != nil {
+			return fmt.Errorf("config: invalid y-min for dashboard panel %q: %w", p.Title, err)
+		}
+		p.Max, err = parseFloat(rp.Max)
+		if err != nil {
+			return fmt.Errorf("config: invalid y-max for dashboard panel %q: %w", p.Title, err)
+		}
+		if p.Min > p.Max {
+			return fmt.Errorf("config: invalid y-range for dashboard panel %q", p.Title)
+		}
+		p.Log = rp.Log
+		if p.Log && p.Min != p.Max && p.Min <= 0 {
+			return fmt.Errorf("config: invalid y-range for log-scale dashboard panel %q", p.Title)
+		}
+		for _, rs := range rp.Sensors {
+			p.Sensors = append(p.Sensors, rs.Name)
+			if rs.Color == "" {
+				continue
+			}
+			col, err := parseColor(rs.Color)
+			if err != nil {
+				return fmt.Errorf("config: invalid color for sensor %q: %w", rs.Name, err)
+			}
+			// a sensor is drawn with the same color on all panels.
+			if old, dup := dash.Colors[rs.Name]; dup && old != col {
+				return fmt.Errorf("config: conflicting colors for sensor %q", rs.Name)
+			}
+			dash.Colors[rs.Name] = col
+		}
+	}
+
 	return nil
 }
+
+// parseColor parses a color in the #rrggbb or #rgb hexadecimal notation.
+func parseColor(v string) (color.Color, error) {
+	if !strings.HasPrefix(v, "#") {
+		return nil, fmt.Errorf("invalid color %q", v)
+	}
+	hex := v[1:]
+	if len(hex) == 3 {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+	}
+	if len(hex) != 6 {
+		return nil, fmt.Errorf("invalid color %q", v)
+	}
+	rgb, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid color %q", v)
+	}
+	return color.NRGBA{
+		R: uint8(rgb >> 16),
+		G: uint8(rgb >> 8),
+		B: uint8(rgb),
+		A: 0xff,
+	}, nil
+}
+
+func decodeSensor(dec *xml.Decoder, start xml.StartElement) (sensors.Descr, error) {
+	tokType := func(attrs []xml.Attr) string {
+		for _, attr := range attrs {
+			if attr.Name.Local == "type" {
+				return attr.Value
+			}
+		}
+		return "???"
+	}
+
+	var descr sensors.Descr
+	switch tname := strings.ToLower(tokType(start.Attr)); tname {
+	case "at30tse":
+		descr = new(sensors.DescrAT30TSE)
+	case "adc101x":
+		descr = new(sensors.DescrADC101x)
+	case "hts221":
+		descr = new(sensors.DescrHTS221)
+	case "onboard":
+		descr = new(sensors.DescrOnBoard)
+	case "bme280":
+		descr = new(sensors.DescrBME280)
+	default:
+		return nil, fmt.Errorf("sensors: invalid type %q", tname)
+	}
+	err := dec.DecodeElement(descr, &start)
+	if err != nil {
+		return nil, err
+	}
+	return descr, nil
+}
+
+// buses returns the list of I2C buses described by the configuration.
+// Sensors declared outside of any <bus> element are attached to the
+// default bus (id, addr).
+func (cfg *Config) buses(id int, addr uint8) ([]BusConfig, error) {
+	var (
+		buses []BusConfig
+		idx   = make(map[int]int)
+	)
+	add := func(bus BusConfig) error {
+		if bus.Addr == 0 {
+			bus.Addr = addr
+		}
+		i, dup := idx[bus.ID]
+		if !dup {
+			idx[bus.ID] = len(buses)
+			buses = append(buses, bus)
+			return nil
+		}
+		if buses[i].Addr != bus.Addr {
+			return fmt.Errorf(
+				"config: bus %d declared with different mux addresses (0x%x and 0x%x)",
+				bus.ID, buses[i].Addr, bus.Addr,
+			)
+		}
+		if buses[i].Recover == 0 {
+			buses[i].Recover = bus.Recover
+		}
+		buses[i].Sensors = append(buses[i].Sensors, bus.Sensors...)
+		return nil
+	}
+
+	if len(cfg.Sensors) > 0 || len(cfg.Buses) == 0 {
+		err := add(BusConfig{ID: id, Addr: addr, Sensors: cfg.Sensors})
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, bus := range cfg.Buses {
+		err := add(bus)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	names := make(map[string]int)
+	for _, bus := range buses {
+		for _, descr := range bus.Sensors {
+			name := descr.Descr().Name
+			if id, dup := names[name]; dup {
+				return nil, fmt.Errorf(
+					"config: duplicate sensor name %q (buses %d and %d)",
+					name, id, bus.ID,
+				)
+			}
+			names[name] = bus.ID
+		}
+	}
+
+	return buses, nil
+}
+
+// derived checks the derived sensors only depend on quantities measured by
+// the sensors attached to the provided buses, or by previously declared
+// derived sensors.
+func (cfg *Config) derived(buses []BusConfig) ([]sensors.Derived, error) {
+	known := make(map[sensors.Input]bool)
+	names := make(map[string]bool)
+	for _, bus := range buses {
+		for _, descr := range bus.Sensors {
+			name := descr.Descr().Name
+			names[name] = true
+			for _, typ := range sensors.Types(descr) {
+				known[sensors.Input{Name: name, Type: typ}] = true
+			}
+		}
+	}
+
+	for _, d := range cfg.Derived {
+		if names[d.Name] {
+			return nil, fmt.Errorf("config: duplicate sensor name %q for derived sensor", d.Name)
+		}
+		for _, in := range d.Inputs {
+			if !known[in] {
+				return nil, fmt.Errorf("config: derived sensor %q depends on unknown quantity %v", d.Name, in)
+			}
+		}
+		names[d.Name] = true
+		known[sensors.Input{Name: d.Name, Type: d.Type()}] = true
+	}
+
+	return cfg.Derived, nil
+}
+
+// panels returns the dashboard panels.
+// When no panel is configured, one panel per type of quantity is created.
+func (cfg *Config) panels(buses []BusConfig, derived []sensors.Derived) ([]Panel, error) {
+	known := make(map[sensors.Input]bool)
+	set := make(map[sensors.Type]bool)
+	for _, bus := range buses {
+		for _, descr := range bus.Sensors {
+			for _, typ := range sensors.Types(descr) {
+				known[sensors.Input{Name: descr.Descr().Name, Type: typ}] = true
+				set[typ] = true
+			}
+		}
+	}
+	for i := range derived {
+		d := &derived[i]
+		known[sensors.Input{Name: d.Name, Type: d.Type()}] = true
+		set[d.Type()] = true
+	}
+
+	if len(cfg.Dash.Panels) == 0 {
+		var panels []Panel
+		for _, typ := range sensors.AllTypes() {
+			if !set[typ] {
+				continue
+			}
+			panels = append(panels, Panel{
+				Title: typ.Title(),
+				Type:  typ,
+			})
+		}
+		return panels, nil
+	}
+
+	for _, p := range cfg.Dash.Panels {
+		for _, name := range p.Sensors {
+			in := sensors.Input{Name: name, Type: p.Type}
+			if !known[in] {
+				return nil, fmt.Errorf("config: dashboard panel %q displays unknown quantity %v", p.Title, in)
+			}
+		}
+	}
+	return cfg.Dash.Panels, nil
+}
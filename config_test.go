@@ -7,8 +7,11 @@ package main
 import (
 	"bytes"
 	"encoding/xml"
+	"fmt"
+	"image/color"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/sbinet-solid/solid-mon-rpi/sensors"
 )
@@ -20,7 +23,7 @@ func TestConfigXML(t *testing.T) {
 	<sensor name="dev-2" channel="3" type="AT30TSE" i2c-addr="0x2d"/>
 	<sensor name="dev-3" channel="3" type="ADC101x" i2c-addr="0x3d" vdd="3.2"/>
 	<sensor name="dev-4" channel="3" type="ADC101x" i2c-addr="0x4d" vdd="3.2" full-range="256"/>
-	<sensor name="dev-5" channel="3" type="HTS221"  i2c-addr="0x5d"/>
+	<sensor name="dev-5" channel="3" type="HTS221"  i2c-addr="0x5d" interval="1m"/>
 	<sensor name="dev-6" channel="3" type="Onboard" i2c-addr="0x6d"/>
 	<sensor name="dev-7" channel="3" type="BME280"  i2c-addr="0x6d"/>
 </data>
@@ -33,10 +36,10 @@ func TestConfigXML(t *testing.T) {
 	}
 
 	want := []sensors.Descr{
-		&sensors.DescrAT30TSE{sensors.DescrBase{
+		&sensors.DescrAT30TSE{DescrBase: sensors.DescrBase{
 			Name: "dev-1", ChanID: 3, Type: "AT30TSE", I2CAddr: 0},
 		},
-		&sensors.DescrAT30TSE{sensors.DescrBase{
+		&sensors.DescrAT30TSE{DescrBase: sensors.DescrBase{
 			Name: "dev-2", ChanID: 3, Type: "AT30TSE", I2CAddr: 0x2d},
 		},
 		&sensors.DescrADC101x{
@@ -53,13 +56,13 @@ func TestConfigXML(t *testing.T) {
 			Vdd:       3.2,
 			FullRange: 256,
 		},
-		&sensors.DescrHTS221{sensors.DescrBase{
-			Name: "dev-5", ChanID: 3, Type: "HTS221", I2CAddr: 0x5d},
+		&sensors.DescrHTS221{DescrBase: sensors.DescrBase{
+			Name: "dev-5", ChanID: 3, Type: "HTS221", I2CAddr: 0x5d, Interval: time.Minute},
 		},
-		&sensors.DescrOnBoard{sensors.DescrBase{
+		&sensors.DescrOnBoard{DescrBase: sensors.DescrBase{
 			Name: "dev-6", ChanID: 3, Type: "Onboard", I2CAddr: 0x6d},
 		},
-		&sensors.DescrBME280{sensors.DescrBase{
+		&sensors.DescrBME280{DescrBase: sensors.DescrBase{
 			Name: "dev-7", ChanID: 3, Type: "BME280", I2CAddr: 0x6d},
 		},
 	}
@@ -67,3 +70,290 @@ func TestConfigXML(t *testing.T) {
 		t.Fatalf("error:\ngot= %v\nwant=%v\n", cfg.Sensors, want)
 	}
 }
+
+func TestConfigBuses(t *testing.T) {
+	const raw = `<?xml version="1.0"?>
+<data>
+	<sensor name="dev-1" channel="3" type="AT30TSE"/>
+	<bus id="3" recover="3">
+		<sensor name="dev-2" channel="1" type="HTS221"/>
+	</bus>
+	<bus id="4" addr="0x71" recover="0">
+		<sensor name="dev-3" channel="2" type="BME280" i2c-addr="0x6d"/>
+	</bus>
+	<bus id="1">
+		<sensor name="dev-4" channel="4" type="AT30TSE"/>
+	</bus>
+</data>
+`
+
+	var cfg Config
+	err := xml.NewDecoder(bytes.NewReader([]byte(raw))).Decode(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buses, err := cfg.buses(1, 0x70)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []BusConfig{
+		{
+			ID: 1, Addr: 0x70,
+			Sensors: []sensors.Descr{
+				&sensors.DescrAT30TSE{DescrBase: sensors.DescrBase{
+					Name: "dev-1", ChanID: 3, Type: "AT30TSE"},
+				},
+				&sensors.DescrAT30TSE{DescrBase: sensors.DescrBase{
+					Name: "dev-4", ChanID: 4, Type: "AT30TSE"},
+				},
+			},
+		},
+		{
+			ID: 3, Addr: 0x70, Recover: 3,
+			Sensors: []sensors.Descr{
+				&sensors.DescrHTS221{DescrBase: sensors.DescrBase{
+					Name: "dev-2", ChanID: 1, Type: "HTS221"},
+				},
+			},
+		},
+		{
+			ID: 4, Addr: 0x71, Recover: -1,
+			Sensors: []sensors.Descr{
+				&sensors.DescrBME280{DescrBase: sensors.DescrBase{
+					Name: "dev-3", ChanID: 2, Type: "BME280", I2CAddr: 0x6d},
+				},
+			},
+		},
+	}
+	if !reflect.DeepEqual(want, buses) {
+		t.Fatalf("error:\ngot= %v\nwant=%v\n", buses, want)
+	}
+
+	for _, tc := range []struct {
+		name string
+		raw  string
+	}{
+		{
+			name: "dup-name",
+			raw: `<data>
+	<sensor name="dev-1" channel="3" type="AT30TSE"/>
+	<bus id="2"><sensor name="dev-1" channel="3" type="AT30TSE"/></bus>
+</data>`,
+		},
+		{
+			name: "dup-name-same-bus",
+			raw: `<data>
+	<bus id="2">
+		<sensor name="dev-1" channel="3" type="AT30TSE"/>
+		<sensor name="dev-1" channel="4" type="AT30TSE"/>
+	</bus>
+</data>`,
+		},
+		{
+			name: "mux-addr",
+			raw: `<data>
+	<bus id="2" addr="0x70"><sensor name="dev-1" channel="3" type="AT30TSE"/></bus>
+	<bus id="2" addr="0x71"><sensor name="dev-2" channel="3" type="AT30TSE"/></bus>
+</data>`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var cfg Config
+			err := xml.NewDecoder(bytes.NewReader([]byte(tc.raw))).Decode(&cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = cfg.buses(1, 0x70)
+			if err == nil {
+				t.Fatalf("expected an error")
+			}
+		})
+	}
+}
+
+func TestConfigBusAddr(t *testing.T) {
+	for _, tc := range []struct {
+		addr string
+		want uint8
+		err  bool
+	}{
+		{addr: "0x70", want: 0x70},
+		{addr: "0xff", want: 0xff},
+		{addr: "0x100", err: true},
+		{addr: "-1", err: true},
+	} {
+		t.Run(tc.addr, func(t *testing.T) {
+			raw := fmt.Sprintf(`<data><bus id="2" addr=%q><sensor name="dev-1" channel="3" type="AT30TSE"/></bus></data>`, tc.addr)
+			var cfg Config
+			err := xml.NewDecoder(bytes.NewReader([]byte(raw))).Decode(&cfg)
+			switch {
+			case tc.err && err == nil:
+				t.Fatalf("expected an error")
+			case tc.err:
+				return
+			case err != nil:
+				t.Fatalf("could not decode config: %+v", err)
+			}
+			if got, want := cfg.Buses[0].Addr, tc.want; got != want {
+				t.Fatalf("invalid bus address: got=0x%x, want=0x%x", got, want)
+			}
+		})
+	}
+}
+
+func TestConfigDerived(t *testing.T) {
+	const raw = `<?xml version="1.0"?>
+<data>
+	<sensor name="hts" channel="1" type="HTS221"/>
+	<sensor name="t1" channel="3" type="AT30TSE"/>
+	<derived name="dp" type="dew-point">
+		<input sensor="hts" type="temperature"/>
+		<input sensor="hts" type="humidity"/>
+	</derived>
+	<derived name="delta" type="difference">
+		<input sensor="dp" type="temperature"/>
+		<input sensor="t1" type="temperature"/>
+	</derived>
+	<derived name="bad" type="average">
+		<input sensor="t1" type="humidity"/>
+	</derived>
+</data>
+`
+
+	var cfg Config
+	err := xml.NewDecoder(bytes.NewReader([]byte(raw))).Decode(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buses, err := cfg.buses(1, 0x70)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = cfg.derived(buses)
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+
+	cfg.Derived = cfg.Derived[:2]
+	derived, err := cfg.derived(buses)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(derived), 2; got != want {
+		t.Fatalf("invalid number of derived sensors: got=%d, want=%d", got, want)
+	}
+}
+
+func TestConfigDashboard(t *testing.T) {
+	const raw = `<?xml version="1.0"?>
+<data>
+	<sensor name="hts" channel="1" type="HTS221"/>
+	<sensor name="t1" channel="3" type="AT30TSE"/>
+	<sensor name="t2" channel="3" type="AT30TSE" i2c-addr="0x4d"/>
+	<dashboard>
+		<panel title="Detector" type="temperature" ymin="15" ymax="30">
+			<sensor name="t1" color="#ff0000"/>
+			<sensor name="t2" color="#0f0"/>
+		</panel>
+		<panel type="humidity" log="true"/>
+	</dashboard>
+</data>
+`
+
+	var cfg Config
+	err := xml.NewDecoder(bytes.NewReader([]byte(raw))).Decode(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buses, err := cfg.buses(1, 0x70)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	panels, err := cfg.panels(buses, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Panel{
+		{Title: "Detector", Type: sensors.Temperature, Sensors: []string{"t1", "t2"}, Min: 15, Max: 30},
+		{Title: "Humidity", Type: sensors.Humidity, Log: true},
+	}
+	if !reflect.DeepEqual(panels, want) {
+		t.Fatalf("invalid panels:\ngot= %+v\nwant=%+v", panels, want)
+	}
+
+	wantColors := map[string]color.Color{
+		"t1": color.NRGBA{R: 0xff, A: 0xff},
+		"t2": color.NRGBA{G: 0xff, A: 0xff},
+	}
+	if !reflect.DeepEqual(cfg.Dash.Colors, wantColors) {
+		t.Fatalf("invalid colors:\ngot= %+v\nwant=%+v", cfg.Dash.Colors, wantColors)
+	}
+
+	cfg.Dash.Panels[1].Sensors = append(cfg.Dash.Panels[1].Sensors, "t1")
+	_, err = cfg.panels(buses, nil)
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+
+	cfg.Dash.Panels = nil
+	panels, err = cfg.panels(buses, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []Panel{
+		{Title: "Humidity", Type: sensors.Humidity},
+		{Title: "Temperature", Type: sensors.Temperature},
+	}
+	if !reflect.DeepEqual(panels, want) {
+		t.Fatalf("invalid default panels:\ngot= %+v\nwant=%+v", panels, want)
+	}
+}
+
+func TestConfigDashboardColors(t *testing.T) {
+	const raw = `<?xml version="1.0"?>
+<data>
+	<sensor name="hts" channel="1" type="HTS221"/>
+	<dashboard>
+		<panel type="temperature">
+			<sensor name="hts" color="%s"/>
+		</panel>
+		<panel type="humidity">
+			<sensor name="hts" color="%s"/>
+		</panel>
+	</dashboard>
+</data>
+`
+
+	for _, tc := range []struct {
+		c1, c2 string
+		err    bool
+	}{
+		{"#ff0000", "#f00", false},
+		{"#ff0000", "", false},
+		{"#ff0000", "#00ff00", true},
+	} {
+		t.Run(tc.c1+tc.c2, func(t *testing.T) {
+			var cfg Config
+			err := xml.NewDecoder(bytes.NewReader([]byte(fmt.Sprintf(raw, tc.c1, tc.c2)))).Decode(&cfg)
+			switch {
+			case err != nil && !tc.err:
+				t.Fatal(err)
+			case err == nil && tc.err:
+				t.Fatalf("expected an error")
+			case err != nil:
+				return
+			}
+			want := map[string]color.Color{"hts": color.NRGBA{R: 0xff, A: 0xff}}
+			if !reflect.DeepEqual(cfg.Dash.Colors, want) {
+				t.Fatalf("invalid colors:\ngot= %+v\nwant=%+v", cfg.Dash.Colors, want)
+			}
+		})
+	}
+}
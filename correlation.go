@@ -0,0 +1,231 @@
+// Copyright 2018 The solid-mon-rpi Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"image/color"
+	"net/http"
+	"net/url"
+
+	"github.com/sbinet-solid/solid-mon-rpi/sensors"
+	"go-hep.org/x/hep/hbook"
+	"go-hep.org/x/hep/hplot"
+	gstat "gonum.org/v1/gonum/stat"
+	"gonum.org/v1/plot/plotter"
+	"gonum.org/v1/plot/vg"
+	"gonum.org/v1/plot/vg/draw"
+)
+
+// correlationBins is the number of bins, along each axis, of the
+// correlation 2D histograms.
+const correlationBins = 30
+
+// correlation holds the pairs of values of two quantities sampled at the
+// same time.
+type correlation struct {
+	x, y   sensors.Input
+	xs, ys []float64
+}
+
+// correlationPlot creates the plot of a quantity against another one, from
+// the following query parameters:
+//   - x, y: names of the sensors,
+//   - xtype, ytype: types of the quantities (optional when the sensor
+//     measures a single quantity),
+//   - kind: scatter (default) or hist2d.
+//
+// Values are paired when they were sampled during the same acquisition
+// (fast monitoring window) or the same trend bucket (longer time windows.)
+// The plot displays the linear fit of y as a function of x.
+func correlationPlot(q url.Values, hist history, sel selection, colors map[string]color.Color) (*hplot.Plot, error) {
+	kind := q.Get("kind")
+	switch kind {
+	case "":
+		kind = "scatter"
+	case "scatter", "hist2d":
+	default:
+		return nil, errorf(http.StatusBadRequest, "invalid 'kind' parameter %q", kind)
+	}
+
+	// sensors selected with the 'sensor' parameter are irrelevant here.
+	sel.names = nil
+
+	var (
+		cor correlation
+		src = hist.source(sel)
+		err error
+	)
+	switch src {
+	case -1:
+		tbl := sel.table(hist.fast)
+		cor.x, cor.y, err = parseCorrelation(q, tbl)
+		if err != nil {
+			return nil, err
+		}
+		for _, row := range tbl {
+			x, okx := row.Value(cor.x.Name, cor.x.Type)
+			y, oky := row.Value(cor.y.Name, cor.y.Type)
+			if okx && oky {
+				cor.add(x, y)
+			}
+		}
+	default:
+		tbl := sel.trend(hist.trends[src])
+		cor.x, cor.y, err = parseCorrelation(q, tbl)
+		if err != nil {
+			return nil, err
+		}
+		for _, b := range tbl.buckets {
+			x, okx := b.Stats[cor.x]
+			y, oky := b.Stats[cor.y]
+			if okx && oky {
+				cor.add(x.Mean(), y.Mean())
+			}
+		}
+	}
+	if len(cor.xs) < 2 {
+		return nil, errorf(http.StatusNotFound, "not enough data for the requested correlation plot")
+	}
+
+	return cor.plot(kind, colors[cor.y.Name])
+}
+
+// parseCorrelation returns the quantities requested with the x, xtype, y and
+// ytype query parameters, among the ones present in data.
+func parseCorrelation(q url.Values, data timeSeries) (x, y sensors.Input, err error) {
+	for _, axis := range []string{"x", "y"} {
+		if q.Get(axis) == "" {
+			return x, y, errorf(http.StatusBadRequest, "missing %q parameter", axis)
+		}
+	}
+	for _, p := range []struct {
+		axis string
+		ptr  *sensors.Input
+	}{
+		{"x", &x},
+		{"y", &y},
+	} {
+		name := q.Get(p.axis)
+		var types []sensors.Type
+		for _, typ := range data.Types() {
+			for _, label := range data.Labels(typ) {
+				if label == name {
+					types = append(types, typ)
+				}
+			}
+		}
+
+		typ := sensors.InvalidType
+		switch v := q.Get(p.axis + "type"); v {
+		case "":
+			switch len(types) {
+			case 0:
+				return x, y, errorf(http.StatusNotFound, "no data for sensor %q", name)
+			case 1:
+				typ = types[0]
+			default:
+				return x, y, errorf(http.StatusBadRequest, "sensor %q measures %v: missing %q parameter", name, types, p.axis+"type")
+			}
+		default:
+			typ, err = sensors.ParseType(v)
+			if err != nil {
+				return x, y, errorf(http.StatusBadRequest, "invalid %q parameter: %v", p.axis+"type", err)
+			}
+			found := false
+			for _, t := range types {
+				found = found || t == typ
+			}
+			if !found {
+				return x, y, errorf(http.StatusNotFound, "no %v data for sensor %q", typ, name)
+			}
+		}
+		*p.ptr = sensors.Input{Name: name, Type: typ}
+	}
+	return x, y, nil
+}
+
+func (cor *correlation) add(x, y float64) {
+	cor.xs = append(cor.xs, x)
+	cor.ys = append(cor.ys, y)
+}
+
+// fit returns the parameters of the linear fit y = alpha + beta*x and the
+// correlation coefficient of the values.
+func (cor *correlation) fit() (alpha, beta, r float64) {
+	alpha, beta = gstat.LinearRegression(cor.xs, cor.ys, nil, false)
+	r = gstat.Correlation(cor.xs, cor.ys, nil)
+	return alpha, beta, r
+}
+
+// plot draws the correlation, with the provided color for the scatter
+// plot (the default one if nil.)
+func (cor *correlation) plot(kind string, c color.Color) (*hplot.Plot, error) {
+	p := hplot.New()
+	p.Title.Text = fmt.Sprintf("%v vs %v", cor.y, cor.x)
+	p.X.Label.Text = axisLabel(cor.x)
+	p.Y.Label.Text = axisLabel(cor.y)
+	p.Add(plotter.NewGrid())
+
+	xys := make(plotter.XYs, len(cor.xs))
+	for i := range xys {
+		xys[i] = plotter.XY{X: cor.xs[i], Y: cor.ys[i]}
+	}
+	xmin, xmax, ymin, ymax := plotter.XYRange(xys)
+
+	switch kind {
+	case "scatter":
+		sca, err := plotter.NewScatter(xys)
+		if err != nil {
+			return nil, err
+		}
+		sca.GlyphStyle.Shape = draw.CircleGlyph{}
+		sca.GlyphStyle.Radius = vg.Points(1.5)
+		if c != nil {
+			sca.GlyphStyle.Color = c
+		}
+		p.Add(sca)
+	case "hist2d":
+		xpad, ypad := histPad(xmin, xmax), histPad(ymin, ymax)
+		h := hbook.NewH2D(
+			correlationBins, xmin-xpad, xmax+xpad,
+			correlationBins, ymin-ypad, ymax+ypad,
+		)
+		for i := range cor.xs {
+			h.Fill(cor.xs[i], cor.ys[i], 1)
+		}
+		p.Add(hplot.NewH2D(h, nil))
+	}
+
+	alpha, beta, r := cor.fit()
+	line := plotter.NewFunction(func(x float64) float64 { return alpha + beta*x })
+	line.XMin = xmin
+	line.XMax = xmax
+	line.Color = color.RGBA{R: 255, A: 255}
+	line.Width = vg.Points(1.5)
+	p.Add(line)
+	p.Legend.Add(fmt.Sprintf("y = %.4g + %.4g x (r=%.3f, n=%d)", alpha, beta, r, len(cor.xs)), line)
+	p.Legend.Top = true
+
+	return p, nil
+}
+
+// histPad returns the padding to add on both sides of the [min, max] range
+// of a histogram axis, so the extremal values fall within the histogram.
+func histPad(min, max float64) float64 {
+	pad := 0.05 * (max - min)
+	if pad == 0 {
+		pad = 0.5
+	}
+	return pad
+}
+
+func axisLabel(in sensors.Input) string {
+	label := fmt.Sprintf("%s (%v)", in.Name, in.Type)
+	if unit := in.Type.Unit(); unit != "" {
+		label += " [" + unit + "]"
+	}
+	return label
+}
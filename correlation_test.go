@@ -0,0 +1,89 @@
+// Copyright 2018 The solid-mon-rpi Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/sbinet-solid/solid-mon-rpi/sensors"
+)
+
+func TestCorrelation(t *testing.T) {
+	t0 := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	table := newTestTable(t0)
+	// adc only sampled every other acquisition.
+	for i := 1; i < len(table); i += 2 {
+		table[i].Sensors = table[i].Sensors[:len(table[i].Sensors)-1]
+	}
+	hist := history{fast: sensors.Table(table)}
+
+	var cor correlation
+	cor.x, cor.y, _ = parseCorrelation(url.Values{"x": {"temp-0"}, "y": {"temp-3"}}, hist.fast)
+	for _, row := range hist.fast {
+		x, _ := row.Value(cor.x.Name, cor.x.Type)
+		y, _ := row.Value(cor.y.Name, cor.y.Type)
+		cor.add(x, y)
+	}
+	alpha, beta, r := cor.fit()
+	if math.Abs(alpha-3) > 1e-9 || math.Abs(beta-1) > 1e-9 || math.Abs(r-1) > 1e-9 {
+		t.Fatalf("invalid fit: alpha=%v, beta=%v, r=%v", alpha, beta, r)
+	}
+
+	for _, tc := range []struct {
+		q    url.Values
+		code int
+	}{
+		{url.Values{"x": {"temp-0"}, "y": {"adc"}}, http.StatusOK},
+		{url.Values{"x": {"temp-0"}, "y": {"adc"}, "ytype": {"voltage"}, "kind": {"hist2d"}}, http.StatusOK},
+		{url.Values{"x": {"temp-0"}}, http.StatusBadRequest},
+		{url.Values{"x": {"temp-0"}, "y": {"adc"}, "kind": {"pie"}}, http.StatusBadRequest},
+		{url.Values{"x": {"temp-0"}, "y": {"adc"}, "ytype": {"humidity"}}, http.StatusNotFound},
+		{url.Values{"x": {"temp-0"}, "y": {"not-there"}}, http.StatusNotFound},
+	} {
+		t.Run(tc.q.Encode(), func(t *testing.T) {
+			p, err := correlationPlot(tc.q, hist, selection{beg: t0}, nil)
+			code := http.StatusOK
+			if err != nil {
+				code = err.(*httpError).code
+			}
+			if code != tc.code {
+				t.Fatalf("invalid status code: got=%d, want=%d (err=%v)", code, tc.code, err)
+			}
+			if err == nil && p == nil {
+				t.Fatalf("nil plot")
+			}
+		})
+	}
+}
+
+func TestCorrelationDefaultWindow(t *testing.T) {
+	// server up for a few minutes: the trend tables only hold a few buckets.
+	now := time.Now().UTC()
+	srv := newHistoryServer(t, newTestHistory(now.Add(-10*time.Minute), 10*time.Minute, 2*time.Second))
+
+	for _, tc := range []struct {
+		url  string
+		code int
+	}{
+		{"/plots/correlation.svg?x=t&y=h&kind=hist2d", http.StatusOK},
+		{"/plots/correlation.svg?x=t&y=h", http.StatusOK},
+		{"/plots/correlation.svg?x=t&y=h&last=5m", http.StatusOK},
+		{"/plots/correlation.svg?x=t&y=h&from=2018-01-01T00:00:00Z&to=2018-01-02T00:00:00Z", http.StatusNotFound},
+	} {
+		t.Run(tc.url, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, tc.url, nil)
+			srv.wrap(srv.plotsHandler)(w, r)
+			if got, want := w.Code, tc.code; got != want {
+				t.Fatalf("invalid status code: got=%d, want=%d (%s)", got, want, w.Body.String())
+			}
+		})
+	}
+}
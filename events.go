@@ -0,0 +1,137 @@
+// Copyright 2018 The solid-mon-rpi Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sbinet-solid/solid-mon-rpi/sensors"
+)
+
+// eventsKeepAlive is the interval between two keep-alive comments sent on
+// idle event streams, so proxies do not close them.
+const eventsKeepAlive = 15 * time.Second
+
+// subscriber is a client of the sensors data stream.
+type subscriber struct {
+	since  time.Time            // timestamp of the last sample received by the client (if any)
+	replay []sensors.Sensors    // samples missed by the client, filled upon subscription
+	datac  chan sensors.Sensors // new samples (closed if the client falls behind)
+	ready  chan struct{}        // closed once the subscription is registered
+}
+
+func newSubscriber(since time.Time) *subscriber {
+	return &subscriber{
+		since: since,
+		datac: make(chan sensors.Sensors, 64),
+		ready: make(chan struct{}),
+	}
+}
+
+// eventsHandler streams the sensors data as Server-Sent Events:
+//
+//	id: <sample timestamp, in nanoseconds since the Unix epoch>
+//	event: data
+//	data: <sensors data, as served by /echo>
+//
+// A client reconnecting with the Last-Event-ID header first receives the
+// samples it missed, as long as they are still within the fast monitoring
+// window.
+// Clients too slow to keep up are disconnected, and may resume the same
+// way.
+func (srv *server) eventsHandler(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return errorf(http.StatusMethodNotAllowed, "invalid HTTP request (got=%v, want=%v)", r.Method, http.MethodGet)
+	}
+
+	var since time.Time
+	if v := strings.TrimSpace(r.Header.Get("Last-Event-ID")); v != "" {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return errorf(http.StatusBadRequest, "invalid Last-Event-ID %q", v)
+		}
+		since = time.Unix(0, id).UTC()
+	}
+
+	sub := newSubscriber(since)
+	timeout := time.NewTimer(2 * srv.freq)
+	defer timeout.Stop()
+	select {
+	case <-timeout.C:
+		return fmt.Errorf("timeout subscribing to sensors data")
+	case srv.subscribe <- sub:
+	}
+	defer func() { srv.unsubscribe <- sub }()
+	<-sub.ready
+
+	hdr := w.Header()
+	hdr.Set("Content-Type", "text/event-stream")
+	hdr.Set("Cache-Control", "no-cache")
+	hdr.Set("X-Accel-Buffering", "no") // disable buffering by nginx proxies
+	rc := http.NewResponseController(w)
+
+	log.Printf("new events client [%v] (replay=%d)...", r.RemoteAddr, len(sub.replay))
+	defer log.Printf("events client disconnected [%v]", r.RemoteAddr)
+
+	// from now on, errors only mean the client went away.
+	_, err := io.WriteString(w, "retry: 5000\n\n")
+	if err != nil {
+		return nil
+	}
+	for _, data := range sub.replay {
+		err = writeEvent(w, data)
+		if err != nil {
+			return nil
+		}
+	}
+	sub.replay = nil
+	if rc.Flush() != nil {
+		return nil
+	}
+
+	tick := time.NewTicker(eventsKeepAlive)
+	defer tick.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return nil
+		case data, ok := <-sub.datac:
+			if !ok {
+				// client fell behind.
+				return nil
+			}
+			err = writeEvent(w, data)
+		case <-tick.C:
+			_, err = io.WriteString(w, ": keep-alive\n\n")
+		}
+		if err == nil {
+			err = rc.Flush()
+		}
+		if err != nil {
+			return nil
+		}
+	}
+}
+
+// writeEvent writes the sensors data as a Server-Sent Event.
+func writeEvent(w io.Writer, data sensors.Sensors) error {
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "id: %d\nevent: data\ndata: ", data.Timestamp.UnixNano())
+	err := json.NewEncoder(buf).Encode(data) // adds the end-of-line.
+	if err != nil {
+		return err
+	}
+	buf.WriteString("\n")
+	_, err = w.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,120 @@
+// Copyright 2018 The solid-mon-rpi Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sbinet-solid/solid-mon-rpi/sensors"
+)
+
+func TestEvents(t *testing.T) {
+	srv := &server{
+		freq:        time.Second,
+		tick:        time.Second,
+		data:        make(chan sensors.Sensors),
+		plots:       make(chan Plots),
+		echo:        make(chan chan sensors.Sensors),
+		hist:        make(chan chan history),
+		subscribe:   make(chan *subscriber),
+		unsubscribe: make(chan *subscriber),
+	}
+	srv.windows.fast = time.Hour
+	srv.windows.trend = time.Hour
+	srv.health = newHealth(srv.tick, srv.buses)
+	go srv.mon()
+
+	t0 := time.Now().UTC().Truncate(time.Second)
+	table := newTestTable(t0)
+	for _, row := range table[:5] {
+		srv.data <- row
+	}
+
+	ts := httptest.NewServer(gzipHandler(srv.wrap(srv.eventsHandler)))
+	defer ts.Close()
+
+	// resume after the 3rd sample.
+	req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Last-Event-ID", strconv.FormatInt(table[2].Timestamp.UnixNano(), 10))
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("could not connect: %+v", err)
+	}
+	defer resp.Body.Close()
+
+	if got, want := resp.Header.Get("Content-Type"), "text/event-stream"; got != want {
+		t.Fatalf("invalid content-type: got=%q, want=%q", got, want)
+	}
+	if got := resp.Header.Get("Content-Encoding"); got != "" {
+		t.Fatalf("unexpected content-encoding: %q", got)
+	}
+
+	go func() {
+		for _, row := range table[5:] {
+			srv.data <- row
+		}
+	}()
+
+	sc := bufio.NewScanner(resp.Body)
+	sc.Buffer(nil, 1<<20)
+	var (
+		ids  []int64
+		n    int // number of data events
+		data sensors.Sensors
+	)
+	for n < len(table)-3 && sc.Scan() {
+		line := sc.Text()
+		switch {
+		case strings.HasPrefix(line, "id: "):
+			id, err := strconv.ParseInt(strings.TrimPrefix(line, "id: "), 10, 64)
+			if err != nil {
+				t.Fatalf("invalid event id %q: %+v", line, err)
+			}
+			ids = append(ids, id)
+		case strings.HasPrefix(line, "data: "):
+			err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &data)
+			if err != nil {
+				t.Fatalf("invalid event data %q: %+v", line, err)
+			}
+			n++
+		}
+	}
+	if err := sc.Err(); err != nil {
+		t.Fatalf("could not read events: %+v", err)
+	}
+
+	for i, id := range ids {
+		if got, want := id, table[i+3].Timestamp.UnixNano(); got != want {
+			t.Fatalf("invalid event #%d: got=%d, want=%d", i, got, want)
+		}
+	}
+	if got, want := len(ids), len(table)-3; got != want {
+		t.Fatalf("invalid number of events: got=%d, want=%d", got, want)
+	}
+	if !data.Timestamp.Equal(table[len(table)-1].Timestamp) || len(data.Sensors) != len(table[0].Sensors) {
+		t.Fatalf("invalid last event: %+v", data)
+	}
+
+	req.Header.Set("Last-Event-ID", "not-a-number")
+	resp, err = http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("could not connect: %+v", err)
+	}
+	resp.Body.Close()
+	if got, want := resp.StatusCode, http.StatusBadRequest; got != want {
+		t.Fatalf("invalid status code: got=%d, want=%d", got, want)
+	}
+}
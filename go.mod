@@ -5,7 +5,9 @@ go 1.20
 require (
 	github.com/go-daq/smbus v0.0.0-20201216173259-5725b4593606
 	go-hep.org/x/hep v0.34.1
+	golang.org/x/crypto v0.14.0
 	golang.org/x/net v0.17.0
+	gonum.org/v1/gonum v0.14.0
 	gonum.org/v1/plot v0.14.0
 )
 
@@ -23,6 +25,5 @@ require (
 	golang.org/x/image v0.13.0 // indirect
 	golang.org/x/sync v0.4.0 // indirect
 	golang.org/x/text v0.13.0 // indirect
-	gonum.org/v1/gonum v0.14.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -0,0 +1,316 @@
+// Copyright 2018 The solid-mon-rpi Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// health tracks the progress of the data acquisition, for the health and
+// readiness endpoints.
+//
+// Unlike the rest of the server state, owned by its goroutines, health is
+// guarded by a mutex: it must remain readable when those goroutines are
+// stuck (e.g. on an unresponsive I2C bus.)
+type health struct {
+	start   time.Time
+	timeout time.Duration // time after which a goroutine not making progress is considered stuck
+	stale   time.Duration // time after which the last successful acquisition is considered stale
+
+	mu      sync.Mutex
+	beats   map[string]time.Time // last progress of each goroutine
+	last    time.Time            // last successful acquisition
+	buses   map[string]*busHealth
+	sensors map[string]*sensorHealth
+	storage storageHealth
+}
+
+// healthGoroutines are the goroutines whose progress is tracked: the data
+// acquisition, the storage and monitoring of the data, and the broadcast of
+// the dashboard updates.
+var healthGoroutines = []string{"daq", "mon", "run"}
+
+type busHealth struct {
+	Connected bool      `json:"connected"`            // whether the last acquisition on the bus succeeded
+	Last      time.Time `json:"last_success"`         // last successful acquisition on the bus
+	Failures  int       `json:"consecutive_failures"` // number of acquisitions failing since then
+	Errors    int64     `json:"errors"`               // total number of failed acquisitions
+	LastError string    `json:"last_error,omitempty"`
+
+	Recoveries    int64     `json:"recoveries"`    // number of recoveries of the bus
+	LastRecovery  time.Time `json:"last_recovery"` // time of the last recovery
+	RecoveryError string    `json:"recovery_error,omitempty"`
+}
+
+type sensorHealth struct {
+	Failing   bool      `json:"failing"` // whether the last reading of the sensor failed
+	Last      time.Time `json:"last_success"`
+	Errors    int64     `json:"errors"` // total number of failed readings
+	LastError string    `json:"last_error,omitempty"`
+}
+
+type storageHealth struct {
+	Last    time.Time `json:"last_sample"`  // timestamp of the last stored sample
+	Samples int       `json:"fast_samples"` // number of samples in the fast monitoring window
+}
+
+func newHealth(tick time.Duration, buses []*i2cBus) *health {
+	timeout := 5 * tick
+	if timeout < 10*time.Second {
+		timeout = 10 * time.Second
+	}
+	// sensors may be polled much less often than the acquisition ticks:
+	// data is stale once the slowest of them missed its polling.
+	var every time.Duration
+	for _, bus := range buses {
+		for _, s := range bus.sched {
+			if s.every > every {
+				every = s.every
+			}
+		}
+	}
+	h := &health{
+		start:   time.Now().UTC(),
+		timeout: timeout,
+		stale:   every + timeout,
+		beats:   make(map[string]time.Time),
+		buses:   make(map[string]*busHealth),
+		sensors: make(map[string]*sensorHealth),
+	}
+	for _, name := range healthGoroutines {
+		h.beats[name] = h.start
+	}
+	for _, bus := range buses {
+		h.buses[bus.String()] = &busHealth{}
+		for _, descr := range bus.descr {
+			h.sensors[descr.Descr().Name] = &sensorHealth{}
+		}
+	}
+	return h
+}
+
+// beat records the progress of the named goroutine.
+// The monitoring and broadcast goroutines beat periodically, from their
+// event loop, so they are alive as long as they are responsive; the data
+// acquisition beats once all buses are done with an acquisition.
+func (h *health) beat(name string, now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.beats[name] = now
+}
+
+// acquired records the outcome of an acquisition on a bus.
+func (h *health) acquired(now time.Time, v busData) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, d := range v.data.Sensors {
+		h.sensor(d.Name).succeeded(now)
+	}
+	for _, e := range v.errs {
+		h.sensor(e.name).failed(e.err)
+	}
+
+	bus, ok := h.buses[v.bus.String()]
+	if !ok {
+		bus = new(busHealth)
+		h.buses[v.bus.String()] = bus
+	}
+	switch {
+	case len(v.data.Sensors) > 0:
+		bus.Connected = true
+		bus.Last = now
+		bus.Failures = 0
+		h.last = now
+	case len(v.errs) > 0:
+		bus.Connected = false
+		bus.Failures++
+		bus.Errors++
+		bus.LastError = v.err().Error()
+	}
+
+	if rec := v.recovery; rec != nil {
+		bus.Recoveries++
+		bus.LastRecovery = now
+		bus.RecoveryError = ""
+		if rec.err != nil {
+			bus.RecoveryError = rec.err.Error()
+		}
+	}
+}
+
+// derived records the outcome of the computation of a derived sensor.
+func (h *health) derived(now time.Time, name string, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s := h.sensor(name)
+	switch err {
+	case nil:
+		s.succeeded(now)
+	default:
+		s.failed(err)
+	}
+}
+
+func (h *health) sensor(name string) *sensorHealth {
+	s, ok := h.sensors[name]
+	if !ok {
+		s = new(sensorHealth)
+		h.sensors[name] = s
+	}
+	return s
+}
+
+func (s *sensorHealth) succeeded(now time.Time) {
+	s.Failing = false
+	s.Last = now
+}
+
+func (s *sensorHealth) failed(err error) {
+	s.Failing = true
+	s.Errors++
+	s.LastError = err.Error()
+}
+
+// stored records the storage of a new sample in the fast monitoring
+// window.
+func (h *health) stored(ts time.Time, n int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.storage = storageHealth{Last: ts, Samples: n}
+}
+
+// healthReport is the response of the health and readiness endpoints.
+// Ages are in seconds.
+type healthReport struct {
+	Status  string    `json:"status"` // ok, degraded (some buses or sensors failing) or failing
+	Healthy bool      `json:"healthy"`
+	Ready   bool      `json:"ready"`
+	Time    time.Time `json:"time"`
+	Uptime  float64   `json:"uptime"`
+	Version string    `json:"version"`
+
+	LastAcquisition    time.Time `json:"last_acquisition"`
+	LastAcquisitionAge float64   `json:"last_acquisition_age"`
+
+	Buses      map[string]busHealth       `json:"buses"`
+	Sensors    map[string]sensorHealth    `json:"sensors"`
+	Storage    storageHealth              `json:"storage"`
+	Goroutines map[string]goroutineHealth `json:"goroutines"`
+	Dropped    int64                      `json:"dropped_messages"` // websocket messages dropped for slow clients
+}
+
+type goroutineHealth struct {
+	Alive bool      `json:"alive"`
+	Last  time.Time `json:"last_progress"`
+	Age   float64   `json:"age"`
+}
+
+// report returns the state of the server at the provided time.
+//
+// The server is healthy as long as all its goroutines make progress, and
+// ready once data is acquired and stored.
+// It is degraded while some buses or sensors fail.
+func (h *health) report(now time.Time) healthReport {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	age := func(t time.Time) float64 {
+		if t.IsZero() {
+			return 0
+		}
+		return now.Sub(t).Seconds()
+	}
+
+	rep := healthReport{
+		Healthy: true,
+		Time:    now,
+		Uptime:  now.Sub(h.start).Seconds(),
+		Version: Version,
+
+		LastAcquisition:    h.last,
+		LastAcquisitionAge: age(h.last),
+
+		Buses:      make(map[string]busHealth, len(h.buses)),
+		Sensors:    make(map[string]sensorHealth, len(h.sensors)),
+		Storage:    h.storage,
+		Goroutines: make(map[string]goroutineHealth, len(h.beats)),
+	}
+
+	names := make([]string, 0, len(h.beats))
+	for name := range h.beats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		last := h.beats[name]
+		g := goroutineHealth{
+			Alive: now.Sub(last) <= h.timeout,
+			Last:  last,
+			Age:   age(last),
+		}
+		rep.Goroutines[name] = g
+		rep.Healthy = rep.Healthy && g.Alive
+	}
+
+	degraded := false
+	for name, bus := range h.buses {
+		rep.Buses[name] = *bus
+		degraded = degraded || bus.Failures > 0
+	}
+	for name, s := range h.sensors {
+		rep.Sensors[name] = *s
+		degraded = degraded || s.Failing
+	}
+
+	rep.Ready = rep.Healthy &&
+		!h.last.IsZero() && now.Sub(h.last) <= h.stale &&
+		!h.storage.Last.IsZero()
+
+	switch {
+	case !rep.Healthy || !rep.Ready:
+		rep.Status = "failing"
+	case degraded:
+		rep.Status = "degraded"
+	default:
+		rep.Status = "ok"
+	}
+	return rep
+}
+
+// healthzHandler serves the health of the server: whether its goroutines
+// make progress (200 OK), or are stuck (503 Service Unavailable.)
+func (srv *server) healthzHandler(w http.ResponseWriter, r *http.Request) error {
+	return srv.serveHealth(w, r, func(rep healthReport) bool { return rep.Healthy })
+}
+
+// readyzHandler serves the readiness of the server: whether sensors data
+// is acquired and stored (200 OK), or not (503 Service Unavailable.)
+func (srv *server) readyzHandler(w http.ResponseWriter, r *http.Request) error {
+	return srv.serveHealth(w, r, func(rep healthReport) bool { return rep.Ready })
+}
+
+func (srv *server) serveHealth(w http.ResponseWriter, r *http.Request, ok func(rep healthReport) bool) error {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return errorf(http.StatusMethodNotAllowed, "invalid HTTP request (got=%v, want=%v)", r.Method, http.MethodGet)
+	}
+
+	rep := srv.health.report(time.Now().UTC())
+	rep.Dropped = srv.dataReg.dropped.Load()
+
+	code := http.StatusOK
+	if !ok(rep) {
+		code = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(code)
+	return json.NewEncoder(w).Encode(rep)
+}
@@ -0,0 +1,207 @@
+// Copyright 2018 The solid-mon-rpi Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/sbinet-solid/solid-mon-rpi/sensors"
+)
+
+func TestHealth(t *testing.T) {
+	bus := &i2cBus{id: 1, descr: []sensors.Descr{
+		&sensors.DescrAT30TSE{DescrBase: sensors.DescrBase{Name: "temp-1"}},
+		&sensors.DescrAT30TSE{DescrBase: sensors.DescrBase{Name: "temp-2"}},
+	}}
+	h := newHealth(time.Second, []*i2cBus{bus})
+	t0 := h.start
+
+	rep := h.report(t0.Add(time.Second))
+	if !rep.Healthy || rep.Ready || rep.Status != "failing" {
+		t.Fatalf("invalid initial report: %+v", rep)
+	}
+
+	beat := func(now time.Time) {
+		for _, name := range healthGoroutines {
+			h.beat(name, now)
+		}
+	}
+
+	// successful acquisition.
+	t1 := t0.Add(2 * time.Second)
+	h.acquired(t1, busData{bus: bus, data: sensors.Sensors{
+		Timestamp: t1,
+		Sensors: []sensors.Data{
+			{Name: "temp-1", Type: sensors.Temperature, Value: 20},
+			{Name: "temp-2", Type: sensors.Temperature, Value: 21},
+		},
+	}})
+	h.stored(t1, 1)
+	beat(t1)
+	rep = h.report(t1.Add(time.Second))
+	if !rep.Healthy || !rep.Ready || rep.Status != "ok" {
+		t.Fatalf("invalid report: %+v", rep)
+	}
+	if got, want := rep.LastAcquisitionAge, 1.0; got != want {
+		t.Fatalf("invalid acquisition age: got=%v, want=%v", got, want)
+	}
+
+	// one sensor failing.
+	t2 := t1.Add(time.Second)
+	h.acquired(t2, busData{
+		bus: bus,
+		data: sensors.Sensors{
+			Timestamp: t2,
+			Sensors:   []sensors.Data{{Name: "temp-1", Type: sensors.Temperature, Value: 20}},
+		},
+		errs: []sensorError{{name: "temp-2", err: fmt.Errorf("i/o error")}},
+	})
+	beat(t2)
+	rep = h.report(t2)
+	if !rep.Ready || rep.Status != "degraded" {
+		t.Fatalf("invalid report: %+v", rep)
+	}
+	if s := rep.Sensors["temp-2"]; !s.Failing || s.Errors != 1 || s.LastError != "i/o error" {
+		t.Fatalf("invalid sensor health: %+v", s)
+	}
+	if b := rep.Buses["/dev/i2c-1"]; !b.Connected || b.Failures != 0 {
+		t.Fatalf("invalid bus health: %+v", b)
+	}
+
+	// bus failing.
+	for i := 0; i < 3; i++ {
+		t2 = t2.Add(time.Second)
+		h.acquired(t2, busData{bus: bus, errs: []sensorError{
+			{name: "temp-1", err: fmt.Errorf("i/o error")},
+			{name: "temp-2", err: fmt.Errorf("i/o error")},
+		}})
+		beat(t2)
+	}
+	h.acquired(t2, busData{
+		bus:      bus,
+		errs:     []sensorError{{name: "temp-1", err: fmt.Errorf("i/o error")}},
+		recovery: &busRecovery{failures: 4, err: fmt.Errorf("no such device")},
+	})
+	rep = h.report(t2)
+	if b := rep.Buses["/dev/i2c-1"]; b.Connected || b.Failures != 4 || b.Errors != 4 ||
+		b.Recoveries != 1 || b.LastRecovery != t2 || b.RecoveryError != "no such device" {
+		t.Fatalf("invalid bus health: %+v", b)
+	}
+	if !rep.Healthy || !rep.Ready || rep.Status != "degraded" {
+		t.Fatalf("invalid report: %+v", rep)
+	}
+
+	// no data for too long.
+	t3 := h.last.Add(h.stale + time.Second)
+	beat(t3)
+	rep = h.report(t3)
+	if !rep.Healthy || rep.Ready || rep.Status != "failing" {
+		t.Fatalf("invalid report: %+v", rep)
+	}
+
+	// stuck acquisition.
+	h.beat("mon", t3.Add(h.timeout))
+	h.beat("run", t3.Add(h.timeout))
+	rep = h.report(t3.Add(h.timeout + time.Second))
+	if rep.Healthy || rep.Goroutines["daq"].Alive || !rep.Goroutines["mon"].Alive {
+		t.Fatalf("invalid report: %+v", rep)
+	}
+}
+
+func TestHealthSlowSchedule(t *testing.T) {
+	// all sensors polled once a minute, with ticks every other second.
+	const tick = 2 * time.Second
+	bus := &i2cBus{id: 1, sched: []schedule{
+		{dev: sensors.NewDevice(&sensors.DescrAT30TSE{DescrBase: sensors.DescrBase{Name: "temp-1"}}), every: time.Minute},
+		{dev: sensors.NewDevice(&sensors.DescrAT30TSE{DescrBase: sensors.DescrBase{Name: "temp-2"}}), every: time.Minute},
+	}}
+	h := newHealth(tick, []*i2cBus{bus})
+
+	t1 := h.start.Add(tick)
+	h.acquired(t1, busData{bus: bus, data: sensors.Sensors{
+		Timestamp: t1,
+		Sensors: []sensors.Data{
+			{Name: "temp-1", Type: sensors.Temperature, Value: 20},
+			{Name: "temp-2", Type: sensors.Temperature, Value: 21},
+		},
+	}})
+	h.stored(t1, 1)
+
+	// ticks without any sensor due.
+	for now := t1; now.Before(t1.Add(time.Minute + tick)); now = now.Add(tick) {
+		for _, name := range healthGoroutines {
+			h.beat(name, now)
+		}
+		rep := h.report(now)
+		if !rep.Healthy || !rep.Ready || rep.Status != "ok" {
+			t.Fatalf("invalid report %v after the last acquisition: %+v", now.Sub(t1), rep)
+		}
+	}
+
+	// the sensors missed their polling.
+	now := t1.Add(time.Minute + h.timeout + tick)
+	for _, name := range healthGoroutines {
+		h.beat(name, now)
+	}
+	if rep := h.report(now); rep.Ready || rep.Status != "failing" {
+		t.Fatalf("invalid report: %+v", rep)
+	}
+}
+
+func TestHealthHandlers(t *testing.T) {
+	srv := &server{
+		dataReg: newRegistry(),
+		health:  newHealth(time.Second, nil),
+	}
+
+	get := func(h http.HandlerFunc) (int, healthReport) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		h(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		var rep healthReport
+		err := json.Unmarshal(rec.Body.Bytes(), &rep)
+		if err != nil {
+			t.Fatalf("could not decode report: %+v", err)
+		}
+		if got, want := rec.Header().Get("Content-Type"), "application/json"; got != want {
+			t.Fatalf("invalid content type: got=%q, want=%q", got, want)
+		}
+		return rec.Code, rep
+	}
+
+	if code, _ := get(srv.wrap(srv.healthzHandler)); code != http.StatusOK {
+		t.Fatalf("invalid healthz status code: %d", code)
+	}
+	if code, _ := get(srv.wrap(srv.readyzHandler)); code != http.StatusServiceUnavailable {
+		t.Fatalf("invalid readyz status code: %d", code)
+	}
+
+	now := time.Now().UTC()
+	srv.health.acquired(now, busData{bus: &i2cBus{id: 1}, data: sensors.Sensors{
+		Timestamp: now,
+		Sensors:   []sensors.Data{{Name: "temp-1", Type: sensors.Temperature, Value: 20}},
+	}})
+	srv.health.stored(now, 1)
+	srv.dataReg.dropped.Add(2)
+
+	code, rep := get(srv.wrap(srv.readyzHandler))
+	if code != http.StatusOK {
+		t.Fatalf("invalid readyz status code: %d (%+v)", code, rep)
+	}
+	if rep.Status != "ok" || rep.Dropped != 2 || rep.Sensors["temp-1"].Last.IsZero() {
+		t.Fatalf("invalid report: %+v", rep)
+	}
+
+	rec := httptest.NewRecorder()
+	srv.wrap(srv.healthzHandler)(rec, httptest.NewRequest(http.MethodPost, "/", nil))
+	if got, want := rec.Code, http.StatusMethodNotAllowed; got != want {
+		t.Fatalf("invalid status code: got=%d, want=%d", got, want)
+	}
+}
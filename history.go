@@ -0,0 +1,227 @@
+// Copyright 2018 The solid-mon-rpi Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/sbinet-solid/solid-mon-rpi/sensors"
+)
+
+// history is a snapshot of the data kept in memory by the server.
+type history struct {
+	fast   sensors.Table
+	trends []trendTable // one table per trend bucket width
+	start  time.Time    // timestamp of the first sample acquired (zero: unknown)
+}
+
+// oldest returns the timestamp of the oldest sample held in memory.
+func (hist history) oldest() time.Time {
+	t := hist.start
+	if n := len(hist.trends); n > 0 && hist.trends[n-1].Len() > 0 {
+		// the first buckets of the coarsest trend may have been evicted.
+		if beg, _ := hist.trends[n-1].Span(); t.IsZero() || beg.After(t) {
+			t = beg
+		}
+	}
+	if beg, _ := hist.fast.Span(); hist.fast.Len() > 0 && (t.IsZero() || beg.Before(t)) {
+		t = beg
+	}
+	return t
+}
+
+// source returns the index of the finest trend table covering the time
+// range of the selection, or -1 if the fast table covers it.
+//
+// A table covers the selection when it holds the data since the beginning
+// of the selection, or since the oldest sample held if the selection
+// begins before (e.g. on a server up for less than the selection.)
+// As the oldest entries of the tables are continuously evicted, a table
+// is considered covering the selection when its oldest entry lies within
+// one sampling period (or bucket width) of that time.
+func (hist history) source(sel selection) int {
+	lim := hist.oldest()
+	if sel.beg.After(lim) {
+		lim = sel.beg
+	}
+	if n := hist.fast.Len(); n > 0 {
+		beg, end := hist.fast.Span()
+		var period time.Duration
+		if n > 1 {
+			period = end.Sub(beg) / time.Duration(n-1)
+		}
+		if !beg.After(lim.Add(period)) {
+			return -1
+		}
+	}
+	for i, tbl := range hist.trends {
+		if beg, _ := tbl.Span(); tbl.Len() > 0 && !beg.After(lim.Add(tbl.width)) {
+			return i
+		}
+	}
+	// time window longer than all the tables: use the one spanning the
+	// longest time interval.
+	return len(hist.trends) - 1
+}
+
+// history retrieves a snapshot of the data kept in memory.
+func (srv *server) history() (history, error) {
+	req := make(chan history, 1)
+	timeout := time.NewTimer(2 * srv.freq)
+	defer timeout.Stop()
+	select {
+	case <-timeout.C:
+		return history{}, fmt.Errorf("timeout retrieving history")
+	case srv.hist <- req:
+	}
+	return <-req, nil
+}
+
+// selection describes a subset of the data, selected by time range and
+// sensor names.
+type selection struct {
+	beg, end time.Time       // time range (zero values: unbounded)
+	names    map[string]bool // selected sensors (nil: all sensors)
+}
+
+// parseSelection parses a selection from the query parameters:
+//   - from, to: RFC 3339 timestamps delimiting the time range,
+//   - last: duration of the time range, ending now (e.g. last=30m),
+//   - sensor: name of a sensor to select (may be repeated.)
+func parseSelection(q url.Values) (selection, error) {
+	var (
+		sel selection
+		err error
+	)
+
+	if v := q.Get("last"); v != "" {
+		if q.Get("from") != "" {
+			return sel, errorf(http.StatusBadRequest, "invalid time range: both 'from' and 'last' parameters")
+		}
+		last, err := time.ParseDuration(v)
+		if err != nil || last <= 0 {
+			return sel, errorf(http.StatusBadRequest, "invalid 'last' parameter %q", v)
+		}
+		sel.end = time.Now().UTC()
+		sel.beg = sel.end.Add(-last)
+	}
+
+	for _, p := range []struct {
+		name string
+		ptr  *time.Time
+	}{
+		{"from", &sel.beg},
+		{"to", &sel.end},
+	} {
+		v := q.Get(p.name)
+		if v == "" {
+			continue
+		}
+		*p.ptr, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			return sel, errorf(http.StatusBadRequest, "invalid %q parameter %q: %v", p.name, v, err)
+		}
+	}
+	if !sel.beg.IsZero() && !sel.end.IsZero() && !sel.beg.Before(sel.end) {
+		return sel, errorf(http.StatusBadRequest, "invalid time range [%v, %v]", sel.beg, sel.end)
+	}
+
+	for _, name := range q["sensor"] {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if sel.names == nil {
+			sel.names = make(map[string]bool)
+		}
+		sel.names[name] = true
+	}
+
+	return sel, nil
+}
+
+func (sel selection) contains(t time.Time) bool {
+	if !sel.beg.IsZero() && t.Before(sel.beg) {
+		return false
+	}
+	if !sel.end.IsZero() && t.After(sel.end) {
+		return false
+	}
+	return true
+}
+
+func (sel selection) selected(name string) bool {
+	return sel.names == nil || sel.names[name]
+}
+
+// table returns the snapshots of tbl within the selection.
+func (sel selection) table(tbl sensors.Table) sensors.Table {
+	o := make(sensors.Table, 0, len(tbl))
+	for _, row := range tbl {
+		if !sel.contains(row.Timestamp) {
+			continue
+		}
+		if sel.names == nil {
+			o = append(o, row)
+			continue
+		}
+		v := sensors.Sensors{
+			Timestamp: row.Timestamp,
+			Labels:    make(map[string][]sensors.Type),
+		}
+		for _, d := range row.Sensors {
+			if !sel.names[d.Name] {
+				continue
+			}
+			v.Sensors = append(v.Sensors, d)
+		}
+		for k, types := range row.Labels {
+			if sel.names[k] {
+				v.Labels[k] = types
+			}
+		}
+		if len(v.Sensors) == 0 {
+			continue
+		}
+		o = append(o, v)
+	}
+	return o
+}
+
+// trend returns the buckets of tbl within the selection.
+// A bucket is selected when its beginning lies within the time range.
+func (sel selection) trend(tbl trendTable) trendTable {
+	o := trendTable{
+		width:   tbl.width,
+		buckets: make([]bucket, 0, len(tbl.buckets)),
+	}
+	for _, b := range tbl.buckets {
+		if !sel.contains(b.Beg) {
+			continue
+		}
+		if sel.names == nil {
+			o.buckets = append(o.buckets, b)
+			continue
+		}
+		v := bucket{
+			Beg:   b.Beg,
+			Stats: make(map[sensors.Input]*stat),
+		}
+		for in, st := range b.Stats {
+			if sel.names[in.Name] {
+				v.Stats[in] = st
+			}
+		}
+		if len(v.Stats) == 0 {
+			continue
+		}
+		o.buckets = append(o.buckets, v)
+	}
+	return o
+}
@@ -0,0 +1,89 @@
+// Copyright 2018 The solid-mon-rpi Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sbinet-solid/solid-mon-rpi/sensors"
+)
+
+// newTestHistory returns the history of a server acquiring one sample
+// every dt during uptime, with the default time windows.
+func newTestHistory(start time.Time, uptime, dt time.Duration) history {
+	const fastWindow = time.Hour
+	fast := newRing(fastWindow, int(fastWindow/dt), func(v *sensors.Sensors) time.Time {
+		return v.Timestamp
+	})
+	trends := newTrends(0)
+	for i, ts := 0, start; !ts.After(start.Add(uptime)); i, ts = i+1, ts.Add(dt) {
+		row := sensors.Sensors{
+			Timestamp: ts,
+			Sensors: []sensors.Data{
+				{Name: "t", Type: sensors.Temperature, Value: float64(20 + i%10)},
+				{Name: "h", Type: sensors.Humidity, Value: float64(40 + i%7)},
+			},
+			Labels: map[string][]sensors.Type{
+				"t": {sensors.Temperature},
+				"h": {sensors.Humidity},
+			},
+		}
+		fast.add(row)
+		for _, tr := range trends {
+			tr.add(row)
+		}
+	}
+
+	hist := history{
+		fast:   sensors.Table(fast.slice()),
+		trends: make([]trendTable, len(trends)),
+		start:  start,
+	}
+	for i, tr := range trends {
+		hist.trends[i] = tr.table()
+	}
+	return hist
+}
+
+func TestHistorySource(t *testing.T) {
+	start := time.Date(2018, 1, 1, 10, 23, 17, 0, time.UTC)
+
+	for _, tc := range []struct {
+		name   string
+		uptime time.Duration
+		dt     time.Duration
+		last   time.Duration // 0: no time range
+		want   int
+	}{
+		{"young-all", 10 * time.Minute, 2 * time.Second, 0, -1},
+		{"young-5m", 10 * time.Minute, 2 * time.Second, 5 * time.Minute, -1},
+		{"young-24h", 10 * time.Minute, 2 * time.Second, 24 * time.Hour, -1},
+		{"young-168h", 10 * time.Minute, 2 * time.Second, 168 * time.Hour, -1},
+		{"hours-30m", 3 * time.Hour, 10 * time.Second, 30 * time.Minute, -1},
+		{"hours-1h", 3 * time.Hour, 10 * time.Second, time.Hour, -1},
+		{"hours-24h", 3 * time.Hour, 10 * time.Second, 24 * time.Hour, 0},
+		{"hours-all", 3 * time.Hour, 10 * time.Second, 0, 0},
+		{"days-24h", 8 * 24 * time.Hour, time.Minute, 24 * time.Hour, 0},
+		{"days-168h", 8 * 24 * time.Hour, time.Minute, 168 * time.Hour, 0},
+		{"days-240h", 8 * 24 * time.Hour, time.Minute, 240 * time.Hour, 1},
+		{"days-all", 8 * 24 * time.Hour, time.Minute, 0, 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			hist := newTestHistory(start, tc.uptime, tc.dt)
+
+			var sel selection
+			if tc.last > 0 {
+				// requested in between two samples.
+				_, end := hist.fast.Span()
+				sel.end = end.Add(tc.dt / 2)
+				sel.beg = sel.end.Add(-tc.last)
+			}
+			if got, want := hist.source(sel), tc.want; got != want {
+				t.Fatalf("invalid source: got=%d, want=%d", got, want)
+			}
+		})
+	}
+}
@@ -6,23 +6,22 @@ package main
 
 import (
 	"bytes"
+	"crypto/tls"
 	"encoding/json"
 	"encoding/xml"
+	"errors"
 	"flag"
 	"fmt"
-	"html/template"
+	"image/color"
 	"log"
 	"net"
 	"net/http"
 	"os"
 	"runtime"
-	"sort"
 	"time"
 
-	"github.com/go-daq/smbus"
 	"github.com/sbinet-solid/solid-mon-rpi/sensors"
 	"golang.org/x/net/websocket"
-	"gonum.org/v1/plot/palette/brewer"
 )
 
 var (
@@ -35,7 +34,14 @@ func main() {
 		busID   = flag.Int("bus-id", 0x1, "SMBus ID number (/dev/i2c-[ID]")
 		busAddr = flag.Int("bus-addr", 0x70, "SMBus address to read/write")
 		freq    = flag.Duration("freq", 2*time.Second, "data polling interval")
+		fastWin = flag.Duration("fast-window", time.Hour, "time window of the fast monitoring plots")
+		slowWin = flag.Duration("trend-window", 7*24*time.Hour, "time window of the trend monitoring plots")
 		cfgFlag = flag.String("cfg", "", "path to an XML configuration file for sensors")
+		webDir  = flag.String("web-dir", "", "path to a directory to serve the web UI from, instead of the embedded one (development)")
+		auth    = flag.String("auth", "", "path to an XML credentials file enabling authentication")
+		tlsCert = flag.String("tls-cert", "", "path to a PEM certificate file, to serve HTTPS")
+		tlsKey  = flag.String("tls-key", "", "path to the PEM private key file of the certificate")
+		tlsSelf = flag.Bool("tls-self-signed", false, "generate a self-signed certificate at -tls-cert and -tls-key, if they do not exist")
 		version = flag.Bool("version", false, "display version and exit")
 	)
 
@@ -49,14 +55,8 @@ func main() {
 		os.Exit(0)
 	}
 
-	log.Printf("starting up web-server on: %v\n", *addr)
-	srv, err := newServer(*addr, *freq, *busID, *busAddr)
-	if err != nil {
-		log.Fatalf("error starting server: %v", err)
-	}
-
+	var cfg Config
 	if *cfgFlag != "" {
-		var cfg Config
 		f, err := os.Open(*cfgFlag)
 		if err != nil {
 			log.Fatal(err)
@@ -67,85 +67,224 @@ func main() {
 			log.Fatal(err)
 		}
 		log.Printf("cfg: %+v\n", cfg.Sensors)
-		srv.bus.descr = cfg.Sensors
+		for _, bus := range cfg.Buses {
+			log.Printf("cfg: bus=%d %+v\n", bus.ID, bus.Sensors)
+		}
+	}
 
-		set := make(map[string]int)
-		for _, descr := range srv.bus.descr {
-			set[descr.Descr().Name] = 1
+	buses, err := cfg.buses(*busID, uint8(*busAddr))
+	if err != nil {
+		log.Fatal(err)
+	}
+	derived, err := cfg.derived(buses)
+	if err != nil {
+		log.Fatal(err)
+	}
+	panels, err := cfg.panels(buses, derived)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var creds *credentials
+	if *auth != "" {
+		creds, err = loadCredentials(*auth)
+		if err != nil {
+			log.Fatal(err)
 		}
-		var labels []string
-		for k := range set {
-			labels = append(labels, k)
+	}
+
+	var tlsCfg *tls.Config
+	if *tlsCert != "" || *tlsKey != "" || *tlsSelf {
+		if *tlsSelf {
+			if *tlsCert == "" {
+				*tlsCert = "solid-mon-rpi.crt"
+			}
+			if *tlsKey == "" {
+				*tlsKey = "solid-mon-rpi.key"
+			}
 		}
-		sort.Strings(labels)
-		p, err := brewer.GetPalette(brewer.TypeAny, "Dark2", 8)
+		tlsCfg, err = tlsConfig(*tlsCert, *tlsKey, *addr, *tlsSelf)
 		if err != nil {
 			log.Fatal(err)
 		}
-		colors := p.Colors()
-		for i, label := range labels {
-			col := colors[i%len(colors)]
-			plotColors[label] = col
-		}
 	}
 
-	http.Handle("/", srv)
-	http.Handle("/data", websocket.Handler(srv.dataHandler))
-	http.HandleFunc("/echo", srv.wrap(srv.echoHandler))
+	log.Printf("starting up web-server on: %v\n", *addr)
+	srv, err := newServer(options{
+		addr:    *addr,
+		freq:    *freq,
+		buses:   buses,
+		derived: derived,
+		panels:  panels,
+		colors:  cfg.Dash.Colors,
+		fast:    *fastWin,
+		trend:   *slowWin,
+		webDir:  *webDir,
+		creds:   creds,
+	})
+	if err != nil {
+		log.Fatalf("error starting server: %v", err)
+	}
+
+	notifier, err := newNotifier()
+	if err != nil {
+		log.Printf("%v", err)
+	}
+	if notifier != nil {
+		go srv.sdnotify(notifier)
+	}
 
-	err = http.ListenAndServe(srv.addr, nil)
+	srv.routes(http.DefaultServeMux)
+
+	handler := gzipHandler(http.DefaultServeMux)
+	switch {
+	case tlsCfg != nil:
+		hsrv := &http.Server{
+			Addr:      srv.addr,
+			Handler:   handler,
+			TLSConfig: tlsCfg,
+		}
+		err = hsrv.ListenAndServeTLS("", "")
+	default:
+		err = http.ListenAndServe(srv.addr, handler)
+	}
 	if err != nil {
 		srv.quit <- 1
 		log.Fatalf("error running server: %v", err)
 	}
 }
 
+// options configures a server.
+type options struct {
+	addr    string
+	freq    time.Duration // default polling interval
+	buses   []BusConfig
+	derived []sensors.Derived
+	panels  []Panel                // layout of the monitoring plots
+	colors  map[string]color.Color // configured colors of the sensors
+	fast    time.Duration          // time window of the fast monitoring plots
+	trend   time.Duration          // time window of the trend monitoring plots
+	webDir  string                 // directory of the web UI assets (embedded ones if empty)
+	creds   *credentials           // accounts allowed to access the server (nil: no authentication)
+}
+
 type server struct {
 	addr string
 	freq time.Duration
+	tick time.Duration // acquisition period
 	quit chan int
 
-	bus struct {
-		id    int
-		addr  uint8
-		data  chan sensors.Sensors
-		descr []sensors.Descr
+	windows struct {
+		fast  time.Duration
+		trend time.Duration
 	}
 
-	tmpl    *template.Template
-	dataReg registry // clients interested in sensors data
+	buses   []*i2cBus
+	derived []sensors.Derived
+	every   map[string]time.Duration // polling interval of each sensor (derived ones included)
+	panels  []Panel                  // layout of the monitoring plots
+	colors  map[string]color.Color   // color of each sensor in the plots
+	data    chan sensors.Sensors
+
+	web     *webUI       // templates and static assets of the web interface
+	creds   *credentials // accounts allowed to access the server (nil: no authentication)
+	health  *health      // progress of the data acquisition
+	stats   *daqStats    // timing of the data acquisition
+	dataReg *registry    // clients interested in sensors data
 	plots   chan Plots
-	echo    chan sensors.Sensors
+	echo    chan chan sensors.Sensors
+	hist    chan chan history
+
+	subscribe   chan *subscriber // clients of the sensors data stream
+	unsubscribe chan *subscriber
 }
 
-func newServer(addr string, freq time.Duration, busID, busAddr int) (*server, error) {
+func newServer(opts options) (*server, error) {
+	addr := opts.addr
 	if addr == "" {
 		addr = getHostIP() + ":80"
 	}
 
 	srv := &server{
 		addr:    addr,
-		freq:    freq,
+		freq:    opts.freq,
 		quit:    make(chan int),
+		derived: opts.derived,
+		panels:  opts.panels,
+		creds:   opts.creds,
+		data:    make(chan sensors.Sensors),
 		dataReg: newRegistry(),
-		tmpl:    template.Must(template.New("fcs").Parse(indexTmpl)),
 		plots:   make(chan Plots),
-		echo:    make(chan sensors.Sensors),
+		echo:    make(chan chan sensors.Sensors),
+		hist:    make(chan chan history),
+
+		subscribe:   make(chan *subscriber),
+		unsubscribe: make(chan *subscriber),
+	}
+
+	web, err := newWebUI(opts.webDir)
+	if err != nil {
+		return nil, err
+	}
+	srv.web = web
+
+	srv.windows.fast = opts.fast
+	srv.windows.trend = opts.trend
+
+	for _, cfg := range opts.buses {
+		bus, err := newBus(cfg, srv.freq)
+		if err != nil {
+			for _, bus := range srv.buses {
+				bus.conn.Close()
+			}
+			return nil, err
+		}
+		srv.buses = append(srv.buses, bus)
 	}
-	srv.bus.id = busID
-	srv.bus.addr = uint8(busAddr)
-	srv.bus.data = make(chan sensors.Sensors)
 
-	conn, err := smbus.Open(srv.bus.id, srv.bus.addr)
+	srv.tick = srv.freq
+	for _, bus := range srv.buses {
+		if p := bus.period(); p > 0 && p < srv.tick {
+			srv.tick = p
+		}
+	}
+	for _, bus := range srv.buses {
+		bus.slack = srv.tick / 10
+	}
+	srv.every = make(map[string]time.Duration)
+	for _, bus := range srv.buses {
+		for _, s := range bus.sched {
+			srv.every[s.dev.Name()] = s.every
+		}
+	}
+	for _, d := range srv.derived {
+		// derived sensors are updated as often as their slowest input.
+		for _, in := range d.Inputs {
+			if every := srv.every[in.Name]; every > srv.every[d.Name] {
+				srv.every[d.Name] = every
+			}
+		}
+	}
+	var labels []string
+	for _, bus := range srv.buses {
+		for _, descr := range bus.descr {
+			labels = append(labels, descr.Descr().Name)
+		}
+	}
+	for _, d := range srv.derived {
+		labels = append(labels, d.Name)
+	}
+	srv.colors, err = plotColors(labels, opts.colors)
 	if err != nil {
-		return nil, fmt.Errorf(
-			"error opening SMBus connection (id=%d addr=0x%x): %v",
-			srv.bus.id,
-			srv.bus.addr,
-			err,
-		)
+		for _, bus := range srv.buses {
+			bus.conn.Close()
+		}
+		return nil, err
 	}
-	go srv.run(conn)
+
+	srv.health = newHealth(srv.tick, srv.buses)
+	srv.stats = newDAQStats(srv.tick)
+	go srv.run()
 
 	return srv, nil
 }
@@ -163,56 +302,119 @@ func (srv *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 func (srv *server) rootHandler(w http.ResponseWriter, r *http.Request) error {
-	return srv.tmpl.Execute(w, srv)
+	buf := new(bytes.Buffer)
+	err := srv.web.execute(buf, "index.html", srv)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+// routes registers the handlers of the server with mux.
+// The health and readiness endpoints are open to all clients, so
+// supervision probes do not need credentials.
+func (srv *server) routes(mux *http.ServeMux) {
+	mux.Handle("/", srv)
+	mux.HandleFunc("/static/", srv.wrap(srv.web.staticHandler))
+	mux.HandleFunc("/data", srv.wrap(srv.websocketHandler))
+	mux.HandleFunc("/echo", srv.wrap(srv.echoHandler))
+	mux.HandleFunc("/plots/", srv.wrap(srv.plotsHandler))
+	mux.HandleFunc("/stats", srv.wrap(srv.statsHandler))
+	mux.HandleFunc("/api/history", srv.wrap(srv.historyHandler))
+	mux.HandleFunc("/api/stats", srv.wrap(srv.daqStatsHandler))
+	mux.HandleFunc("/events", srv.wrap(srv.eventsHandler))
+	mux.HandleFunc("/healthz", srv.public(srv.healthzHandler))
+	mux.HandleFunc("/readyz", srv.public(srv.readyzHandler))
 }
 
+// wrap turns f into an HTTP handler, checking the client is authorized to
+// issue the request (see server.authorize) and reporting errors.
 func (srv *server) wrap(f func(w http.ResponseWriter, r *http.Request) error) http.HandlerFunc {
+	return srv.public(func(w http.ResponseWriter, r *http.Request) error {
+		err := srv.authorize(r)
+		if err != nil {
+			return err
+		}
+		return f(w, r)
+	})
+}
+
+// public turns f into an HTTP handler open to all clients, reporting
+// errors.
+func (srv *server) public(f func(w http.ResponseWriter, r *http.Request) error) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		err := f(w, r)
 		if err != nil {
 			log.Printf("error: %v", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			code := http.StatusInternalServerError
+			var herr *httpError
+			if errors.As(err, &herr) {
+				code = herr.code
+			}
+			if code == http.StatusUnauthorized {
+				w.Header().Set("WWW-Authenticate", `Basic realm="solid-mon-rpi", charset="UTF-8"`)
+			}
+			http.Error(w, err.Error(), code)
 			return
 		}
 	}
 }
 
+// httpError is an error with an associated HTTP status code.
+type httpError struct {
+	code int
+	err  error
+}
+
+func (e *httpError) Error() string { return e.err.Error() }
+func (e *httpError) Unwrap() error { return e.err }
+
+// errorf returns an error associated with the provided HTTP status code.
+func errorf(code int, format string, args ...interface{}) error {
+	return &httpError{code: code, err: fmt.Errorf(format, args...)}
+}
+
 func (srv *server) echoHandler(w http.ResponseWriter, r *http.Request) error {
 	if r.Method != http.MethodGet {
-		return fmt.Errorf("invalid HTTP request (got=%v, want=%v)", r.Method, http.MethodGet)
+		return errorf(http.StatusMethodNotAllowed, "invalid HTTP request (got=%v, want=%v)", r.Method, http.MethodGet)
 	}
+	req := make(chan sensors.Sensors, 1)
 	timeout := time.NewTimer(2 * srv.freq)
 	defer timeout.Stop()
 	select {
 	case <-timeout.C:
 		return fmt.Errorf("timeout retrieving data from board")
-	case data := <-srv.echo:
-		w.Header().Set("Content-Type", "application/json")
-		err := json.NewEncoder(w).Encode(data)
-		if err != nil {
-			return err
-		}
+	case srv.echo <- req:
 	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(<-req)
+}
+
+// websocketHandler serves the /data websocket.
+func (srv *server) websocketHandler(w http.ResponseWriter, r *http.Request) error {
+	websocket.Handler(srv.dataHandler).ServeHTTP(w, r)
 	return nil
 }
 
 func (srv *server) dataHandler(ws *websocket.Conn) {
 	log.Printf("new client...")
-	c := &client{
-		srv:   srv,
-		reg:   &srv.dataReg,
-		datac: make(chan []byte, 256),
-		ws:    ws,
-	}
+	c := newClient(srv, ws)
 	c.reg.register <- c
 	defer c.Release()
 
+	go c.read(c.srv, c.reg)
 	c.run()
 }
 
-func (srv *server) run(bus *smbus.Conn) {
-	go srv.daq(bus)
+func (srv *server) run() {
+	go srv.daq()
 	go srv.mon()
+
+	beat := time.NewTicker(srv.tick)
+	defer beat.Stop()
 	for {
 		select {
 		case <-srv.quit:
@@ -220,62 +422,162 @@ func (srv *server) run(bus *smbus.Conn) {
 			close(srv.quit)
 			return
 		case c := <-srv.dataReg.register:
-			log.Printf("client registering [%v]...", c.ws.LocalAddr())
+			log.Printf("client registering [%v]...", c.addr)
 			srv.dataReg.clients[c] = true
 
 		case c := <-srv.dataReg.unregister:
+			// datac is only ever closed here, once the client is done
+			// with it.
 			if _, ok := srv.dataReg.clients[c]; ok {
 				delete(srv.dataReg.clients, c)
 				close(c.datac)
 				log.Printf(
-					"client disconnected [%v]\n",
-					c.ws.LocalAddr(),
+					"client disconnected [%v] (dropped messages: %d)\n",
+					c.addr, c.dropped,
 				)
 			}
 
-		case plots := <-srv.plots:
-			if len(srv.dataReg.clients) == 0 {
-				// no client connected
-				continue
+		case req := <-srv.dataReg.subscribe:
+			if _, ok := srv.dataReg.clients[req.c]; ok {
+				req.c.sub = req.sub
 			}
-			dataBuf := new(bytes.Buffer)
-			err := json.NewEncoder(dataBuf).Encode(&plots)
-			if err != nil {
-				log.Printf("error marshalling data: %v\n", err)
-				continue
+
+		case now := <-beat.C:
+			srv.health.beat("run", now.UTC())
+
+		case plots := <-srv.plots:
+			srv.broadcast(plots)
+		}
+	}
+}
+
+// broadcast sends the dashboard update to the websocket clients.
+// It is called by server.run, which owns the clients.
+func (srv *server) broadcast(plots Plots) {
+	if len(srv.dataReg.clients) == 0 {
+		// no client connected
+		return
+	}
+	// payloads, with and without the trend plots, marshaled on
+	// demand: the trend plots are only sent to the clients which
+	// did not receive their latest update yet.
+	var full, fast []byte
+	marshal := func(trends bool) []byte {
+		msg, err := plots.marshal(trends)
+		if err != nil {
+			log.Printf("error marshalling data: %v\n", err)
+		}
+		return msg
+	}
+	for c := range srv.dataReg.clients {
+		var msg []byte
+		trends := false
+		switch {
+		case c.sub != nil:
+			msg = c.sub.message(plots.sample)
+		case !plots.redrawn:
+			// dashboard clients are only updated with new plots.
+		case !c.trends.Equal(plots.trends.update):
+			if full == nil {
+				full = marshal(true)
 			}
-			for c := range srv.dataReg.clients {
-				select {
-				case c.datac <- dataBuf.Bytes():
-				default:
-					close(c.datac)
-					delete(srv.dataReg.clients, c)
-				}
+			msg, trends = full, true
+		default:
+			if fast == nil {
+				fast = marshal(false)
 			}
+			msg = fast
+		}
+		if msg == nil {
+			continue
+		}
+		dropped := c.dropped
+		srv.dataReg.send(c, msg)
+		switch {
+		case c.dropped != dropped:
+			// the dropped message may have held the trend plots.
+			c.trends = time.Time{}
+		case trends:
+			c.trends = plots.trends.update
 		}
 	}
 }
 
-func (srv *server) daq(bus *smbus.Conn) {
-	defer bus.Close()
+// daqLogPeriod is the minimum interval between two logs of the acquisition
+// timings.
+const daqLogPeriod = time.Minute
 
-	tick := time.NewTicker(srv.freq)
+func (srv *server) daq() {
+	out := make(chan busData)
+	for _, bus := range srv.buses {
+		go bus.run(out)
+	}
+	defer func() {
+		for _, bus := range srv.buses {
+			close(bus.tick)
+		}
+	}()
+
+	tick := time.NewTicker(srv.tick)
 	defer tick.Stop()
 
 	i := 0
-	for range tick.C {
-		data, err := srv.fetchData(bus)
-		if err != nil {
-			log.Printf("error fetching data: %v\n", err)
+	vs := make([]sensors.Sensors, 0, len(srv.buses))
+	var (
+		last    sensors.Sensors              // latest reading of each sensor
+		seen    = make(map[string]time.Time) // time of the latest reading of each sensor
+		summary = time.Now()                 // last timing summary log
+		overrun time.Time                    // last overrun log
+	)
+	for now := range tick.C {
+		start := time.Now()
+		for _, bus := range srv.buses {
+			bus.tick <- now
+		}
+
+		vs = vs[:0]
+		for range srv.buses {
+			v := <-out
+			srv.health.acquired(now.UTC(), v)
+			srv.stats.acquired(v)
+			if err := v.err(); err != nil {
+				log.Printf("error fetching data from bus %v: %v\n", v.bus, err)
+			}
+			if rec := v.recovery; rec != nil {
+				switch rec.err {
+				case nil:
+					log.Printf("bus %v recovered after %d failed acquisitions", v.bus, rec.failures)
+				default:
+					log.Printf("error recovering bus %v after %d failed acquisitions: %v", v.bus, rec.failures, rec.err)
+				}
+			}
+			if len(v.data.Sensors) == 0 {
+				continue
+			}
+			vs = append(vs, v.data)
+		}
+		end := time.Now()
+		srv.health.beat("daq", end.UTC())
+		if dt := end.Sub(start); srv.stats.tick(now.UTC(), dt) && end.Sub(overrun) > daqLogPeriod {
+			log.Printf("daq: acquisition overrun: %v > %v (polling period)", dt.Round(time.Microsecond), srv.tick)
+			overrun = end
+		}
+		if end.Sub(summary) > daqLogPeriod {
+			log.Printf("daq: timing: %s", srv.stats.summary())
+			summary = end
+		}
+		if len(vs) == 0 {
 			continue
 		}
+		data := merge(now.UTC(), vs)
+		srv.derive(&data, &last, seen)
 
 		i++
 		if i%10 == 0 {
 			log.Printf("daq: %+v\n", data)
 		}
 		select {
-		case srv.bus.data <- data:
+		case srv.data <- data:
 		default:
 			// nobody is listening
 			// drop it on the floor
@@ -283,78 +585,169 @@ func (srv *server) daq(bus *smbus.Conn) {
 	}
 }
 
-func (srv *server) mon() {
-	trendTick := time.NewTicker(time.Minute)
-	defer trendTick.Stop()
+// derive computes the derived sensors depending on the new readings,
+// using the latest readings of their other inputs, and adds them to data.
+// seen holds the time of the latest reading of each sensor.
+//
+// A derived sensor is not computed while one of its inputs was not read for
+// staleReadings polling intervals (e.g. a dead sensor): it is reported as
+// failing instead.
+func (srv *server) derive(data, last *sensors.Sensors, seen map[string]time.Time) {
+	last.Update(*data)
+	for _, v := range data.Sensors {
+		seen[v.Name] = data.Timestamp
+	}
+	for i := range srv.derived {
+		d := &srv.derived[i]
+		if !d.Depends(*data) {
+			continue
+		}
+		val, err := srv.eval(d, *last, data.Timestamp, seen)
+		srv.health.derived(data.Timestamp, d.Name, err)
+		if err != nil {
+			log.Printf("error computing derived sensor %q: %v", d.Name, err)
+			continue
+		}
+		v := sensors.Data{Name: d.Name, Type: d.Type(), Value: val}
+		data.Sensors = append(data.Sensors, v)
+		data.Labels[d.Name] = append(data.Labels[d.Name], v.Type)
+		last.Update(sensors.Sensors{Timestamp: data.Timestamp, Sensors: []sensors.Data{v}})
+		seen[d.Name] = data.Timestamp
+	}
+}
 
-	table := newNtuple()
-	trend := newNtuple()
+// staleReadings is the number of polling intervals after which the latest
+// reading of a sensor is too old to compute derived sensors.
+const staleReadings = 3
+
+// eval computes the derived sensor d from the latest readings, at the
+// provided time.
+func (srv *server) eval(d *sensors.Derived, last sensors.Sensors, now time.Time, seen map[string]time.Time) (float64, error) {
+	for _, in := range d.Inputs {
+		ts, ok := seen[in.Name]
+		if !ok {
+			continue // reported as missing by Eval.
+		}
+		if age, max := now.Sub(ts), staleReadings*srv.every[in.Name]; max > 0 && age > max {
+			return 0, fmt.Errorf("stale input %v: last read %v ago", in, age.Round(time.Second))
+		}
+	}
+	return d.Eval(last)
+}
+
+func (srv *server) mon() {
+	table := newRing(srv.windows.fast, int(srv.windows.fast/srv.tick), func(v *sensors.Sensors) time.Time {
+		return v.Timestamp
+	})
+	trends := newTrends(srv.windows.trend)
 
-	first := true
-	var data sensors.Sensors
+	var (
+		psFast ControlPlots // fast plots
+		drawn  time.Time    // timestamp of the latest sample when the fast plots were built
+		psSlow ControlPlots // trend plots
+		closed time.Time    // beginning of the trend bucket filled when the trend plots were built
+
+		data  sensors.Sensors
+		last  sensors.Sensors // latest reading of each sensor
+		start time.Time       // timestamp of the first sample
+		subs  = make(map[*subscriber]bool)
+	)
+	beat := time.NewTicker(srv.tick)
+	defer beat.Stop()
 	for {
 		select {
-		case data = <-srv.bus.data:
+		case now := <-beat.C:
+			srv.health.beat("mon", now.UTC())
+
+		case data = <-srv.data:
+			if start.IsZero() {
+				start = data.Timestamp
+			}
 			table.add(data)
-			if first {
-				first = false
-				trend.add(data)
+			srv.health.stored(data.Timestamp, table.Len())
+			last.Update(data)
+			for _, tr := range trends {
+				tr.add(data)
 			}
-			psFast, err := newControlPlots(table.data)
-			if err != nil {
-				log.Printf("error creating monitoring plots: %v", err)
-				continue
+			for sub := range subs {
+				select {
+				case sub.datac <- data:
+				default:
+					// client fell behind: disconnect it, it may resume
+					// from the samples still in the table.
+					delete(subs, sub)
+					close(sub.datac)
+				}
 			}
-			psSlow, err := newControlPlots(trend.data)
-			if err != nil {
-				log.Printf("error creating (trend) monitoring plots: %v", err)
-				continue
+			// the samples are published on each acquisition, while the
+			// plots are redrawn at most once per plotPeriod (with some
+			// slack for the jitter of the acquisition ticks.)
+			redraw := psFast.tile == nil || data.Timestamp.Sub(drawn) >= plotPeriod-srv.tick/2
+			if redraw {
+				var err error
+				psFast, err = newControlPlots(srv.panels, srv.colors, sensors.Table(table.sample(maxPlotPoints)), renderSize())
+				if err != nil {
+					log.Printf("error creating monitoring plots: %v", err)
+					continue
+				}
+				drawn = data.Timestamp
+			}
+			// trend plots only change when a trend bucket is closed.
+			if beg := trends[0].cur.Beg; psSlow.tile == nil || !beg.Equal(closed) {
+				var err error
+				psSlow, err = newControlPlots(srv.panels, srv.colors, trends[0].table().downsample(maxPlotPoints), renderSize())
+				if err != nil {
+					log.Printf("error creating (trend) monitoring plots: %v", err)
+					continue
+				}
+				closed = beg
 			}
 			ps := Plots{
-				update: time.Now().UTC(),
-				plots:  psFast,
-				trends: psSlow,
-				data:   data,
+				update:  time.Now().UTC(),
+				plots:   psFast,
+				trends:  psSlow,
+				redrawn: redraw,
+				data:    last.Clone(),
+				sample:  data,
 			}
 			select {
 			case srv.plots <- ps:
 			default:
 				// nobody is listening
 			}
-		case <-trendTick.C:
-			trend.add(data)
-
-		case srv.echo <- data:
-		}
-	}
-}
-
-type ntuple struct {
-	data []sensors.Sensors
-}
 
-func newNtuple() *ntuple {
-	return &ntuple{
-		data: make([]sensors.Sensors, 0, 2048),
-	}
-}
+		case req := <-srv.echo:
+			req <- last.Clone()
 
-func (nt *ntuple) add(data sensors.Sensors) {
-	if len(nt.data) == cap(nt.data) {
-		i := len(nt.data)
-		copy(nt.data[:i/2], nt.data[i/2:])
-		nt.data = nt.data[:i/2]
-	}
-	nt.data = append(nt.data, data)
-}
+		case req := <-srv.hist:
+			hist := history{
+				fast:   sensors.Table(table.slice()),
+				trends: make([]trendTable, len(trends)),
+				start:  start,
+			}
+			for i, tr := range trends {
+				hist.trends[i] = tr.table()
+			}
+			req <- hist
+
+		case sub := <-srv.subscribe:
+			if !sub.since.IsZero() {
+				for i := 0; i < table.Len(); i++ {
+					if v := table.at(i); v.Timestamp.After(sub.since) {
+						sub.replay = append(sub.replay, *v)
+					}
+				}
+			}
+			subs[sub] = true
+			close(sub.ready)
 
-func (srv *server) fetchData(bus *smbus.Conn) (sensors.Sensors, error) {
-	data, err := sensors.New(bus, srv.bus.addr, srv.bus.descr)
-	if err != nil {
-		return data, err
+		case sub := <-srv.unsubscribe:
+			if subs[sub] {
+				delete(subs, sub)
+				close(sub.datac)
+			}
+		}
 	}
-
-	return data, nil
 }
 
 func getHostIP() string {
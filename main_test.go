@@ -0,0 +1,129 @@
+// Copyright 2018 The solid-mon-rpi Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sbinet-solid/solid-mon-rpi/sensors"
+)
+
+func TestServerDeriveStale(t *testing.T) {
+	srv := &server{
+		derived: []sensors.Derived{{
+			Name: "avg",
+			Func: "average",
+			Inputs: []sensors.Input{
+				{Name: "t1", Type: sensors.Temperature},
+				{Name: "t2", Type: sensors.Temperature},
+			},
+		}},
+		every: map[string]time.Duration{
+			"t1":  time.Second,
+			"t2":  time.Second,
+			"avg": time.Second,
+		},
+		health: newHealth(time.Second, nil),
+	}
+
+	var (
+		last sensors.Sensors
+		seen = make(map[string]time.Time)
+	)
+	derive := func(ts time.Time, vs ...sensors.Data) (float64, bool) {
+		t.Helper()
+		data := sensors.Sensors{
+			Timestamp: ts,
+			Sensors:   vs,
+			Labels:    make(map[string][]sensors.Type),
+		}
+		for _, v := range vs {
+			data.Labels[v.Name] = append(data.Labels[v.Name], v.Type)
+		}
+		srv.derive(&data, &last, seen)
+		return data.Value("avg", sensors.Temperature)
+	}
+
+	t0 := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	v, ok := derive(t0,
+		sensors.Data{Name: "t1", Type: sensors.Temperature, Value: 20},
+		sensors.Data{Name: "t2", Type: sensors.Temperature, Value: 30},
+	)
+	if !ok || v != 25 {
+		t.Fatalf("invalid derived value: %v (ok=%v)", v, ok)
+	}
+
+	// t2 stops updating: its latest reading is used while recent enough.
+	for i := 1; i <= staleReadings; i++ {
+		v, ok = derive(t0.Add(time.Duration(i)*time.Second),
+			sensors.Data{Name: "t1", Type: sensors.Temperature, Value: 22},
+		)
+		if !ok || v != 26 {
+			t.Fatalf("step #%d: invalid derived value: %v (ok=%v)", i, v, ok)
+		}
+	}
+
+	now := t0.Add((staleReadings + 1) * time.Second)
+	if v, ok = derive(now, sensors.Data{Name: "t1", Type: sensors.Temperature, Value: 22}); ok {
+		t.Fatalf("unexpected derived value from a stale input: %v", v)
+	}
+	rep := srv.health.report(now)
+	if s := rep.Sensors["avg"]; !s.Failing || s.Errors != 1 || !strings.Contains(s.LastError, "stale input t2") {
+		t.Fatalf("invalid derived sensor health: %+v", s)
+	}
+
+	// t2 is back.
+	v, ok = derive(now.Add(time.Second),
+		sensors.Data{Name: "t2", Type: sensors.Temperature, Value: 24},
+	)
+	if !ok || v != 23 {
+		t.Fatalf("invalid derived value: %v (ok=%v)", v, ok)
+	}
+	if s := srv.health.report(now).Sensors["avg"]; s.Failing {
+		t.Fatalf("invalid derived sensor health: %+v", s)
+	}
+}
+
+func TestEchoHandler(t *testing.T) {
+	srv := &server{
+		freq:      time.Second,
+		tick:      time.Hour, // no heartbeat.
+		data:      make(chan sensors.Sensors),
+		plots:     make(chan Plots),
+		echo:      make(chan chan sensors.Sensors),
+		hist:      make(chan chan history),
+		subscribe: make(chan *subscriber),
+		health:    newHealth(time.Second, nil),
+	}
+	srv.windows.fast = time.Hour
+	go srv.mon()
+
+	t0 := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, row := range newTestTable(t0)[:2] {
+		srv.data <- row
+	}
+
+	rec := httptest.NewRecorder()
+	srv.wrap(srv.echoHandler)(rec, httptest.NewRequest(http.MethodGet, "/echo", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("invalid status code: %d (%s)", rec.Code, rec.Body.String())
+	}
+	var data sensors.Sensors
+	err := json.Unmarshal(rec.Body.Bytes(), &data)
+	if err != nil {
+		t.Fatalf("could not decode readings: %+v", err)
+	}
+	if got, want := data.Timestamp, t0.Add(time.Second); !got.Equal(want) {
+		t.Fatalf("invalid timestamp: got=%v, want=%v", got, want)
+	}
+	if _, ok := data.Value("temp-1", sensors.Temperature); !ok {
+		t.Fatalf("missing readings: %+v", data)
+	}
+}
@@ -9,9 +9,14 @@ import (
 	"encoding/json"
 	"fmt"
 	"image/color"
+	"io"
 	"log"
 	"math"
+	"net/http"
+	"net/url"
+	"path"
 	"sort"
+	"strconv"
 	"strings"
 	"text/tabwriter"
 	"time"
@@ -19,37 +24,52 @@ import (
 	"github.com/sbinet-solid/solid-mon-rpi/sensors"
 	"go-hep.org/x/hep/hplot"
 	"gonum.org/v1/plot"
+	"gonum.org/v1/plot/palette/brewer"
 	"gonum.org/v1/plot/plotter"
 	"gonum.org/v1/plot/vg"
 	"gonum.org/v1/plot/vg/draw"
+	_ "gonum.org/v1/plot/vg/vgimg" // register png image format
+	_ "gonum.org/v1/plot/vg/vgpdf" // register pdf image format
 	"gonum.org/v1/plot/vg/vgsvg"
 )
 
-var plotColors = make(map[string]color.Color)
-
 type Plots struct {
-	update time.Time
-	plots  ControlPlots
-	trends ControlPlots
-	data   sensors.Sensors
+	update  time.Time
+	plots   ControlPlots
+	trends  ControlPlots
+	redrawn bool            // whether the fast plots were redrawn since the previous update
+	data    sensors.Sensors // latest reading of each sensor
+	sample  sensors.Sensors // readings of the latest acquisition
 }
 
 func (ps *Plots) MarshalJSON() ([]byte, error) {
+	return ps.marshal(true)
+}
+
+// marshal returns the JSON payload of the dashboard, with or without the
+// trend plots (which only change when a trend bucket is closed.)
+func (ps *Plots) marshal(trends bool) ([]byte, error) {
 	var raw struct {
 		Plot   string `json:"plot"`
-		Trends string `json:"trends"`
+		Trends string `json:"trends,omitempty"`
 		Update string `json:"update"`
 		Data   string `json:"data"`
 	}
 
-	raw.Plot = renderPlot(ps.plots.tile)
-	raw.Trends = renderPlot(ps.trends.tile)
+	raw.Plot = ps.plots.render()
+	if trends {
+		raw.Trends = ps.trends.render()
+	}
 	raw.Update = ps.update.Format("2006-01-02 15:04:05 (MST)")
 
 	str := new(bytes.Buffer)
 	w := tabwriter.NewWriter(str, 8, 4, 1, ' ', 0)
 	for _, d := range ps.data.Sensors {
-		fmt.Fprintf(w, "%s\t%v\t(%v)\n", d.Name, d.Value, d.Type)
+		valid := ""
+		if !d.Type.Valid(d.Value) {
+			valid = "\t(out of range)"
+		}
+		fmt.Fprintf(w, "%s\t%s\t(%v)%s\n", d.Name, d.Type.Format(d.Value), d.Type, valid)
 	}
 	w.Flush()
 	raw.Data = string(str.Bytes())
@@ -66,11 +86,38 @@ func (ps *Plots) MarshalJSON() ([]byte, error) {
 type ControlPlots struct {
 	update time.Time
 	tile   *hplot.TiledPlot
+	svg    *string // rendered plots (see ControlPlots.render)
+}
+
+// maxPlotPoints is the maximum number of points per sensor drawn in the
+// monitoring plots: denser time series are downsampled.
+const maxPlotPoints = 2048
+
+// plotPeriod is the minimum interval between two redraws of the fast
+// monitoring plots.
+const plotPeriod = 2 * time.Second
+
+// render renders the plots as SVG.
+// The rendering is done once, and shared by the copies of the plots.
+func (ps ControlPlots) render() string {
+	if ps.svg == nil {
+		return renderPlot(ps.tile)
+	}
+	if *ps.svg == "" {
+		*ps.svg = renderPlot(ps.tile)
+	}
+	return *ps.svg
+}
+
+// renderSize returns the size of the rendered plots.
+func renderSize() vg.Point {
+	const size = 30 * vg.Centimeter
+	return vg.Point{X: size, Y: size / vg.Length(math.Phi)}
 }
 
 func renderPlot(p *hplot.TiledPlot) string {
-	size := 30 * vg.Centimeter
-	canvas := vgsvg.New(size, size/vg.Length(math.Phi))
+	size := renderSize()
+	canvas := vgsvg.New(size.X, size.Y)
 	p.Draw(draw.New(canvas))
 	out := new(bytes.Buffer)
 	_, err := canvas.WriteTo(out)
@@ -80,62 +127,312 @@ func renderPlot(p *hplot.TiledPlot) string {
 	return string(out.Bytes())
 }
 
-func newControlPlots(data []sensors.Sensors) (ControlPlots, error) {
+// plotFormats are the image formats served by the plots endpoint.
+var plotFormats = map[string]string{
+	"svg": "image/svg+xml",
+	"png": "image/png",
+	"pdf": "application/pdf",
+}
+
+// drawer is a plot that can be drawn on a canvas.
+type drawer interface {
+	Draw(c draw.Canvas)
+}
+
+// writePlot renders the plot in the provided format (svg, png or pdf.)
+func writePlot(w io.Writer, p drawer, format string, size vg.Point) error {
+	canvas, err := draw.NewFormattedCanvas(size.X, size.Y, format)
+	if err != nil {
+		return err
+	}
+	p.Draw(draw.New(canvas))
+	_, err = canvas.WriteTo(w)
+	return err
+}
+
+// plotsHandler serves the fast and trend monitoring plots, and the
+// correlation plots (see correlationPlot), as images:
+//
+//	/plots/{fast,trend,correlation}.{svg,png,pdf}
+//
+// The plots can be customized with the following query parameters:
+//   - w, h: width and height of the image, in centimeters,
+//   - from, to, last: time range (see parseSelection, default for
+//     correlation plots: the fast monitoring window),
+//   - sensor: name of a sensor to display (may be repeated.)
+func (srv *server) plotsHandler(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return errorf(http.StatusMethodNotAllowed, "invalid HTTP request (got=%v, want=%v)", r.Method, http.MethodGet)
+	}
+
+	name := path.Base(r.URL.Path)
+	ext := path.Ext(name)
+	name = strings.TrimSuffix(name, ext)
+	ext = strings.TrimPrefix(ext, ".")
+	mime, ok := plotFormats[ext]
+	if !ok || (name != "fast" && name != "trend" && name != "correlation") {
+		return errorf(http.StatusNotFound, "unknown plot %q", r.URL.Path)
+	}
+
+	q := r.URL.Query()
+	size, err := parsePlotSize(q)
+	if err != nil {
+		return err
+	}
+	if name == "correlation" && q.Get("from") == "" && q.Get("last") == "" {
+		// values of the fast monitoring window are paired by acquisition.
+		q.Set("last", srv.windows.fast.String())
+	}
+	sel, err := parseSelection(q)
+	if err != nil {
+		return err
+	}
+
+	hist, err := srv.history()
+	if err != nil {
+		return err
+	}
+
+	var p drawer
+	switch name {
+	case "correlation":
+		p, err = correlationPlot(q, hist, sel, srv.colors)
+		if err != nil {
+			return err
+		}
+	default:
+		var data timeSeries
+		switch name {
+		case "fast":
+			data = sel.table(hist.fast)
+		case "trend":
+			// the finest trend table covering the selection.
+			src := hist.source(sel)
+			if src < 0 {
+				src = 0
+			}
+			data = sel.trend(hist.trends[src]).downsample(maxPlotPoints)
+		}
+		if data.Len() == 0 {
+			return errorf(http.StatusNotFound, "no data for the requested plot")
+		}
+
+		ps, err := newControlPlots(srv.panels, srv.colors, data, size)
+		if err != nil {
+			return err
+		}
+		p = ps.tile
+	}
+
+	buf := new(bytes.Buffer)
+	err = writePlot(buf, p, ext, size)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", mime)
+	w.Header().Set("Cache-Control", "no-cache")
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+// maxPlotSize is the largest dimension of a plot, in centimeters.
+// It bounds the memory needed to render raster images (about 14 MB at
+// 96 dpi.)
+const maxPlotSize = 50
+
+// parsePlotSize parses the size of a plot from the w and h query parameters,
+// in centimeters.
+// When only one dimension is provided, the other one follows the golden ratio.
+func parsePlotSize(q url.Values) (vg.Point, error) {
+	size := renderSize()
+	var w, h float64
+	for _, p := range []struct {
+		name string
+		ptr  *float64
+	}{
+		{"w", &w},
+		{"h", &h},
+	} {
+		v := q.Get(p.name)
+		if v == "" {
+			continue
+		}
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f <= 0 || f > maxPlotSize {
+			return size, errorf(http.StatusBadRequest, "invalid plot size parameter %s=%q", p.name, v)
+		}
+		*p.ptr = f
+	}
+
+	switch {
+	case w > 0 && h > 0:
+		size = vg.Point{X: vg.Length(w) * vg.Centimeter, Y: vg.Length(h) * vg.Centimeter}
+	case w > 0:
+		size = vg.Point{X: vg.Length(w) * vg.Centimeter, Y: vg.Length(w/math.Phi) * vg.Centimeter}
+	case h > 0:
+		size = vg.Point{X: vg.Length(h*math.Phi) * vg.Centimeter, Y: vg.Length(h) * vg.Centimeter}
+	}
+	if max := maxPlotSize * vg.Centimeter; size.X > max || size.Y > max {
+		return size, errorf(http.StatusBadRequest, "invalid plot size (max=%dcm)", maxPlotSize)
+	}
+	return size, nil
+}
+
+// timeSeries is a collection of sensor readings over time.
+type timeSeries interface {
+	// Len returns the number of entries in the time series.
+	Len() int
+	// Span returns the time interval covered by the time series.
+	Span() (beg, end time.Time)
+	// Types returns the types of all the quantities in the time series.
+	Types() []sensors.Type
+	// Labels returns the names of all the sensors of the given type.
+	Labels(typ sensors.Type) []string
+	// Segments returns the values of the sensor label for the given type,
+	// split into contiguous segments, together with their minimum and
+	// maximum.
+	Segments(typ sensors.Type, label string) (min, max float64, data []plotter.XYs)
+}
+
+// bandSeries is a time series with a spread of values for each entry.
+type bandSeries interface {
+	timeSeries
+	// Band returns the lower and upper values of the sensor label for the
+	// given type, split into the same segments than Segments.
+	Band(typ sensors.Type, label string) (lo, hi []plotter.XYs)
+}
+
+// newControlPlots creates the time-series panels, arranged in tiles,
+// followed by the legend.
+// When no panel is provided, one panel per type present in data is created.
+// Sensors are drawn with the provided colors, and the legend is laid out
+// for a rendering of the provided size.
+func newControlPlots(panels []Panel, colors map[string]color.Color, data timeSeries, size vg.Point) (ControlPlots, error) {
 	var (
-		ps  ControlPlots
+		ps  = ControlPlots{svg: new(string)}
 		err error
 	)
 
-	ps.update = data[len(data)-1].Timestamp
+	if len(panels) == 0 {
+		panels = autoPanels(data)
+	}
+
+	_, ps.update = data.Span()
 	const pad = 10
-	ps.tile = hplot.NewTiledPlot(draw.Tiles{
-		Cols:      3,
-		Rows:      2,
-		PadBottom: pad,
-		PadLeft:   pad,
-		PadRight:  pad,
-		PadTop:    pad,
-		PadX:      pad,
-		PadY:      pad,
-	})
-
-	leg := ps.tile.Plot(0, 2)
-	leg.HideAxes()
-	labels := make(map[string]int)
-
-	for _, tbl := range []struct {
-		pl  *hplot.Plot
-		typ sensors.Type
-	}{
-		{ps.tile.Plot(0, 0), sensors.Humidity},
-		{ps.tile.Plot(0, 1), sensors.Pressure},
-		{ps.tile.Plot(1, 0), sensors.Temperature},
-		{ps.tile.Plot(1, 1), sensors.Luminosity},
-	} {
-		tbl.pl.Title.Text = strings.Title(tbl.typ.String())
-		tbl.pl.X.Tick.Marker = plot.TimeTicks{Format: "2006-01-02\n15:04:05"}
-		tbl.pl.X.Tick.Label.Rotation = math.Pi / 4
-		tbl.pl.X.Tick.Label.YAlign = draw.YTop
-		tbl.pl.X.Tick.Label.XAlign = draw.XRight
+	tiles := newTiles(len(panels) + 1)
+	tiles.PadBottom = pad
+	tiles.PadLeft = pad
+	tiles.PadRight = pad
+	tiles.PadTop = pad
+	tiles.PadX = pad
+	tiles.PadY = pad
+	ps.tile = hplot.NewTiledPlot(tiles)
 
-		err = setupPlot(tbl.pl, leg, &labels, data, tbl.typ)
+	leg := newLegend()
+	for i, panel := range panels {
+		pl := ps.tile.Plots[i]
+		pl.Title.Text = panel.Title
+		pl.Y.Label.Text = "[" + panel.Type.Unit() + "]"
+		pl.X.Tick.Marker = plot.TimeTicks{Format: "2006-01-02\n15:04:05"}
+		pl.X.Tick.Label.Rotation = math.Pi / 4
+		pl.X.Tick.Label.YAlign = draw.YTop
+		pl.X.Tick.Label.XAlign = draw.XRight
+
+		err = setupPlot(pl, leg, data, panel, colors)
 		if err != nil {
 			return ps, err
 		}
 	}
 
-	ps.tile.Plots[5] = nil
+	leg.draw(ps.tile.Plots[len(panels):], tiles, size)
 
 	return ps, err
 }
 
+// autoPanels returns one panel per type of quantity present in data.
+func autoPanels(data timeSeries) []Panel {
+	var panels []Panel
+	for _, typ := range data.Types() {
+		panels = append(panels, Panel{
+			Title: typ.Title(),
+			Type:  typ,
+		})
+	}
+	return panels
+}
+
+// newTiles returns a layout with enough tiles to hold n plots, as close
+// as possible to a square.
+func newTiles(n int) draw.Tiles {
+	cols := int(math.Ceil(math.Sqrt(float64(n))))
+	rows := (n + cols - 1) / cols
+	return draw.Tiles{Cols: cols, Rows: rows}
+}
+
+// legend collects the legend entries of all the panels of a tiled plot.
+type legend struct {
+	labels []string
+	thumbs map[string]plot.Thumbnailer
+}
+
+func newLegend() *legend {
+	return &legend{thumbs: make(map[string]plot.Thumbnailer)}
+}
+
+func (leg *legend) add(label string, thumb plot.Thumbnailer) {
+	if _, dup := leg.thumbs[label]; dup {
+		return
+	}
+	leg.labels = append(leg.labels, label)
+	leg.thumbs[label] = thumb
+}
+
+// draw spreads the legend entries over the provided (free) tiles of a plot
+// of the given size.
+// The text size is reduced when the entries do not fit in the tiles.
+// Tiles without any entry are removed.
+func (leg *legend) draw(ps []*hplot.Plot, tiles draw.Tiles, size vg.Point) {
+	if len(ps) == 0 {
+		return
+	}
+
+	var (
+		n = (len(leg.labels) + len(ps) - 1) / len(ps) // entries per tile
+		h = (size.Y - tiles.PadTop - tiles.PadBottom - vg.Length(tiles.Rows-1)*tiles.PadY) /
+			vg.Length(tiles.Rows)
+	)
+
+	for i, pl := range ps {
+		beg := i * n
+		end := beg + n
+		if end > len(leg.labels) {
+			end = len(leg.labels)
+		}
+		if beg >= end {
+			ps[i] = nil
+			continue
+		}
+
+		pl.HideAxes()
+		pl.Legend.Top = true
+		pl.Legend.Left = true
+		if font := h / vg.Length(n) / 1.5; font < pl.Legend.TextStyle.Font.Size {
+			pl.Legend.TextStyle.Font.Size = vg.Length(math.Max(float64(font), 6))
+		}
+		for _, label := range leg.labels[beg:end] {
+			pl.Legend.Add(label, leg.thumbs[label])
+		}
+	}
+}
+
 func (ps *ControlPlots) MarshalJSON() ([]byte, error) {
 	var raw struct {
 		Plot   string `json:"plot"`
 		Update string `json:"update"`
 	}
 
-	raw.Plot = renderPlot(ps.tile)
+	raw.Plot = ps.render()
 	raw.Update = ps.update.Format("2006-01-02 15:04:05 (MST)")
 
 	buf := new(bytes.Buffer)
@@ -147,37 +444,183 @@ func (ps *ControlPlots) MarshalJSON() ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
-func setupPlot(pl, leg *hplot.Plot, names *map[string]int, table sensors.Table, typ sensors.Type) error {
+func setupPlot(pl *hplot.Plot, leg *legend, table timeSeries, panel Panel, colors map[string]color.Color) error {
+	typ := panel.Type
 	min := +math.MaxFloat64
 	max := -math.MaxFloat64
 	{
 		labels := table.Labels(typ)
 		sort.Strings(labels)
+		if len(panel.Sensors) > 0 {
+			labels = selectLabels(labels, panel.Sensors)
+		}
 		for k := range labels {
 			label := labels[k]
-			ymin, ymax, data := table.Data(typ, label)
+			ymin, ymax, segs := table.Segments(typ, label)
 			min = math.Min(min, ymin)
 			max = math.Max(max, ymax)
-			lines, err := plotter.NewLine(data)
+			if table, ok := table.(bandSeries); ok {
+				lo, hi := table.Band(typ, label)
+				for i := range lo {
+					band := hplot.NewBand(bandColor(colors[label]), hi[i], lo[i])
+					pl.Add(band)
+				}
+			}
+			ps, thumb, err := segmentPlotters(segs, colors[label])
 			if err != nil {
 				return err
 			}
-			lines.Color = plotColors[label]
-			pl.Add(lines)
-			if _, dup := (*names)[label]; !dup {
-				leg.Legend.Add(label, lines)
-				(*names)[label] = 1
+			pl.Add(ps...)
+			if thumb != nil {
+				leg.add(label, thumb)
 			}
 		}
 	}
 
-	if typ == sensors.Pressure {
+	if min > max {
+		// no data (yet) for that panel.
+		// use sensible axes ranges for the empty panel.
+		info := typ.Info()
+		beg, end := table.Span()
+		pl.X.Min = float64(beg.UnixNano()) * 1e-9
+		pl.X.Max = float64(end.UnixNano()) * 1e-9
+		if pl.X.Max <= pl.X.Min {
+			pl.X.Max = pl.X.Min + 1
+		}
+		pl.Y.Min = info.Min
+		pl.Y.Max = info.Max
+		if panel.Min < panel.Max {
+			pl.Y.Min = panel.Min
+			pl.Y.Max = panel.Max
+		}
+		pl.Add(plotter.NewGrid())
+		return nil
+	}
+
+	switch {
+	case panel.Min < panel.Max:
+		pl.Y.Min = panel.Min
+		pl.Y.Max = panel.Max
+	case typ == sensors.Pressure:
 		// FIXME(sbinet): hack to work around https://github.com/gonum/plot/issues/366
 		pl.Y.Min = min - 0.5
 		pl.Y.Max = max + 0.5
 	}
 
+	// log-scale axes can only display strictly positive values.
+	// silently fall back to a linear scale otherwise.
+	if panel.Log && math.Min(min, pl.Y.Min) > 0 {
+		pl.Y.Scale = plot.LogScale{}
+		pl.Y.Tick.Marker = plot.LogTicks{Prec: -1}
+	}
+
 	pl.Add(plotter.NewGrid())
 
 	return nil
 }
+
+// segmentPlotters returns the plotters drawing the provided segments, and
+// the one to display in the legend.
+// Each contiguous segment is drawn as a line, so gaps in the data (missing
+// or failed sensor) show up as breaks in the line.
+// Isolated samples, between two gaps, are drawn as dots.
+func segmentPlotters(segs []plotter.XYs, c color.Color) ([]plot.Plotter, plot.Thumbnailer, error) {
+	var (
+		ps    []plot.Plotter
+		thumb plot.Thumbnailer
+	)
+	for _, data := range segs {
+		switch len(data) {
+		case 0:
+			continue
+		case 1:
+			dot, err := plotter.NewScatter(data)
+			if err != nil {
+				return nil, nil, err
+			}
+			dot.GlyphStyle.Color = c
+			dot.GlyphStyle.Shape = draw.CircleGlyph{}
+			dot.GlyphStyle.Radius = vg.Points(1.5)
+			ps = append(ps, dot)
+			if thumb == nil {
+				thumb = dot
+			}
+		default:
+			line, err := plotter.NewLine(data)
+			if err != nil {
+				return nil, nil, err
+			}
+			line.Color = c
+			ps = append(ps, line)
+			if _, ok := thumb.(*plotter.Line); !ok {
+				thumb = line
+			}
+		}
+	}
+	return ps, thumb, nil
+}
+
+// bandColor returns a translucent version of c, to draw the band of
+// values around a line.
+func bandColor(c color.Color) color.Color {
+	if c == nil {
+		c = color.Black
+	}
+	r, g, b, _ := c.RGBA()
+	return color.NRGBA{R: uint8(r >> 8), G: uint8(g >> 8), B: uint8(b >> 8), A: 0x40}
+}
+
+// selectLabels returns the labels listed in names, in the order of names.
+func selectLabels(labels, names []string) []string {
+	set := make(map[string]bool, len(labels))
+	for _, label := range labels {
+		set[label] = true
+	}
+	o := make([]string, 0, len(names))
+	for _, name := range names {
+		if set[name] {
+			o = append(o, name)
+		}
+	}
+	return o
+}
+
+// palettes are the color palettes used to assign distinct colors to
+// sensors, in order.
+var palettes = []struct {
+	name string
+	n    int
+}{
+	{"Dark2", 8},
+	{"Set1", 9},
+	{"Paired", 12},
+	{"Set2", 8},
+}
+
+// plotColors assigns a color to each sensor label.
+// Colors explicitly configured take precedence over the palettes ones.
+// Palette colors are only reused once all of them have been assigned.
+func plotColors(labels []string, colors map[string]color.Color) (map[string]color.Color, error) {
+	var pal []color.Color
+	for _, p := range palettes {
+		v, err := brewer.GetPalette(brewer.TypeAny, p.name, p.n)
+		if err != nil {
+			return nil, err
+		}
+		pal = append(pal, v.Colors()...)
+	}
+
+	labels = append([]string(nil), labels...)
+	sort.Strings(labels)
+	o := make(map[string]color.Color, len(labels))
+	i := 0
+	for _, label := range labels {
+		if col, ok := colors[label]; ok {
+			o[label] = col
+			continue
+		}
+		o[label] = pal[i%len(pal)]
+		i++
+	}
+	return o, nil
+}
@@ -0,0 +1,293 @@
+// Copyright 2018 The solid-mon-rpi Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"image/color"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sbinet-solid/solid-mon-rpi/sensors"
+	"gonum.org/v1/plot/plotter"
+	"gonum.org/v1/plot/vg"
+)
+
+func newTestTable(t0 time.Time) []sensors.Sensors {
+	table := make([]sensors.Sensors, 10)
+	for i := range table {
+		row := sensors.Sensors{
+			Timestamp: t0.Add(time.Duration(i) * time.Second),
+			Labels:    make(map[string][]sensors.Type),
+		}
+		for j := 0; j < 12; j++ {
+			name := fmt.Sprintf("temp-%d", j)
+			row.Sensors = append(row.Sensors, sensors.Data{
+				Name: name, Type: sensors.Temperature, Value: float64(20 + i + j),
+			})
+			row.Labels[name] = []sensors.Type{sensors.Temperature}
+		}
+		row.Sensors = append(row.Sensors, sensors.Data{
+			Name: "adc", Type: sensors.Voltage, Value: 3.2,
+		})
+		row.Labels["adc"] = []sensors.Type{sensors.Voltage}
+		table[i] = row
+	}
+	return table
+}
+
+func TestControlPlots(t *testing.T) {
+	t0 := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	table := newTestTable(t0)
+
+	for _, tc := range []struct {
+		name   string
+		panels []Panel
+		tiles  int
+	}{
+		{"auto", nil, 4}, // panels from data
+		{"temp", []Panel{{Title: "T", Type: sensors.Temperature}}, 2},
+		{
+			"all",
+			[]Panel{
+				{Title: "H", Type: sensors.Humidity},
+				{Title: "P", Type: sensors.Pressure},
+				{Title: "T", Type: sensors.Temperature},
+				{Title: "L", Type: sensors.Luminosity},
+				{Title: "V", Type: sensors.Voltage},
+			},
+			6,
+		},
+		{
+			"dashboard",
+			[]Panel{
+				{Title: "T1", Type: sensors.Temperature, Sensors: []string{"temp-1", "temp-2"}, Min: 10, Max: 40},
+				{Title: "T2", Type: sensors.Temperature, Sensors: []string{"temp-3"}, Log: true},
+				{Title: "V", Type: sensors.Voltage, Min: 1, Max: 10, Log: true},
+			},
+			4,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ps, err := newControlPlots(tc.panels, nil, sensors.Table(table), renderSize())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := len(ps.tile.Plots), tc.tiles; got != want {
+				t.Fatalf("invalid number of tiles: got=%d, want=%d", got, want)
+			}
+			svg := renderPlot(ps.tile)
+			if !strings.Contains(svg, "<svg") {
+				t.Fatalf("invalid SVG output")
+			}
+		})
+	}
+
+	t.Run("trend", func(t *testing.T) {
+		tr := newTrend(2*time.Second, time.Hour)
+		for _, row := range table {
+			tr.add(row)
+		}
+		ps, err := newControlPlots(nil, nil, tr.table(), renderSize())
+		if err != nil {
+			t.Fatal(err)
+		}
+		svg := renderPlot(ps.tile)
+		if !strings.Contains(svg, "<svg") {
+			t.Fatalf("invalid SVG output")
+		}
+	})
+}
+
+func TestSegmentPlotters(t *testing.T) {
+	segs := []plotter.XYs{
+		{{X: 0, Y: 1}, {X: 1, Y: 2}},
+		{{X: 5, Y: 3}}, // isolated sample
+		{{X: 9, Y: 4}, {X: 10, Y: 5}},
+	}
+	ps, thumb, err := segmentPlotters(segs, color.Black)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(ps), 3; got != want {
+		t.Fatalf("invalid number of plotters: got=%d, want=%d", got, want)
+	}
+	if _, ok := ps[1].(*plotter.Scatter); !ok {
+		t.Fatalf("isolated sample not drawn as a dot: got=%T", ps[1])
+	}
+	if _, ok := thumb.(*plotter.Line); !ok {
+		t.Fatalf("invalid legend thumbnail: got=%T", thumb)
+	}
+
+	ps, thumb, err = segmentPlotters(segs[1:2], color.Black)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ps) != 1 || thumb == nil {
+		t.Fatalf("isolated sample not drawn: plotters=%d, thumb=%v", len(ps), thumb)
+	}
+}
+
+// newTestServer returns a server serving the provided data as its history.
+func newTestServer(t *testing.T, table []sensors.Sensors) *server {
+	tr := newTrend(2*time.Second, time.Hour)
+	for _, row := range table {
+		tr.add(row)
+	}
+	return newHistoryServer(t, history{
+		fast:   sensors.Table(table),
+		trends: []trendTable{tr.table()},
+	})
+}
+
+// newHistoryServer returns a server serving the provided history.
+func newHistoryServer(t *testing.T, hist history) *server {
+	srv := &server{
+		freq: time.Second,
+		hist: make(chan chan history),
+		quit: make(chan int),
+	}
+	srv.windows.fast = time.Hour
+	web, err := newWebUI("")
+	if err != nil {
+		t.Fatalf("could not create web UI: %+v", err)
+	}
+	srv.web = web
+
+	go func() {
+		for {
+			select {
+			case req := <-srv.hist:
+				req <- hist
+			case <-srv.quit:
+				return
+			}
+		}
+	}()
+	t.Cleanup(func() { close(srv.quit) })
+	return srv
+}
+
+func TestPlotsHandler(t *testing.T) {
+	t0 := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	srv := newTestServer(t, newTestTable(t0))
+
+	for _, tc := range []struct {
+		url  string
+		code int
+		mime string
+	}{
+		{"/plots/fast.svg", http.StatusOK, "image/svg+xml"},
+		{"/plots/fast.png?w=10", http.StatusOK, "image/png"},
+		{"/plots/trend.pdf?sensor=temp-1&sensor=adc", http.StatusOK, "application/pdf"},
+		{"/plots/fast.svg?from=2018-01-01T00:00:02Z&to=2018-01-01T00:00:05Z", http.StatusOK, "image/svg+xml"},
+		{"/plots/fast.svg?from=2019-01-01T00:00:00Z", http.StatusNotFound, ""},
+		{"/plots/fast.svg?sensor=not-there", http.StatusNotFound, ""},
+		{"/plots/correlation.png?x=temp-0&y=adc&from=2018-01-01T00:00:00Z", http.StatusOK, "image/png"},
+		{"/plots/correlation.svg?x=temp-0&y=temp-1&kind=hist2d&from=2018-01-01T00:00:00Z", http.StatusOK, "image/svg+xml"},
+		{"/plots/correlation.svg?x=temp-0", http.StatusBadRequest, ""},
+		{"/plots/fast.gif", http.StatusNotFound, ""},
+		{"/plots/slow.svg", http.StatusNotFound, ""},
+		{"/plots/fast.svg?w=-1", http.StatusBadRequest, ""},
+		{"/plots/fast.png?w=200", http.StatusBadRequest, ""},
+		{"/plots/fast.png?h=40", http.StatusBadRequest, ""},
+		{"/plots/fast.png?w=50&h=50", http.StatusOK, "image/png"},
+		{"/plots/fast.svg?last=xx", http.StatusBadRequest, ""},
+	} {
+		t.Run(tc.url, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, tc.url, nil)
+			srv.wrap(srv.plotsHandler)(w, r)
+			if got, want := w.Code, tc.code; got != want {
+				t.Fatalf("invalid status code: got=%d, want=%d (%s)", got, want, w.Body.String())
+			}
+			if tc.mime == "" {
+				return
+			}
+			if got, want := w.Header().Get("Content-Type"), tc.mime; got != want {
+				t.Fatalf("invalid content-type: got=%q, want=%q", got, want)
+			}
+			if w.Body.Len() == 0 {
+				t.Fatalf("empty plot")
+			}
+		})
+	}
+}
+
+func TestPlotsHandlerTrendSource(t *testing.T) {
+	t0 := time.Date(2018, 1, 3, 0, 0, 0, 0, time.UTC)
+	var (
+		fine   = newTrend(time.Second, time.Hour)
+		coarse = newTrend(time.Hour, 7*24*time.Hour)
+	)
+	for _, row := range newTestTable(t0.Add(-48 * time.Hour)) {
+		coarse.add(row)
+	}
+	for _, row := range newTestTable(t0) {
+		fine.add(row)
+		coarse.add(row)
+	}
+	srv := newHistoryServer(t, history{
+		trends: []trendTable{fine.table(), coarse.table()},
+	})
+
+	for _, url := range []string{
+		"/plots/trend.svg",
+		"/plots/trend.svg?from=2018-01-01T00:00:00Z&to=2018-01-02T00:00:00Z",
+	} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, url, nil)
+		srv.wrap(srv.plotsHandler)(w, r)
+		if got, want := w.Code, http.StatusOK; got != want {
+			t.Fatalf("%s: invalid status code: got=%d, want=%d (%s)", url, got, want, w.Body.String())
+		}
+	}
+}
+
+func TestControlPlotsLegendSize(t *testing.T) {
+	t0 := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	table := sensors.Table(newTestTable(t0))
+
+	font := func(size vg.Point) vg.Length {
+		t.Helper()
+		ps, err := newControlPlots(nil, nil, table, size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		leg := ps.tile.Plots[len(table.Types())]
+		if leg == nil {
+			t.Fatalf("missing legend")
+		}
+		return leg.Legend.TextStyle.Font.Size
+	}
+
+	small := font(vg.Point{X: 10 * vg.Centimeter, Y: 6 * vg.Centimeter})
+	large := font(renderSize())
+	if !(small < large) {
+		t.Fatalf("legend not laid out for the plot size: small=%v, large=%v", small, large)
+	}
+}
+
+func TestPlotColors(t *testing.T) {
+	red := color.NRGBA{R: 0xff, A: 0xff}
+	labels := []string{"t2", "t1", "t3"}
+	colors, err := plotColors(labels, map[string]color.Color{"t2": red})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := labels, []string{"t2", "t1", "t3"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("labels modified: got=%q, want=%q", got, want)
+	}
+	if len(colors) != 3 || colors["t2"] != red {
+		t.Fatalf("invalid colors: %v", colors)
+	}
+	if colors["t1"] == colors["t3"] || colors["t1"] == nil || colors["t3"] == nil {
+		t.Fatalf("palette colors not assigned: %v", colors)
+	}
+}
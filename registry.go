@@ -5,8 +5,14 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
+	"io"
 	"log"
+	"sync/atomic"
+	"time"
 
+	"github.com/sbinet-solid/solid-mon-rpi/sensors"
 	"golang.org/x/net/websocket"
 )
 
@@ -14,21 +20,194 @@ type registry struct {
 	clients    map[*client]bool
 	register   chan *client
 	unregister chan *client
+	subscribe  chan subscribeRequest
+
+	ping time.Duration // interval between two pings sent to the clients
+	pong time.Duration // time allowed to receive a frame from a client
+
+	dropped atomic.Int64 // total number of messages dropped for slow clients
 }
 
-func newRegistry() registry {
-	return registry{
+func newRegistry() *registry {
+	return &registry{
 		clients:    make(map[*client]bool),
 		register:   make(chan *client),
 		unregister: make(chan *client),
+		subscribe:  make(chan subscribeRequest),
+		ping:       pingPeriod,
+		pong:       pongWait,
 	}
 }
 
+const (
+	clientQueueSize = 16               // maximum number of messages queued for a client
+	maxMessageSize  = 4096             // maximum size of the messages sent by clients
+	writeWait       = 10 * time.Second // time allowed to write a message to a client
+	pingPeriod      = 30 * time.Second // interval between two pings
+	pongWait        = 60 * time.Second // time allowed to receive a frame (e.g. a pong) from a client
+)
+
 type client struct {
-	srv   *server
-	reg   *registry
-	ws    *websocket.Conn
-	datac chan []byte
+	srv     *server
+	reg     *registry
+	ws      *websocket.Conn
+	addr    string        // remote address of the client
+	datac   chan []byte   // messages queued by server.run
+	replies chan []byte   // replies to the client messages
+	done    chan struct{} // closed when the connection is closed by the client
+	ping    time.Duration // interval between two pings
+	pong    time.Duration // time allowed to receive a frame from the client
+
+	// owned by server.run
+	sub     *subscription // readings the client subscribed to (nil: full dashboard payload)
+	dropped int64         // number of messages dropped because the client was too slow
+	trends  time.Time     // update of the trend plots last sent to the client
+}
+
+// subscription selects the readings sent to a websocket client.
+//
+// By default, clients receive the full dashboard payload (plots and data
+// table) on each update.
+// Clients sending a subscription message, e.g.:
+//
+//	{"sensors": ["crate-1"], "types": ["temperature"], "decimate": 10}
+//
+// instead receive the readings of each acquisition matching the
+// subscription (in the format served by /echo.)
+// Empty sensors or types select all of them, and decimate sends one
+// matching acquisition out of that many (default: all of them.)
+type subscription struct {
+	Sensors  []string       `json:"sensors"`
+	Types    []sensors.Type `json:"types"`
+	Decimate int            `json:"decimate"`
+
+	n int // number of matching acquisitions
+}
+
+type subscribeRequest struct {
+	c   *client
+	sub *subscription
+}
+
+// parseSubscription decodes and validates a subscription message.
+func (srv *server) parseSubscription(msg []byte) (*subscription, error) {
+	var sub subscription
+	err := json.Unmarshal(msg, &sub)
+	if err != nil {
+		return nil, fmt.Errorf("invalid subscription message: %w", err)
+	}
+	switch {
+	case sub.Decimate < 0:
+		return nil, fmt.Errorf("invalid subscription decimation factor %d", sub.Decimate)
+	case sub.Decimate == 0:
+		sub.Decimate = 1
+	}
+
+	known := make(map[string]bool)
+	for _, bus := range srv.buses {
+		for _, descr := range bus.descr {
+			known[descr.Descr().Name] = true
+		}
+	}
+	for _, d := range srv.derived {
+		known[d.Name] = true
+	}
+	for _, name := range sub.Sensors {
+		if !known[name] {
+			return nil, fmt.Errorf("invalid subscription to unknown sensor %q", name)
+		}
+	}
+	return &sub, nil
+}
+
+// filter returns the readings of data matching the subscription.
+func (sub *subscription) filter(data sensors.Sensors) sensors.Sensors {
+	o := sensors.Sensors{
+		Timestamp: data.Timestamp,
+		Labels:    make(map[string][]sensors.Type),
+	}
+	for _, v := range data.Sensors {
+		if !sub.selected(v.Name, v.Type) {
+			continue
+		}
+		o.Sensors = append(o.Sensors, v)
+		o.Labels[v.Name] = append(o.Labels[v.Name], v.Type)
+	}
+	return o
+}
+
+func (sub *subscription) selected(name string, typ sensors.Type) bool {
+	match := func(n int, f func(i int) bool) bool {
+		if n == 0 {
+			return true
+		}
+		for i := 0; i < n; i++ {
+			if f(i) {
+				return true
+			}
+		}
+		return false
+	}
+	return match(len(sub.Sensors), func(i int) bool { return sub.Sensors[i] == name }) &&
+		match(len(sub.Types), func(i int) bool { return sub.Types[i] == typ })
+}
+
+// message returns the message to send to the subscribed client for the
+// provided acquisition, or nil if there is none (no matching reading, or
+// decimated acquisition.)
+func (sub *subscription) message(data sensors.Sensors) []byte {
+	v := sub.filter(data)
+	if len(v.Sensors) == 0 {
+		return nil
+	}
+	sub.n++
+	if (sub.n-1)%sub.Decimate != 0 {
+		return nil
+	}
+	raw, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("error marshalling subscribed data: %v", err)
+		return nil
+	}
+	return raw
+}
+
+// newClient creates a websocket client of the server.
+func newClient(srv *server, ws *websocket.Conn) *client {
+	ws.MaxPayloadBytes = maxMessageSize
+	return &client{
+		srv:     srv,
+		reg:     srv.dataReg,
+		ws:      ws,
+		addr:    ws.Request().RemoteAddr,
+		datac:   make(chan []byte, clientQueueSize),
+		replies: make(chan []byte, 4),
+		done:    make(chan struct{}),
+		ping:    srv.dataReg.ping,
+		pong:    srv.dataReg.pong,
+	}
+}
+
+// send queues msg for the client, dropping the oldest queued message if the
+// client is too slow to keep up.
+// send must only be called from the server.run goroutine.
+func (reg *registry) send(c *client, msg []byte) {
+	for {
+		select {
+		case c.datac <- msg:
+			return
+		default:
+		}
+		select {
+		case <-c.datac:
+			c.dropped++
+			reg.dropped.Add(1)
+			if c.dropped == 1 {
+				log.Printf("client [%v] too slow: dropping messages", c.addr)
+			}
+		default:
+		}
+	}
 }
 
 func (c *client) Release() {
@@ -38,19 +217,134 @@ func (c *client) Release() {
 	c.srv = nil
 }
 
+// read handles the messages sent by the client (subscriptions and close
+// frames), until the connection is closed or the client stops answering
+// the pings of the server.
+func (c *client) read(srv *server, reg *registry) {
+	defer close(c.done)
+	err := c.ws.SetReadDeadline(time.Now().Add(c.pong))
+	if err != nil {
+		return
+	}
+	for {
+		msg, err := c.receive()
+		switch {
+		case err == websocket.ErrFrameTooLarge:
+			c.reply(fmt.Errorf("message too large (max=%d bytes)", maxMessageSize))
+			continue
+		case err != nil:
+			// io.EOF upon a close frame, timeout for a half-open connection.
+			if err != io.EOF {
+				log.Printf("client [%v] unresponsive: %v", c.addr, err)
+			}
+			return
+		}
+		sub, err := srv.parseSubscription(msg)
+		if err != nil {
+			log.Printf("error from client [%v]: %v", c.addr, err)
+			c.reply(err)
+			continue
+		}
+		reg.subscribe <- subscribeRequest{c: c, sub: sub}
+	}
+}
+
+// receive returns the next message sent by the client.
+//
+// Unlike websocket.Message.Receive, it sees all the frames sent by the
+// client, including the pongs answering the pings of the server (which
+// the websocket package swallows): each of them extends the read deadline
+// of the connection.
+func (c *client) receive() ([]byte, error) {
+	for {
+		frame, err := c.ws.NewFrameReader()
+		if err != nil {
+			return nil, err
+		}
+		err = c.ws.SetReadDeadline(time.Now().Add(c.pong))
+		if err != nil {
+			return nil, err
+		}
+		// replies to pings, discards pongs and handles close frames.
+		frame, err = c.ws.HandleFrame(frame)
+		if err != nil {
+			return nil, err
+		}
+		if frame == nil {
+			continue
+		}
+		msg, err := io.ReadAll(io.LimitReader(frame, maxMessageSize+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(msg) > maxMessageSize {
+			_, err = io.Copy(io.Discard, frame)
+			if err != nil {
+				return nil, err
+			}
+			return nil, websocket.ErrFrameTooLarge
+		}
+		return msg, nil
+	}
+}
+
+// reply queues an error message for the client.
+func (c *client) reply(err error) {
+	msg, _ := json.Marshal(map[string]string{"error": err.Error()})
+	select {
+	case c.replies <- msg:
+	default:
+		// client not reading its replies.
+	}
+}
+
+// pingCodec sends websocket ping frames.
+var pingCodec = websocket.Codec{
+	Marshal: func(interface{}) ([]byte, byte, error) {
+		return nil, websocket.PingFrame, nil
+	},
+}
+
+// run sends the queued messages, and periodic pings, to the client until
+// the connection is closed or a write fails.
+//
+// Pings keep the connection alive through proxies, and let the read loop
+// detect unresponsive clients: a client not answering them is closed once
+// its read deadline expires (see client.receive.)
 func (c *client) run() {
-	//c.ws.SetReadLimit(maxMessageSize)
-	//c.ws.SetReadDeadline(time.Now().Add(pongWait))
-	//c.ws.SetPongHandler(func(string) error { c.ws.SetReadDeadline(time.Now().Add(pongWait)); return nil })
-	for data := range c.datac {
-		err := websocket.Message.Send(c.ws, string(data))
+	tick := time.NewTicker(c.ping)
+	defer tick.Stop()
+
+	send := func(codec websocket.Codec, v interface{}) error {
+		err := c.ws.SetWriteDeadline(time.Now().Add(writeWait))
+		if err != nil {
+			return err
+		}
+		return codec.Send(c.ws, v)
+	}
+
+	for {
+		var err error
+		select {
+		case <-c.done:
+			return
+		case data, ok := <-c.datac:
+			if !ok {
+				return
+			}
+			err = send(websocket.Message, string(data))
+		case msg := <-c.replies:
+			err = send(websocket.Message, string(msg))
+		case <-tick.C:
+			err = send(pingCodec, nil)
+		}
 		if err != nil {
 			log.Printf(
 				"error sending data to [%v]: %v\n",
-				c.ws.LocalAddr(),
+				c.addr,
 				err,
 			)
-			break
+			return
 		}
 	}
 }
@@ -0,0 +1,367 @@
+// Copyright 2018 The solid-mon-rpi Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sbinet-solid/solid-mon-rpi/sensors"
+	"golang.org/x/net/websocket"
+)
+
+func TestSubscription(t *testing.T) {
+	srv := &server{
+		buses: []*i2cBus{{descr: []sensors.Descr{
+			&sensors.DescrAT30TSE{DescrBase: sensors.DescrBase{Name: "temp-0"}},
+			&sensors.DescrADC101x{Base: sensors.DescrBase{Name: "adc"}},
+		}}},
+		derived: []sensors.Derived{{Name: "dew"}},
+	}
+
+	for _, tc := range []struct {
+		msg string
+		err string
+	}{
+		{`{"sensors": ["temp-0", "dew"], "types": ["temperature"], "decimate": 2}`, ""},
+		{`{}`, ""},
+		{`{"sensors": ["temp-1"]}`, `unknown sensor "temp-1"`},
+		{`{"types": ["colour"]}`, "invalid subscription message"},
+		{`{"decimate": -1}`, "invalid subscription decimation factor -1"},
+		{`not json`, "invalid subscription message"},
+	} {
+		t.Run(tc.msg, func(t *testing.T) {
+			_, err := srv.parseSubscription([]byte(tc.msg))
+			switch {
+			case err == nil && tc.err != "":
+				t.Fatalf("expected an error (%s)", tc.err)
+			case err != nil && tc.err == "":
+				t.Fatalf("unexpected error: %+v", err)
+			case err != nil && !strings.Contains(err.Error(), tc.err):
+				t.Fatalf("invalid error: got=%q, want=%q", err, tc.err)
+			}
+		})
+	}
+
+	sub, err := srv.parseSubscription([]byte(`{"sensors": ["temp-0", "adc"], "types": ["voltage"], "decimate": 3}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t0 := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	var got []string
+	for i, row := range newTestTable(t0) {
+		if i == 1 {
+			// no matching reading: does not count for the decimation.
+			row.Sensors = row.Sensors[:len(row.Sensors)-1]
+		}
+		msg := sub.message(row)
+		if msg == nil {
+			continue
+		}
+		var v sensors.Sensors
+		err := json.Unmarshal(msg, &v)
+		if err != nil {
+			t.Fatalf("invalid message: %+v", err)
+		}
+		if len(v.Sensors) != 1 || v.Sensors[0].Name != "adc" {
+			t.Fatalf("invalid readings: %+v", v.Sensors)
+		}
+		got = append(got, v.Timestamp.Format("05"))
+	}
+	if want := []string{"00", "04", "07"}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("invalid decimated messages: got=%v, want=%v", got, want)
+	}
+}
+
+func TestSubscriptionWebsocket(t *testing.T) {
+	srv := &server{
+		freq:    time.Second,
+		tick:    time.Hour, // no data acquisition.
+		quit:    make(chan int),
+		data:    make(chan sensors.Sensors),
+		dataReg: newRegistry(),
+		plots:   make(chan Plots),
+		echo:    make(chan chan sensors.Sensors),
+		hist:    make(chan chan history),
+		buses: []*i2cBus{{descr: []sensors.Descr{
+			&sensors.DescrAT30TSE{DescrBase: sensors.DescrBase{Name: "temp-3"}},
+		}}},
+		subscribe:   make(chan *subscriber),
+		unsubscribe: make(chan *subscriber),
+	}
+	srv.windows.fast = time.Hour
+	srv.windows.trend = time.Hour
+	srv.health = newHealth(srv.tick, srv.buses)
+	go srv.run()
+
+	ts := httptest.NewServer(websocket.Handler(srv.dataHandler))
+	defer ts.Close()
+
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), "", ts.URL)
+	if err != nil {
+		t.Fatalf("could not dial: %+v", err)
+	}
+	defer ws.Close()
+
+	err = websocket.Message.Send(ws, `{"sensors": ["temp-4"]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reply map[string]string
+	err = websocket.JSON.Receive(ws, &reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(reply["error"], `unknown sensor "temp-4"`) {
+		t.Fatalf("invalid error reply: %v", reply)
+	}
+
+	err = websocket.Message.Send(ws, `{"sensors": ["temp-3"]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		t0 := time.Now().UTC()
+		for i := 0; ; i++ {
+			row := newTestTable(t0.Add(time.Duration(i) * time.Second))[0]
+			select {
+			case srv.data <- row:
+			case <-done:
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+
+	// until the subscription is processed, the full payload is sent.
+	for {
+		var msg string
+		err = websocket.Message.Receive(ws, &msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(msg, `"plot"`) {
+			continue
+		}
+		var v sensors.Sensors
+		err = json.Unmarshal([]byte(msg), &v)
+		if err != nil {
+			t.Fatalf("invalid message %q: %+v", msg, err)
+		}
+		if len(v.Sensors) != 1 || v.Sensors[0].Name != "temp-3" {
+			t.Fatalf("invalid readings: %+v", v.Sensors)
+		}
+		break
+	}
+}
+
+func TestRegistrySend(t *testing.T) {
+	reg := newRegistry()
+	c := &client{datac: make(chan []byte, clientQueueSize)}
+	const n = clientQueueSize + 4
+	for i := 0; i < n; i++ {
+		reg.send(c, []byte{byte(i)})
+	}
+	if got, want := c.dropped, int64(n-clientQueueSize); got != want {
+		t.Fatalf("invalid number of dropped messages: got=%d, want=%d", got, want)
+	}
+	if got, want := reg.dropped.Load(), c.dropped; got != want {
+		t.Fatalf("invalid total of dropped messages: got=%d, want=%d", got, want)
+	}
+	// the oldest messages were dropped.
+	for i := n - clientQueueSize; i < n; i++ {
+		if got := <-c.datac; got[0] != byte(i) {
+			t.Fatalf("invalid queued message: got=%d, want=%d", got[0], i)
+		}
+	}
+}
+
+func TestClientClose(t *testing.T) {
+	srv := &server{
+		freq:    time.Second,
+		tick:    time.Hour, // no data acquisition.
+		quit:    make(chan int),
+		data:    make(chan sensors.Sensors),
+		dataReg: newRegistry(),
+		plots:   make(chan Plots),
+		echo:    make(chan chan sensors.Sensors),
+		hist:    make(chan chan history),
+
+		subscribe:   make(chan *subscriber),
+		unsubscribe: make(chan *subscriber),
+	}
+	srv.windows.fast = time.Hour
+	srv.windows.trend = time.Hour
+	srv.health = newHealth(srv.tick, srv.buses)
+	go srv.run()
+
+	done := make(chan struct{})
+	ts := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		defer close(done)
+		srv.dataHandler(ws)
+	}))
+	defer ts.Close()
+
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), "", ts.URL)
+	if err != nil {
+		t.Fatalf("could not dial: %+v", err)
+	}
+	// make sure the client is registered.
+	err = websocket.Message.Send(ws, `{"decimate": -1}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reply map[string]string
+	err = websocket.JSON.Receive(ws, &reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// no data is flowing: the closing of the connection must be detected
+	// by the read loop.
+	ws.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("closed connection not detected")
+	}
+}
+
+func TestClientUnresponsive(t *testing.T) {
+	srv := &server{
+		freq:    time.Second,
+		tick:    time.Hour, // no data acquisition.
+		quit:    make(chan int),
+		data:    make(chan sensors.Sensors),
+		dataReg: newRegistry(),
+		plots:   make(chan Plots),
+		echo:    make(chan chan sensors.Sensors),
+		hist:    make(chan chan history),
+
+		subscribe:   make(chan *subscriber),
+		unsubscribe: make(chan *subscriber),
+	}
+	srv.windows.fast = time.Hour
+	srv.windows.trend = time.Hour
+	srv.health = newHealth(srv.tick, srv.buses)
+	srv.dataReg.ping = 50 * time.Millisecond
+	srv.dataReg.pong = 300 * time.Millisecond
+	go srv.run()
+
+	done := make(chan struct{}, 2)
+	ts := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		srv.dataHandler(ws)
+		done <- struct{}{}
+	}))
+	defer ts.Close()
+
+	dial := func() *websocket.Conn {
+		ws, err := websocket.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), "", ts.URL)
+		if err != nil {
+			t.Fatalf("could not dial: %+v", err)
+		}
+		return ws
+	}
+
+	// a client reading its messages answers the pings of the server.
+	alive := dial()
+	defer alive.Close()
+	go func() {
+		for {
+			var msg string
+			err := websocket.Message.Receive(alive, &msg)
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	// a silent peer (e.g. a half-open connection) never answers them.
+	silent := dial()
+	defer silent.Close()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("silent peer not detected")
+	}
+
+	select {
+	case <-done:
+		t.Fatalf("responsive client disconnected")
+	case <-time.After(3 * srv.dataReg.pong):
+	}
+}
+
+func TestBroadcastTrends(t *testing.T) {
+	srv := &server{dataReg: newRegistry()}
+	c := &client{datac: make(chan []byte, clientQueueSize)}
+	srv.dataReg.clients[c] = true
+
+	t0 := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	table := newTestTable(t0)
+	fast, err := newControlPlots(nil, nil, sensors.Table(table), renderSize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	trends := fast
+	trends.svg = new(string) // not shared with the fast plots.
+
+	recv := func() map[string]string {
+		t.Helper()
+		var msg map[string]string
+		err := json.Unmarshal(<-c.datac, &msg)
+		if err != nil {
+			t.Fatalf("could not decode message: %+v", err)
+		}
+		return msg
+	}
+
+	for i, tc := range []struct {
+		update time.Time // update of the trend plots
+		trends bool      // whether the trend plots are sent
+	}{
+		{t0, true},
+		{t0, false},
+		{t0, false},
+		{t0.Add(time.Minute), true},
+		{t0.Add(time.Minute), false},
+	} {
+		trends.update = tc.update
+		srv.broadcast(Plots{plots: fast, trends: trends, redrawn: true, data: table[len(table)-1]})
+		msg := recv()
+		if _, ok := msg["trends"]; ok != tc.trends {
+			t.Fatalf("update #%d: invalid trend plots (sent=%v, want=%v)", i, ok, tc.trends)
+		}
+		if !strings.Contains(msg["plot"], "<svg") {
+			t.Fatalf("update #%d: missing fast plots", i)
+		}
+	}
+
+	// dashboard clients are not sent plots which were not redrawn.
+	srv.broadcast(Plots{plots: fast, trends: trends})
+	if n := len(c.datac); n != 0 {
+		t.Fatalf("unexpected messages: %d", n)
+	}
+
+	// the trend plots are sent again when they may have been dropped.
+	for i := 0; i < clientQueueSize+1; i++ {
+		srv.broadcast(Plots{plots: fast, trends: trends, redrawn: true})
+	}
+	srv.broadcast(Plots{plots: fast, trends: trends, redrawn: true})
+	var msg map[string]string
+	for len(c.datac) > 0 {
+		msg = recv()
+	}
+	if _, ok := msg["trends"]; !ok {
+		t.Fatalf("trend plots not sent again after dropped messages")
+	}
+}
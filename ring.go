@@ -0,0 +1,107 @@
+// Copyright 2018 The solid-mon-rpi Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"time"
+)
+
+// ring is a ring buffer of time-stamped values, holding the values of the
+// last window duration (relative to the most recent value).
+//
+// Inserting a value is O(1): expired values are evicted from the front of
+// the buffer, and the buffer grows when more values than anticipated
+// fall within the time window.
+type ring[T any] struct {
+	window time.Duration
+	stamp  func(v *T) time.Time
+
+	buf []T
+	beg int // index of the oldest value
+	n   int // number of values
+}
+
+// newRing creates a ring buffer for the provided time window.
+// n is the anticipated number of values within the time window.
+func newRing[T any](window time.Duration, n int, stamp func(v *T) time.Time) *ring[T] {
+	if n < 1 {
+		n = 1
+	}
+	return &ring[T]{
+		window: window,
+		stamp:  stamp,
+		buf:    make([]T, n),
+	}
+}
+
+// Len returns the number of values in the ring buffer.
+func (r *ring[T]) Len() int { return r.n }
+
+// at returns the i-th oldest value.
+func (r *ring[T]) at(i int) *T {
+	return &r.buf[(r.beg+i)%len(r.buf)]
+}
+
+// add adds v to the ring buffer and evicts the values that fell out of
+// the time window.
+func (r *ring[T]) add(v T) {
+	now := r.stamp(&v)
+	for r.n > 0 && now.Sub(r.stamp(r.at(0))) > r.window {
+		var zero T
+		*r.at(0) = zero
+		r.beg = (r.beg + 1) % len(r.buf)
+		r.n--
+	}
+
+	if r.n == len(r.buf) {
+		r.grow()
+	}
+	*r.at(r.n) = v
+	r.n++
+}
+
+func (r *ring[T]) grow() {
+	buf := make([]T, 2*len(r.buf))
+	r.copy(buf)
+	r.buf = buf
+	r.beg = 0
+}
+
+// copy copies the values of the ring buffer into dst, from the oldest to
+// the most recent one.
+func (r *ring[T]) copy(dst []T) int {
+	end := r.beg + r.n
+	if end <= len(r.buf) {
+		return copy(dst, r.buf[r.beg:end])
+	}
+	n := copy(dst, r.buf[r.beg:])
+	return n + copy(dst[n:], r.buf[:end-len(r.buf)])
+}
+
+// slice returns a copy of the values of the ring buffer, from the oldest
+// to the most recent one.
+func (r *ring[T]) slice() []T {
+	o := make([]T, r.n)
+	r.copy(o)
+	return o
+}
+
+// sample returns a copy of at most n values of the ring buffer, evenly
+// spread from the oldest to the most recent one (included.)
+func (r *ring[T]) sample(n int) []T {
+	switch {
+	case r.n <= n:
+		return r.slice()
+	case n <= 0:
+		return nil
+	case n == 1:
+		return []T{*r.at(r.n - 1)}
+	}
+	o := make([]T, n)
+	for i := range o {
+		o[i] = *r.at(i * (r.n - 1) / (n - 1))
+	}
+	return o
+}
@@ -0,0 +1,73 @@
+// Copyright 2018 The solid-mon-rpi Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRing(t *testing.T) {
+	t0 := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	r := newRing(10*time.Second, 2, func(v *time.Time) time.Time { return *v })
+
+	at := func(secs ...int) []time.Time {
+		o := make([]time.Time, len(secs))
+		for i, s := range secs {
+			o[i] = t0.Add(time.Duration(s) * time.Second)
+		}
+		return o
+	}
+
+	for _, tc := range []struct {
+		add  int
+		want []time.Time
+	}{
+		{0, at(0)},
+		{4, at(0, 4)},
+		{8, at(0, 4, 8)}, // grow
+		{10, at(0, 4, 8, 10)},
+		{12, at(4, 8, 10, 12)},
+		{15, at(8, 10, 12, 15)},
+		{19, at(10, 12, 15, 19)},
+		{40, at(40)},
+		{41, at(40, 41)},
+	} {
+		r.add(t0.Add(time.Duration(tc.add) * time.Second))
+		if got := r.slice(); !reflect.DeepEqual(got, tc.want) {
+			t.Fatalf("add(%d): invalid ring content:\ngot= %v\nwant=%v", tc.add, got, tc.want)
+		}
+		if got, want := r.Len(), len(tc.want); got != want {
+			t.Fatalf("add(%d): invalid length: got=%d, want=%d", tc.add, got, want)
+		}
+	}
+}
+
+func TestRingSample(t *testing.T) {
+	r := newRing(time.Hour, 4, func(v *int) time.Time {
+		return time.Date(2018, 1, 1, 0, 0, *v, 0, time.UTC)
+	})
+	for i := 0; i < 11; i++ {
+		r.add(i)
+	}
+
+	for _, tc := range []struct {
+		n    int
+		want []int
+	}{
+		{0, nil},
+		{1, []int{10}},
+		{2, []int{0, 10}},
+		{3, []int{0, 5, 10}},
+		{4, []int{0, 3, 6, 10}},
+		{11, []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10}},
+		{20, []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10}},
+	} {
+		if got := r.sample(tc.n); !reflect.DeepEqual(got, tc.want) {
+			t.Fatalf("sample(%d): got=%v, want=%v", tc.n, got, tc.want)
+		}
+	}
+}
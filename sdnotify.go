@@ -0,0 +1,157 @@
+// Copyright 2018 The solid-mon-rpi Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// notifier reports the state of the server to systemd, with the sd_notify
+// protocol: datagrams of newline-separated VAR=value assignments sent to
+// the unix socket named by $NOTIFY_SOCKET.
+type notifier struct {
+	conn     *net.UnixConn
+	watchdog time.Duration // watchdog timeout (0 if disabled)
+	ready    bool          // whether READY=1 was sent
+}
+
+// newNotifier connects to the systemd notification socket.
+// It returns nil when the server is not run by systemd (or not as a
+// Type=notify service.)
+func newNotifier() (*notifier, error) {
+	name := os.Getenv("NOTIFY_SOCKET")
+	if name == "" {
+		return nil, nil
+	}
+	if strings.HasPrefix(name, "@") {
+		// abstract namespace socket.
+		name = "\x00" + name[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		return nil, fmt.Errorf("sd_notify: could not connect to notification socket: %w", err)
+	}
+
+	n := &notifier{conn: conn}
+	if v := os.Getenv("WATCHDOG_USEC"); v != "" {
+		if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+			// watchdog meant for another process.
+			return n, nil
+		}
+		usec, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || usec <= 0 {
+			conn.Close()
+			return nil, fmt.Errorf("sd_notify: invalid WATCHDOG_USEC=%q", v)
+		}
+		n.watchdog = time.Duration(usec) * time.Microsecond
+	}
+	return n, nil
+}
+
+func (n *notifier) Close() error {
+	return n.conn.Close()
+}
+
+// notify sends the provided state assignments.
+func (n *notifier) notify(states ...string) error {
+	_, err := n.conn.Write([]byte(strings.Join(states, "\n")))
+	if err != nil {
+		return fmt.Errorf("sd_notify: could not send notification: %w", err)
+	}
+	return nil
+}
+
+// period returns the interval between two state updates: half the
+// watchdog timeout, so a single late update does not trigger it.
+func (n *notifier) period() time.Duration {
+	const max = 10 * time.Second
+	if n.watchdog > 0 && n.watchdog/2 < max {
+		return n.watchdog / 2
+	}
+	return max
+}
+
+// update reports the health of the server: READY=1 once sensors data is
+// acquired and stored, a STATUS line, and a WATCHDOG=1 keep-alive as long
+// as the server goroutines make progress.
+func (n *notifier) update(rep healthReport) error {
+	states := []string{"STATUS=" + healthStatus(rep)}
+	if rep.Ready && !n.ready {
+		states = append(states, "READY=1")
+	}
+	if rep.Healthy && n.watchdog > 0 {
+		states = append(states, "WATCHDOG=1")
+	}
+	err := n.notify(states...)
+	if err != nil {
+		return err
+	}
+	n.ready = n.ready || rep.Ready
+	return nil
+}
+
+// healthStatus summarizes the health report in a single line.
+func healthStatus(rep healthReport) string {
+	var (
+		buses   = 0
+		failing = 0
+	)
+	for _, bus := range rep.Buses {
+		if bus.Connected {
+			buses++
+		}
+	}
+	for _, s := range rep.Sensors {
+		if s.Failing {
+			failing++
+		}
+	}
+	last := "none"
+	if !rep.LastAcquisition.IsZero() {
+		last = fmt.Sprintf("%.1fs ago", rep.LastAcquisitionAge)
+	}
+	o := fmt.Sprintf(
+		"%s: buses %d/%d connected, %d/%d sensors failing, last acquisition %s",
+		rep.Status, buses, len(rep.Buses), failing, len(rep.Sensors), last,
+	)
+	for _, name := range healthGoroutines {
+		if g, ok := rep.Goroutines[name]; ok && !g.Alive {
+			o += fmt.Sprintf(", %s stuck for %.0fs", name, g.Age)
+		}
+	}
+	return o
+}
+
+// sdnotify periodically reports the health of the server to systemd.
+func (srv *server) sdnotify(n *notifier) {
+	defer n.Close()
+
+	if n.watchdog > 0 {
+		log.Printf("sd_notify: watchdog enabled (timeout=%v)", n.watchdog)
+	}
+	tick := time.NewTicker(n.period())
+	defer tick.Stop()
+	for {
+		rep := srv.health.report(time.Now().UTC())
+		ready := n.ready
+		err := n.update(rep)
+		if err != nil {
+			log.Printf("%v", err)
+		}
+		if !ready && n.ready {
+			log.Printf("sd_notify: server ready")
+		}
+		if !rep.Healthy && n.watchdog > 0 {
+			log.Printf("sd_notify: server stuck, withholding watchdog keep-alive (%s)", healthStatus(rep))
+		}
+		<-tick.C
+	}
+}
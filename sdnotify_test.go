@@ -0,0 +1,135 @@
+// Copyright 2018 The solid-mon-rpi Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sbinet-solid/solid-mon-rpi/sensors"
+)
+
+func TestNotifier(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	n, err := newNotifier()
+	if err != nil || n != nil {
+		t.Fatalf("unexpected notifier outside of systemd: %v, %+v", n, err)
+	}
+
+	fname := filepath.Join(t.TempDir(), "notify.sock")
+	sock, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: fname, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("could not create notification socket: %+v", err)
+	}
+	defer sock.Close()
+
+	t.Setenv("NOTIFY_SOCKET", fname)
+	t.Setenv("WATCHDOG_USEC", "2000000")
+	n, err = newNotifier()
+	if err != nil {
+		t.Fatalf("could not create notifier: %+v", err)
+	}
+	defer n.Close()
+
+	if got, want := n.watchdog, 2*time.Second; got != want {
+		t.Fatalf("invalid watchdog timeout: got=%v, want=%v", got, want)
+	}
+	if got, want := n.period(), time.Second; got != want {
+		t.Fatalf("invalid period: got=%v, want=%v", got, want)
+	}
+
+	recv := func() []string {
+		t.Helper()
+		buf := make([]byte, 4096)
+		err := sock.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := sock.Read(buf)
+		if err != nil {
+			t.Fatalf("could not receive notification: %+v", err)
+		}
+		return strings.Split(string(buf[:n]), "\n")
+	}
+
+	bus := &i2cBus{id: 1, descr: []sensors.Descr{
+		&sensors.DescrAT30TSE{DescrBase: sensors.DescrBase{Name: "temp-1"}},
+	}}
+	h := newHealth(time.Second, []*i2cBus{bus})
+	now := h.start
+
+	// not ready yet.
+	err = n.update(h.report(now))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := recv()
+	if got, want := strings.Join(msg, "|"), "STATUS=failing: buses 0/1 connected, 0/1 sensors failing, last acquisition none|WATCHDOG=1"; got != want {
+		t.Fatalf("invalid notification:\ngot= %q\nwant=%q", got, want)
+	}
+
+	// ready, once.
+	h.acquired(now, busData{bus: bus, data: sensors.Sensors{
+		Timestamp: now,
+		Sensors:   []sensors.Data{{Name: "temp-1", Type: sensors.Temperature, Value: 20}},
+	}})
+	h.stored(now, 1)
+	for i, want := range []string{
+		"STATUS=ok: buses 1/1 connected, 0/1 sensors failing, last acquisition 0.0s ago|READY=1|WATCHDOG=1",
+		"STATUS=ok: buses 1/1 connected, 0/1 sensors failing, last acquisition 0.0s ago|WATCHDOG=1",
+	} {
+		err = n.update(h.report(now))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Join(recv(), "|"); got != want {
+			t.Fatalf("invalid notification #%d:\ngot= %q\nwant=%q", i, got, want)
+		}
+	}
+
+	// stuck acquisition: no watchdog keep-alive.
+	later := now.Add(h.timeout + time.Second)
+	h.beat("mon", later)
+	h.beat("run", later)
+	err = n.update(h.report(later))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg = recv()
+	if len(msg) != 1 || !strings.HasSuffix(msg[0], "daq stuck for 11s") {
+		t.Fatalf("invalid notification: %q", msg)
+	}
+}
+
+func TestNotifierInvalidWatchdog(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "notify.sock")
+	sock, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: fname, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("could not create notification socket: %+v", err)
+	}
+	defer sock.Close()
+
+	t.Setenv("NOTIFY_SOCKET", fname)
+	t.Setenv("WATCHDOG_USEC", "nope")
+	_, err = newNotifier()
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+
+	// watchdog of another process.
+	t.Setenv("WATCHDOG_USEC", "1000000")
+	t.Setenv("WATCHDOG_PID", "1")
+	n, err := newNotifier()
+	if err != nil {
+		t.Fatalf("could not create notifier: %+v", err)
+	}
+	defer n.Close()
+	if n.watchdog != 0 {
+		t.Fatalf("unexpected watchdog: %v", n.watchdog)
+	}
+}
@@ -0,0 +1,180 @@
+// Copyright 2018 The solid-mon-rpi Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sensors
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Calibration converts raw sensor values into calibrated values:
+//
+//	v = Gain * f(raw) + Offset
+//
+// where f is the polynomial Poly, the piecewise-linear lookup table LUT,
+// or the identity when neither is defined.
+type Calibration struct {
+	Type   Type // quantity to calibrate (InvalidType: all quantities)
+	Offset float64
+	Gain   float64
+	Poly   []float64 // polynomial coefficients, in increasing degree order
+	LUT    []Point   // lookup table, sorted by raw value
+}
+
+// Point is a (raw, calibrated) pair of a lookup table.
+type Point struct {
+	Raw   float64
+	Value float64
+}
+
+// Apply returns the calibrated value of v.
+func (c *Calibration) Apply(v float64) float64 {
+	switch {
+	case len(c.LUT) > 0:
+		v = interp(c.LUT, v)
+	case len(c.Poly) > 0:
+		// Horner's method.
+		p := 0.0
+		for i := len(c.Poly) - 1; i >= 0; i-- {
+			p = p*v + c.Poly[i]
+		}
+		v = p
+	}
+	return c.Gain*v + c.Offset
+}
+
+// interp linearly interpolates v within the lookup table.
+// Values outside of the table range are extrapolated from the first
+// (or last) segment.
+func interp(lut []Point, v float64) float64 {
+	if len(lut) == 1 {
+		return lut[0].Value + v - lut[0].Raw
+	}
+	i := sort.Search(len(lut), func(i int) bool { return lut[i].Raw >= v })
+	switch {
+	case i == 0:
+		i = 1
+	case i == len(lut):
+		i = len(lut) - 1
+	}
+	lo, hi := lut[i-1], lut[i]
+	return lo.Value + (v-lo.Raw)*(hi.Value-lo.Value)/(hi.Raw-lo.Raw)
+}
+
+// rawCalib holds the XML attributes describing a calibration.
+type rawCalib struct {
+	Type   string `xml:"type,attr"`
+	Offset string `xml:"offset,attr"`
+	Gain   string `xml:"gain,attr"`
+	Poly   string `xml:"poly,attr"`
+	LUT    string `xml:"lut,attr"`
+}
+
+func (raw rawCalib) isZero() bool {
+	return raw.Offset == "" && raw.Gain == "" && raw.Poly == "" && raw.LUT == ""
+}
+
+func (raw rawCalib) decode() (Calibration, error) {
+	c := Calibration{Gain: 1}
+	if raw.Type != "" {
+		typ, err := ParseType(raw.Type)
+		if err != nil {
+			return c, err
+		}
+		c.Type = typ
+	}
+
+	var err error
+	if raw.Offset != "" {
+		c.Offset, err = strconv.ParseFloat(raw.Offset, 64)
+		if err != nil {
+			return c, fmt.Errorf("sensors: invalid calibration offset: %w", err)
+		}
+	}
+	if raw.Gain != "" {
+		c.Gain, err = strconv.ParseFloat(raw.Gain, 64)
+		if err != nil {
+			return c, fmt.Errorf("sensors: invalid calibration gain: %w", err)
+		}
+	}
+	if raw.Poly != "" && raw.LUT != "" {
+		return c, fmt.Errorf("sensors: calibration with both a polynomial and a lookup table")
+	}
+	if raw.Poly != "" {
+		for _, tok := range strings.Split(raw.Poly, ",") {
+			v, err := strconv.ParseFloat(strings.TrimSpace(tok), 64)
+			if err != nil {
+				return c, fmt.Errorf("sensors: invalid calibration polynomial %q: %w", raw.Poly, err)
+			}
+			c.Poly = append(c.Poly, v)
+		}
+	}
+	if raw.LUT != "" {
+		c.LUT, err = readLUT(raw.LUT)
+		if err != nil {
+			return c, err
+		}
+	}
+	return c, nil
+}
+
+// readLUT reads a lookup table from a file containing one (raw, calibrated)
+// pair per line, separated by spaces or commas.
+// Empty lines and lines starting with '#' are ignored.
+func readLUT(fname string) ([]Point, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, fmt.Errorf("sensors: could not open calibration table: %w", err)
+	}
+	defer f.Close()
+
+	var (
+		lut []Point
+		sc  = bufio.NewScanner(f)
+		ln  = 0
+	)
+	for sc.Scan() {
+		ln++
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		toks := strings.FieldsFunc(line, func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\t'
+		})
+		if len(toks) != 2 {
+			return nil, fmt.Errorf("sensors: %s:%d: invalid calibration table entry %q", fname, ln, line)
+		}
+		var p Point
+		p.Raw, err = strconv.ParseFloat(toks[0], 64)
+		if err != nil {
+			return nil, fmt.Errorf("sensors: %s:%d: %w", fname, ln, err)
+		}
+		p.Value, err = strconv.ParseFloat(toks[1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("sensors: %s:%d: %w", fname, ln, err)
+		}
+		lut = append(lut, p)
+	}
+	err = sc.Err()
+	if err != nil {
+		return nil, fmt.Errorf("sensors: could not read calibration table %q: %w", fname, err)
+	}
+	if len(lut) == 0 {
+		return nil, fmt.Errorf("sensors: empty calibration table %q", fname)
+	}
+
+	sort.Slice(lut, func(i, j int) bool { return lut[i].Raw < lut[j].Raw })
+	for i := 1; i < len(lut); i++ {
+		if lut[i].Raw == lut[i-1].Raw {
+			return nil, fmt.Errorf("sensors: duplicate raw value %v in calibration table %q", lut[i].Raw, fname)
+		}
+	}
+	return lut, nil
+}
@@ -0,0 +1,73 @@
+// Copyright 2018 The solid-mon-rpi Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sensors
+
+import (
+	"encoding/xml"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCalibration(t *testing.T) {
+	lut := filepath.Join(t.TempDir(), "lut.txt")
+	err := os.WriteFile(lut, []byte(`# raw calibrated
+10, 12
+0,  0
+
+20  30
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	raw := fmt.Sprintf(`<sensor name="dev" channel="1" type="HTS221" offset="-0.5">
+	<calib type="humidity" poly="1, 2, 0.5"/>
+	<calib type="pressure" lut=%q gain="2"/>
+</sensor>`, lut)
+
+	var descr DescrHTS221
+	err = xml.Unmarshal([]byte(raw), &descr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		typ  Type
+		raw  float64
+		want float64
+	}{
+		{Temperature, 20, 19.5},
+		{Humidity, 2, 1 + 2*2 + 0.5*2*2},
+		{Pressure, 5, 2 * 6},
+		{Pressure, 15, 2 * 21},
+		{Pressure, -10, 2 * -12},
+		{Pressure, 30, 2 * 48},
+	} {
+		t.Run(fmt.Sprintf("%v-%v", tc.typ, tc.raw), func(t *testing.T) {
+			got := descr.Calibrate(tc.typ, tc.raw)
+			if math.Abs(got-tc.want) > 1e-12 {
+				t.Fatalf("got=%v, want=%v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestCalibrationInvalid(t *testing.T) {
+	for _, raw := range []string{
+		`<sensor name="dev" type="AT30TSE" offset="x"/>`,
+		`<sensor name="dev" type="AT30TSE" poly="1,2" lut="lut.txt"/>`,
+		`<sensor name="dev" type="AT30TSE"><calib type="foo" gain="2"/></sensor>`,
+		`<sensor name="dev" type="AT30TSE" lut="not-there.txt"/>`,
+	} {
+		var descr DescrAT30TSE
+		err := xml.Unmarshal([]byte(raw), &descr)
+		if err == nil {
+			t.Fatalf("expected an error for %s", raw)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+// Copyright 2018 The solid-mon-rpi Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sensors
+
+import (
+	"encoding/xml"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// Derived describes a virtual sensor whose values are computed from the
+// readings of other sensors.
+type Derived struct {
+	Name   string
+	Func   string  // dew-point, absolute-humidity, average or difference
+	Inputs []Input // readings the derived value is computed from
+}
+
+// Input identifies a quantity measured by a sensor.
+type Input struct {
+	Name string
+	Type Type
+}
+
+func (in Input) String() string {
+	return fmt.Sprintf("%s (%v)", in.Name, in.Type)
+}
+
+func (d *Derived) UnmarshalXML(dec *xml.Decoder, start xml.StartElement) error {
+	var raw struct {
+		Name   string `xml:"name,attr"`
+		Func   string `xml:"type,attr"`
+		Inputs []struct {
+			Name string `xml:"sensor,attr"`
+			Type string `xml:"type,attr"`
+		} `xml:"input"`
+	}
+	err := dec.DecodeElement(&raw, &start)
+	if err != nil {
+		return err
+	}
+
+	d.Name = raw.Name
+	d.Func = strings.ToLower(raw.Func)
+	d.Inputs = make([]Input, len(raw.Inputs))
+	for i, in := range raw.Inputs {
+		typ, err := ParseType(in.Type)
+		if err != nil {
+			return fmt.Errorf("sensors: invalid input for derived sensor %q: %w", d.Name, err)
+		}
+		d.Inputs[i] = Input{Name: in.Name, Type: typ}
+	}
+
+	return d.validate()
+}
+
+func (d *Derived) validate() error {
+	if d.Name == "" {
+		return fmt.Errorf("sensors: derived sensor with no name")
+	}
+
+	want := func(types ...Type) error {
+		if len(d.Inputs) != len(types) {
+			return fmt.Errorf(
+				"sensors: derived sensor %q (%s) needs %d inputs (got=%d)",
+				d.Name, d.Func, len(types), len(d.Inputs),
+			)
+		}
+		for i, typ := range types {
+			if d.Inputs[i].Type != typ {
+				return fmt.Errorf(
+					"sensors: derived sensor %q (%s) needs a %v input #%d (got=%v)",
+					d.Name, d.Func, typ, i, d.Inputs[i].Type,
+				)
+			}
+		}
+		return nil
+	}
+
+	switch d.Func {
+	case "dew-point", "absolute-humidity":
+		return want(Temperature, Humidity)
+	case "average", "difference":
+		if len(d.Inputs) == 0 {
+			return fmt.Errorf("sensors: derived sensor %q (%s) has no input", d.Name, d.Func)
+		}
+		if d.Func == "difference" && len(d.Inputs) != 2 {
+			return fmt.Errorf("sensors: derived sensor %q (difference) needs 2 inputs (got=%d)", d.Name, len(d.Inputs))
+		}
+		for _, in := range d.Inputs[1:] {
+			if in.Type != d.Inputs[0].Type {
+				return fmt.Errorf(
+					"sensors: derived sensor %q (%s) has inputs of different types (%v and %v)",
+					d.Name, d.Func, d.Inputs[0].Type, in.Type,
+				)
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("sensors: derived sensor %q has an invalid type %q", d.Name, d.Func)
+	}
+}
+
+// Type returns the type of the derived quantity.
+func (d *Derived) Type() Type {
+	switch d.Func {
+	case "dew-point":
+		return Temperature
+	case "absolute-humidity":
+		return AbsHumidity
+	default:
+		return d.Inputs[0].Type
+	}
+}
+
+// Depends returns whether at least one of the inputs of the derived sensor
+// is present in data.
+func (d *Derived) Depends(data Sensors) bool {
+	for _, in := range d.Inputs {
+		if _, ok := data.Value(in.Name, in.Type); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Eval computes the derived quantity from the readings in data.
+func (d *Derived) Eval(data Sensors) (float64, error) {
+	xs := make([]float64, len(d.Inputs))
+	for i, in := range d.Inputs {
+		v, ok := data.Value(in.Name, in.Type)
+		if !ok {
+			return 0, fmt.Errorf("sensors: missing input %v for derived sensor %q", in, d.Name)
+		}
+		xs[i] = v
+	}
+
+	switch d.Func {
+	case "dew-point":
+		return dewPoint(xs[0], xs[1])
+	case "absolute-humidity":
+		return absHumidity(xs[0], xs[1])
+	case "average":
+		sum := 0.0
+		for _, x := range xs {
+			sum += x
+		}
+		return sum / float64(len(xs)), nil
+	case "difference":
+		return xs[0] - xs[1], nil
+	}
+	return 0, fmt.Errorf("sensors: invalid derived sensor type %q", d.Func)
+}
+
+// Magnus formula coefficients (Sonntag, 1990), valid for -45°C < T < 60°C.
+const (
+	magnusA = 17.62
+	magnusB = 243.12 // °C
+)
+
+// dewPoint returns the dew point (in °C) from the temperature t (in °C) and
+// the relative humidity rh (in %).
+func dewPoint(t, rh float64) (float64, error) {
+	if rh <= 0 {
+		return 0, fmt.Errorf("sensors: invalid relative humidity %v%% for dew point", rh)
+	}
+	g := math.Log(rh/100) + magnusA*t/(magnusB+t)
+	return magnusB * g / (magnusA - g), nil
+}
+
+// absHumidity returns the absolute humidity (in g/m³) from the temperature t
+// (in °C) and the relative humidity rh (in %).
+func absHumidity(t, rh float64) (float64, error) {
+	if rh < 0 {
+		return 0, fmt.Errorf("sensors: invalid relative humidity %v%% for absolute humidity", rh)
+	}
+	const (
+		psat0 = 6.112   // saturation vapour pressure at 0°C, in hPa
+		mw    = 18.015  // molar mass of water, in g/mol
+		r     = 8.31446 // gas constant, in J/(mol.K)
+	)
+	psat := psat0 * math.Exp(magnusA*t/(magnusB+t))
+	// 100 * psat [Pa] * rh/100 * mw / (r * T[K])
+	return psat * rh * mw / (r * (t + 273.15)), nil
+}
@@ -0,0 +1,106 @@
+// Copyright 2018 The solid-mon-rpi Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sensors
+
+import (
+	"encoding/xml"
+	"math"
+	"testing"
+)
+
+func TestDerived(t *testing.T) {
+	data := Sensors{
+		Sensors: []Data{
+			{Name: "hts", Type: Temperature, Value: 20},
+			{Name: "hts", Type: Humidity, Value: 50},
+			{Name: "t1", Type: Temperature, Value: 21},
+			{Name: "t2", Type: Temperature, Value: 24},
+		},
+	}
+
+	for _, tc := range []struct {
+		raw  string
+		typ  Type
+		want float64
+	}{
+		{
+			raw: `<derived name="dp" type="dew-point">
+				<input sensor="hts" type="temperature"/>
+				<input sensor="hts" type="humidity"/>
+			</derived>`,
+			typ:  Temperature,
+			want: 9.26,
+		},
+		{
+			raw: `<derived name="ah" type="absolute-humidity">
+				<input sensor="hts" type="temperature"/>
+				<input sensor="hts" type="humidity"/>
+			</derived>`,
+			typ:  AbsHumidity,
+			want: 8.62,
+		},
+		{
+			raw: `<derived name="avg" type="average">
+				<input sensor="hts" type="temperature"/>
+				<input sensor="t1" type="temperature"/>
+				<input sensor="t2" type="temperature"/>
+			</derived>`,
+			typ:  Temperature,
+			want: 65.0 / 3,
+		},
+		{
+			raw: `<derived name="diff" type="difference">
+				<input sensor="t2" type="temperature"/>
+				<input sensor="t1" type="temperature"/>
+			</derived>`,
+			typ:  Temperature,
+			want: 3,
+		},
+	} {
+		var d Derived
+		err := xml.Unmarshal([]byte(tc.raw), &d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Run(d.Name, func(t *testing.T) {
+			if got, want := d.Type(), tc.typ; got != want {
+				t.Fatalf("invalid type: got=%v, want=%v", got, want)
+			}
+			if !d.Depends(data) {
+				t.Fatalf("derived sensor should depend on data")
+			}
+			got, err := d.Eval(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if math.Abs(got-tc.want) > 1e-2 {
+				t.Fatalf("got=%v, want=%v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestDerivedInvalid(t *testing.T) {
+	for _, raw := range []string{
+		`<derived name="dp" type="dew-point"><input sensor="hts" type="temperature"/></derived>`,
+		`<derived name="dp" type="dew-point">
+			<input sensor="hts" type="humidity"/>
+			<input sensor="hts" type="temperature"/>
+		</derived>`,
+		`<derived name="avg" type="average"/>`,
+		`<derived name="avg" type="average">
+			<input sensor="hts" type="humidity"/>
+			<input sensor="hts" type="temperature"/>
+		</derived>`,
+		`<derived name="diff" type="difference"><input sensor="hts" type="humidity"/></derived>`,
+		`<derived name="foo" type="foo"><input sensor="hts" type="humidity"/></derived>`,
+	} {
+		var d Derived
+		err := xml.Unmarshal([]byte(raw), &d)
+		if err == nil {
+			t.Fatalf("expected an error for %s", raw)
+		}
+	}
+}
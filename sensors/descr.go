@@ -9,6 +9,7 @@ import (
 	"fmt"
 	"math"
 	"strconv"
+	"time"
 )
 
 type Descr interface {
@@ -17,27 +18,64 @@ type Descr interface {
 }
 
 type DescrBase struct {
-	Name    string
-	ChanID  int
-	Type    string
-	I2CAddr uint8
+	Name     string
+	ChanID   int
+	Type     string
+	I2CAddr  uint8
+	Interval time.Duration // polling interval (0: use the server default)
+	Calib    []Calibration // calibrations applied to raw values
 }
 
 func (d *DescrBase) isDescr()          {}
 func (d *DescrBase) Descr() *DescrBase { return d }
 
-func (d *DescrBase) UnmarshalXML(dec *xml.Decoder, start xml.StartElement) error {
-	var raw struct {
-		Name   string `xml:"name,attr"`
-		ChanID int    `xml:"channel,attr"`
-		Type   string `xml:"type,attr"`
-		Addr   string `xml:"i2c-addr,attr"`
+// Calibrate returns the calibrated value of a raw reading of type typ.
+// Calibrations specific to typ take precedence over the ones applying
+// to all quantities of the sensor.
+func (d *DescrBase) Calibrate(typ Type, v float64) float64 {
+	var calib *Calibration
+	for i := range d.Calib {
+		c := &d.Calib[i]
+		switch c.Type {
+		case typ:
+			return c.Apply(v)
+		case InvalidType:
+			calib = c
+		}
 	}
+	if calib == nil {
+		return v
+	}
+	return calib.Apply(v)
+}
+
+func (d *DescrBase) UnmarshalXML(dec *xml.Decoder, start xml.StartElement) error {
+	var raw rawDescr
 	err := dec.DecodeElement(&raw, &start)
 	if err != nil {
 		return err
 	}
 
+	return raw.decode(d)
+}
+
+// rawDescr holds the XML attributes common to all sensor descriptions.
+type rawDescr struct {
+	Name     string `xml:"name,attr"`
+	ChanID   int    `xml:"channel,attr"`
+	Type     string `xml:"type,attr"`
+	Addr     string `xml:"i2c-addr,attr"`
+	Interval string `xml:"interval,attr"`
+
+	// calibration applying to all quantities of the sensor.
+	Offset string     `xml:"offset,attr"`
+	Gain   string     `xml:"gain,attr"`
+	Poly   string     `xml:"poly,attr"`
+	LUT    string     `xml:"lut,attr"`
+	Calibs []rawCalib `xml:"calib"`
+}
+
+func (raw rawDescr) decode(d *DescrBase) error {
 	d.Name = raw.Name
 	d.ChanID = raw.ChanID
 	d.Type = raw.Type
@@ -52,6 +90,33 @@ func (d *DescrBase) UnmarshalXML(dec *xml.Decoder, start xml.StartElement) error
 		}
 		d.I2CAddr = uint8(v)
 	}
+	d.Interval = 0
+	if raw.Interval != "" {
+		v, err := time.ParseDuration(raw.Interval)
+		if err != nil {
+			return fmt.Errorf("sensors: invalid polling interval for %q: %w", raw.Name, err)
+		}
+		if v <= 0 {
+			return fmt.Errorf("sensors: invalid polling interval for %q (got=%v)", raw.Name, v)
+		}
+		d.Interval = v
+	}
+
+	d.Calib = nil
+	if rc := (rawCalib{Offset: raw.Offset, Gain: raw.Gain, Poly: raw.Poly, LUT: raw.LUT}); !rc.isZero() {
+		c, err := rc.decode()
+		if err != nil {
+			return fmt.Errorf("sensors: invalid calibration for %q: %w", raw.Name, err)
+		}
+		d.Calib = append(d.Calib, c)
+	}
+	for _, rc := range raw.Calibs {
+		c, err := rc.decode()
+		if err != nil {
+			return fmt.Errorf("sensors: invalid calibration for %q: %w", raw.Name, err)
+		}
+		d.Calib = append(d.Calib, c)
+	}
 
 	return nil
 }
@@ -68,31 +133,18 @@ func (d *DescrADC101x) Descr() *DescrBase { return &d.Base }
 
 func (d *DescrADC101x) UnmarshalXML(dec *xml.Decoder, start xml.StartElement) error {
 	var raw struct {
-		Name   string  `xml:"name,attr"`
-		ChanID int     `xml:"channel,attr"`
-		Type   string  `xml:"type,attr"`
-		Addr   string  `xml:"i2c-addr,attr"`
-		Vdd    float64 `xml:"vdd,attr"`
-		Frng   int     `xml:"full-range,attr"`
+		rawDescr
+		Vdd  float64 `xml:"vdd,attr"`
+		Frng int     `xml:"full-range,attr"`
 	}
 	err := dec.DecodeElement(&raw, &start)
 	if err != nil {
 		return err
 	}
 
-	d.Base.Name = raw.Name
-	d.Base.ChanID = raw.ChanID
-	d.Base.Type = raw.Type
-	d.Base.I2CAddr = 0
-	if raw.Addr != "" {
-		v, err := strconv.ParseUint(raw.Addr, 0, 64)
-		if err != nil {
-			return err
-		}
-		if v >= math.MaxUint8 {
-			return fmt.Errorf("sensors: address value overflows uint8 (got=%v)", v)
-		}
-		d.Base.I2CAddr = uint8(v)
+	err = raw.rawDescr.decode(&d.Base)
+	if err != nil {
+		return err
 	}
 	d.Vdd = raw.Vdd
 	if raw.Frng == 0 {
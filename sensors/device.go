@@ -0,0 +1,198 @@
+// Copyright 2018 The solid-mon-rpi Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sensors
+
+import (
+	"time"
+
+	"github.com/go-daq/smbus"
+	"github.com/go-daq/smbus/sensor/adc101x"
+	"github.com/go-daq/smbus/sensor/at30tse75x"
+)
+
+// Device reads a sensor, behind an I2C multiplexer.
+//
+// The handles of the sensor drivers are opened (and the chips configured)
+// on the first reading, and reused for the next ones.
+// They are re-opened after a failed reading, or when read from a new bus
+// connection.
+type Device struct {
+	descr Descr
+	conn  *smbus.Conn // connection the driver handles were opened with
+	init  bool        // whether the driver handles are opened
+	inits int64       // number of (re)initializations of the drivers
+	xfers int64       // number of SMBus transactions issued (estimated)
+
+	// sample reads the sensor through its driver handles, opening the
+	// missing ones.
+	sample func(bus *smbus.Conn, addr uint8) (Sensors, error)
+
+	adc  ADC101x
+	at30 At30tse75x
+	hts  Hts221
+	bme  Bme280
+	tsl  Tsl2591
+}
+
+// NewDevice creates the device of the sensor described by descr.
+func NewDevice(descr Descr) *Device {
+	dev := &Device{descr: descr}
+	dev.sample = dev.read
+	return dev
+}
+
+// Descr returns the description of the sensor.
+func (dev *Device) Descr() Descr { return dev.descr }
+
+// Name returns the name of the sensor.
+func (dev *Device) Name() string { return dev.descr.Descr().Name }
+
+// Reset drops the driver handles of the device: they are re-opened on
+// the next reading.
+func (dev *Device) Reset() {
+	dev.conn = nil
+	dev.init = false
+	dev.adc.dev = nil
+	dev.at30.dev = nil
+	dev.hts.dev = nil
+	dev.bme.dev = nil
+	dev.tsl.dev = nil
+}
+
+// Read reads the sensor, behind the I2C multiplexer at address addr.
+// Calibrations attached to the sensor description are applied to the raw
+// values.
+func (dev *Device) Read(bus *smbus.Conn, addr uint8) (Sensors, error) {
+	if dev.conn != bus {
+		dev.Reset()
+		dev.conn = bus
+	}
+	if !dev.init {
+		dev.inits++
+	}
+	data, err := dev.sample(bus, addr)
+	if err != nil {
+		dev.Reset()
+		return data, err
+	}
+	dev.init = true
+	return data, nil
+}
+
+// Inits returns the number of readings which (re)opened the driver handles
+// of the device, and thus (re)configured the chips.
+func (dev *Device) Inits() int64 { return dev.inits }
+
+// Transactions returns the number of SMBus transactions issued to read the
+// device: selections of the multiplexer channel, and the transactions of
+// the drivers, estimated from the number of transactions they issue to
+// successfully open and sample the chip.
+func (dev *Device) Transactions() int64 { return dev.xfers }
+
+func (dev *Device) read(bus *smbus.Conn, addr uint8) (Sensors, error) {
+	data := Sensors{
+		Timestamp: time.Now().UTC(),
+		Labels:    make(map[string][]Type, 1),
+	}
+	switch d := dev.descr.(type) {
+	case *DescrADC101x:
+		device := &dev.adc
+		if d.Base.I2CAddr == 0 {
+			d.Base.I2CAddr = adc101x.DefaultI2CAddr
+		}
+		err := device.read(bus, d.Base.I2CAddr, addr, mux[d.Base.ChanID], 1024, 3.3, &dev.xfers)
+		if err != nil {
+			return data, err
+		}
+		data.Sensors = append(data.Sensors, Data{
+			Name:  d.Descr().Name,
+			Type:  Voltage,
+			Value: device.Voltage,
+		})
+		data.Labels[d.Descr().Name] = []Type{Voltage}
+
+	case *DescrAT30TSE:
+		device := &dev.at30
+		if d.I2CAddr == 0 {
+			d.I2CAddr = at30tse75x.DefaultI2CAddr
+		}
+		err := device.read(bus, d.I2CAddr, addr, mux[d.ChanID], &dev.xfers)
+		if err != nil {
+			return data, err
+		}
+		data.Sensors = append(data.Sensors, Data{
+			Name:  d.Name,
+			Type:  Temperature,
+			Value: device.Temp,
+		})
+		data.Labels[d.Name] = []Type{Temperature}
+
+	case *DescrHTS221:
+		device := &dev.hts
+		err := device.read(bus, addr, mux[d.ChanID], &dev.xfers)
+		if err != nil {
+			return data, err
+		}
+		data.Sensors = append(data.Sensors, Data{
+			Name:  d.Name,
+			Type:  Humidity,
+			Value: device.Humi,
+		})
+		data.Sensors = append(data.Sensors, Data{
+			Name:  d.Name,
+			Type:  Temperature,
+			Value: device.Temp,
+		})
+		data.Labels[d.Name] = []Type{Humidity, Temperature}
+
+	case *DescrBME280:
+		device := &dev.bme
+		err := device.read(bus, d.I2CAddr, addr, mux[d.ChanID], &dev.xfers)
+		if err != nil {
+			return data, err
+		}
+		data.Sensors = append(data.Sensors, Data{
+			Name:  d.Name,
+			Type:  Pressure,
+			Value: device.Pres,
+		})
+		data.Labels[d.Name] = append(data.Labels[d.Name], Pressure)
+
+	case *DescrOnBoard:
+		{
+			device := &dev.bme
+			err := device.read(bus, d.I2CAddr, addr, mux[d.ChanID], &dev.xfers)
+			if err != nil {
+				return data, err
+			}
+			data.Sensors = append(data.Sensors, Data{
+				Name:  d.Name,
+				Type:  Pressure,
+				Value: device.Pres,
+			})
+			data.Labels[d.Name] = append(data.Labels[d.Name], Pressure)
+		}
+		{
+			device := &dev.tsl
+			err := device.read(bus, addr, mux[d.ChanID], &dev.xfers)
+			if err != nil {
+				return data, err
+			}
+			data.Sensors = append(data.Sensors, Data{
+				Name:  d.Name,
+				Type:  Luminosity,
+				Value: device.Lux,
+			})
+			data.Labels[d.Name] = append(data.Labels[d.Name], Luminosity)
+		}
+	}
+
+	base := dev.descr.Descr()
+	for i := range data.Sensors {
+		v := &data.Sensors[i]
+		v.Value = base.Calibrate(v.Type, v.Value)
+	}
+	return data, nil
+}
@@ -0,0 +1,112 @@
+// Copyright 2018 The solid-mon-rpi Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sensors
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-daq/smbus"
+	"github.com/go-daq/smbus/sensor/at30tse75x"
+	"github.com/go-daq/smbus/sensor/bme280"
+	"github.com/go-daq/smbus/sensor/tsl2591"
+)
+
+func TestDevice(t *testing.T) {
+	dev := NewDevice(&DescrOnBoard{DescrBase: DescrBase{Name: "board", ChanID: 3}})
+	if got, want := dev.Name(), "board"; got != want {
+		t.Fatalf("invalid name: got=%q, want=%q", got, want)
+	}
+
+	// simulate handles opened by a previous reading.
+	conn := new(smbus.Conn) // not connected to any bus: all transactions fail.
+	dev.conn = conn
+	dev.bme.dev = new(bme280.Device)
+	dev.tsl.dev = new(tsl2591.Device)
+
+	dev.init = true
+	_, err := dev.Read(conn, 0x70)
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	if dev.bme.dev != nil || dev.tsl.dev != nil || dev.conn != nil {
+		t.Fatalf("driver handles not reset after error")
+	}
+	if got, want := dev.Inits(), int64(0); got != want {
+		t.Fatalf("invalid number of initializations: got=%d, want=%d", got, want)
+	}
+
+	// each reading after a failure re-initializes the drivers.
+	for i := 1; i <= 2; i++ {
+		_, err = dev.Read(conn, 0x70)
+		if err == nil {
+			t.Fatalf("expected an error")
+		}
+		if got, want := dev.Inits(), int64(i); got != want {
+			t.Fatalf("invalid number of initializations: got=%d, want=%d", got, want)
+		}
+	}
+
+	// only the selections of the multiplexer channel were issued.
+	if got, want := dev.Transactions(), int64(3); got != want {
+		t.Fatalf("invalid number of transactions: got=%d, want=%d", got, want)
+	}
+
+	dev = NewDevice(&DescrAT30TSE{DescrBase: DescrBase{Name: "temp"}})
+	dev.conn = conn
+	dev.at30.dev = new(at30tse75x.Device)
+	dev.Reset()
+	if dev.at30.dev != nil || dev.conn != nil {
+		t.Fatalf("driver handles not reset")
+	}
+}
+
+func TestDeviceReuse(t *testing.T) {
+	dev := NewDevice(&DescrAT30TSE{DescrBase: DescrBase{Name: "temp"}})
+	opened := 0
+	dev.sample = func(bus *smbus.Conn, addr uint8) (Sensors, error) {
+		// as the drivers do, only open the missing handles.
+		if dev.at30.dev == nil {
+			dev.at30.dev = new(at30tse75x.Device)
+			opened++
+		}
+		return Sensors{
+			Timestamp: time.Now().UTC(),
+			Sensors:   []Data{{Name: "temp", Type: Temperature, Value: 20}},
+		}, nil
+	}
+
+	conn := new(smbus.Conn)
+	read := func(conn *smbus.Conn) *at30tse75x.Device {
+		t.Helper()
+		_, err := dev.Read(conn, 0x70)
+		if err != nil {
+			t.Fatalf("could not read device: %+v", err)
+		}
+		if dev.at30.dev == nil {
+			t.Fatalf("driver handle not opened")
+		}
+		return dev.at30.dev
+	}
+
+	// successful readings share the driver handle.
+	h1 := read(conn)
+	h2 := read(conn)
+	if h1 != h2 {
+		t.Fatalf("driver handle not reused across readings")
+	}
+	if opened != 1 || dev.Inits() != 1 {
+		t.Fatalf("invalid number of initializations: opened=%d, inits=%d", opened, dev.Inits())
+	}
+
+	// a new bus connection drops the driver handle.
+	h3 := read(new(smbus.Conn))
+	if h3 == h1 {
+		t.Fatalf("driver handle reused across bus connections")
+	}
+	if opened != 2 || dev.Inits() != 2 {
+		t.Fatalf("invalid number of initializations: opened=%d, inits=%d", opened, dev.Inits())
+	}
+}
@@ -6,11 +6,10 @@
 package sensors
 
 import (
-	"bytes"
 	"encoding/json"
-	"fmt"
 	"log"
 	"math"
+	"sort"
 	"time"
 
 	"github.com/go-daq/smbus"
@@ -28,49 +27,87 @@ type Sensors struct {
 	Labels    map[string][]Type `json:"labels"`
 }
 
-type Data struct {
-	Name  string  `json:"name"`
-	Type  Type    `json:"type"`
-	Value float64 `json:"value"`
+// Update updates the sensors with the values of the sensors from o.
+// Sensors not present in o retain their previous value.
+func (s *Sensors) Update(o Sensors) {
+	if s.Labels == nil {
+		s.Labels = make(map[string][]Type, len(o.Labels))
+	}
+	s.Timestamp = o.Timestamp
+	for _, v := range o.Sensors {
+		i := s.index(v.Name, v.Type)
+		if i < 0 {
+			s.Sensors = append(s.Sensors, v)
+			s.Labels[v.Name] = append(s.Labels[v.Name], v.Type)
+			continue
+		}
+		s.Sensors[i] = v
+	}
 }
 
-// Type describes the type of data sensor (H,P,T,L,V)
-type Type uint8
+// Clone returns a deep copy of the sensors.
+func (s Sensors) Clone() Sensors {
+	o := Sensors{
+		Timestamp: s.Timestamp,
+		Sensors:   make([]Data, len(s.Sensors)),
+		Labels:    make(map[string][]Type, len(s.Labels)),
+	}
+	copy(o.Sensors, s.Sensors)
+	for k, v := range s.Labels {
+		o.Labels[k] = append([]Type(nil), v...)
+	}
+	return o
+}
 
-const (
-	InvalidType Type = iota
-	Humidity
-	Pressure
-	Temperature
-	Luminosity
-	Voltage
-)
+// Value returns the value of the named sensor for the given type, and
+// whether that sensor is present.
+func (s Sensors) Value(name string, typ Type) (float64, bool) {
+	i := s.index(name, typ)
+	if i < 0 {
+		return 0, false
+	}
+	return s.Sensors[i].Value, true
+}
 
-func (t Type) String() string {
-	switch t {
-	case InvalidType:
-		return "invalid"
-	case Humidity:
-		return "humidity"
-	case Pressure:
-		return "pressure"
-	case Temperature:
-		return "temperature"
-	case Luminosity:
-		return "luminosity"
-	case Voltage:
-		return "voltage"
-	}
-	panic(fmt.Errorf("unknown sensor type %d", t))
+func (s *Sensors) index(name string, typ Type) int {
+	for i, v := range s.Sensors {
+		if v.Name == name && v.Type == typ {
+			return i
+		}
+	}
+	return -1
 }
 
-func (t Type) MarshalJSON() ([]byte, error) {
-	buf := new(bytes.Buffer)
-	err := json.NewEncoder(buf).Encode(t.String())
-	if err != nil {
-		return nil, err
+// MarshalJSON encodes the sensors data together with the description of
+// the types of the quantities they measure.
+func (s Sensors) MarshalJSON() ([]byte, error) {
+	type sensors Sensors // prevent recursion
+	raw := struct {
+		sensors
+		Types map[string]TypeInfo `json:"types"`
+	}{
+		sensors: sensors(s),
+		Types:   make(map[string]TypeInfo),
 	}
-	return buf.Bytes(), nil
+	for _, v := range s.Sensors {
+		raw.Types[v.Type.String()] = v.Type.Info()
+	}
+	return json.Marshal(raw)
+}
+
+type Data struct {
+	Name  string  `json:"name"`
+	Type  Type    `json:"type"`
+	Value float64 `json:"value"`
+}
+
+// MarshalJSON encodes the sensor data together with its unit.
+func (d Data) MarshalJSON() ([]byte, error) {
+	type data Data // prevent recursion
+	return json.Marshal(struct {
+		data
+		Unit string `json:"unit"`
+	}{data(d), d.Type.Unit()})
 }
 
 // mux maps an I2C channel id to an action register
@@ -85,134 +122,101 @@ var mux = [...]uint8{
 	7: 0x80,
 }
 
+// Types returns the types of the quantities measured by a sensor.
+func Types(descr Descr) []Type {
+	switch descr.(type) {
+	case *DescrADC101x:
+		return []Type{Voltage}
+	case *DescrAT30TSE:
+		return []Type{Temperature}
+	case *DescrHTS221:
+		return []Type{Humidity, Temperature}
+	case *DescrBME280:
+		return []Type{Pressure}
+	case *DescrOnBoard:
+		return []Type{Pressure, Luminosity}
+	}
+	return nil
+}
+
+// New reads the sensors described by descr, behind the I2C multiplexer at
+// address addr.
+// Calibrations attached to the sensor descriptions are applied to the raw
+// values.
+//
+// Device drivers are opened for this reading only: use Device to read
+// sensors repeatedly.
 func New(bus *smbus.Conn, addr uint8, descr []Descr) (Sensors, error) {
 	data := Sensors{
 		Timestamp: time.Now().UTC(),
 		Labels:    make(map[string][]Type, len(descr)),
 	}
 	for _, d := range descr {
-		switch d := d.(type) {
-		case *DescrADC101x:
-			device := ADC101x{}
-			if d.Base.I2CAddr == 0 {
-				d.Base.I2CAddr = adc101x.DefaultI2CAddr
-			}
-			err := device.read(bus, d.Base.I2CAddr, addr, mux[d.Base.ChanID], 1024, 3.3)
-			if err != nil {
-				return data, err
-			}
-			data.Sensors = append(data.Sensors, Data{
-				Name:  d.Descr().Name,
-				Type:  Voltage,
-				Value: device.Voltage,
-			})
-			data.Labels[d.Descr().Name] = []Type{Voltage}
-
-		case *DescrAT30TSE:
-			device := At30tse75x{}
-			if d.I2CAddr == 0 {
-				d.I2CAddr = at30tse75x.DefaultI2CAddr
-			}
-			err := device.read(bus, d.I2CAddr, addr, mux[d.ChanID])
-			if err != nil {
-				return data, err
-			}
-			data.Sensors = append(data.Sensors, Data{
-				Name:  d.Name,
-				Type:  Temperature,
-				Value: device.Temp,
-			})
-			data.Labels[d.Name] = []Type{Temperature}
-
-		case *DescrHTS221:
-			device := Hts221{}
-			err := device.read(bus, addr, mux[d.ChanID])
-			if err != nil {
-				return data, err
-			}
-			data.Sensors = append(data.Sensors, Data{
-				Name:  d.Name,
-				Type:  Humidity,
-				Value: device.Humi,
-			})
-			data.Sensors = append(data.Sensors, Data{
-				Name:  d.Name,
-				Type:  Temperature,
-				Value: device.Temp,
-			})
-			data.Labels[d.Name] = []Type{Humidity, Temperature}
-
-		case *DescrBME280:
-			device := Bme280{}
-			err := device.read(bus, d.I2CAddr, addr, mux[d.ChanID])
-			if err != nil {
-				return data, err
-			}
-			data.Sensors = append(data.Sensors, Data{
-				Name:  d.Name,
-				Type:  Pressure,
-				Value: device.Pres,
-			})
-			data.Labels[d.Name] = append(data.Labels[d.Name], Pressure)
-
-		case *DescrOnBoard:
-			{
-				device := Bme280{}
-				err := device.read(bus, d.I2CAddr, addr, mux[d.ChanID])
-				if err != nil {
-					return data, err
-				}
-				data.Sensors = append(data.Sensors, Data{
-					Name:  d.Name,
-					Type:  Pressure,
-					Value: device.Pres,
-				})
-				data.Labels[d.Name] = append(data.Labels[d.Name], Pressure)
-			}
-			{
-				device := Tsl2591{}
-				err := device.read(bus, addr, mux[d.ChanID])
-				if err != nil {
-					return data, err
-				}
-				data.Sensors = append(data.Sensors, Data{
-					Name:  d.Name,
-					Type:  Luminosity,
-					Value: device.Lux,
-				})
-				data.Labels[d.Name] = append(data.Labels[d.Name], Luminosity)
-			}
+		v, err := NewDevice(d).Read(bus, addr)
+		data.Sensors = append(data.Sensors, v.Sensors...)
+		for k, types := range v.Labels {
+			data.Labels[k] = append(data.Labels[k], types...)
+		}
+		if err != nil {
+			return data, err
 		}
 	}
 	return data, nil
 }
 
+// Number of SMBus transactions issued by the device drivers to open a
+// device (chip configuration and calibration readout) and to sample it.
+// Selecting the channel of the multiplexer takes one more transaction.
+// As the drivers do not report the transactions they issue, these are only
+// counted once the operation succeeded: the number of transactions issued
+// before a driver failure is unknown.
+const (
+	adc101xOpenTx      = 1
+	adc101xSampleTx    = 2 // ADC count, then voltage
+	at30tse75xOpenTx   = 1
+	at30tse75xSampleTx = 1
+	bme280OpenTx       = 5
+	bme280SampleTx     = 10
+	hts221OpenTx       = 15
+	hts221SampleTx     = 6
+	tsl2591OpenTx      = 7
+	tsl2591SampleTx    = 4
+)
+
 type Tsl2591 struct {
 	Lux  float64 `json:"lux"`
 	Full uint16  `json:"full"`
 	IR   uint16  `json:"ir"`
+
+	dev *tsl2591.Device
 }
 
-func (tsl *Tsl2591) read(bus *smbus.Conn, addr uint8, ch uint8) error {
+func (tsl *Tsl2591) read(bus *smbus.Conn, addr uint8, ch uint8, tx *int64) error {
+	*tx++
 	err := bus.WriteReg(addr, 0x04, ch)
 	if err != nil {
 		log.Printf("tsl-write-reg error: %v", err)
 		return err
 	}
 
-	dev, err := tsl2591.Open(bus, tsl2591.Addr, tsl2591.IntegTime100ms, tsl2591.GainLow)
-	if err != nil {
-		log.Printf("tsl-open-bus error: %v", err)
-		return err
+	if tsl.dev == nil {
+		dev, err := tsl2591.Open(bus, tsl2591.Addr, tsl2591.IntegTime100ms, tsl2591.GainLow)
+		if err != nil {
+			log.Printf("tsl-open-bus error: %v", err)
+			return err
+		}
+		*tx += tsl2591OpenTx
+		tsl.dev = dev
 	}
 
-	full, ir, err := dev.FullLuminosity()
+	full, ir, err := tsl.dev.FullLuminosity()
 	if err != nil {
 		log.Printf("tsl-sample error: %v", err)
 		return err
 	}
+	*tx += tsl2591SampleTx
 
-	tsl.Lux = dev.Lux(full, ir)
+	tsl.Lux = tsl.dev.Lux(full, ir)
 	tsl.Full = full
 	tsl.IR = ir
 
@@ -223,29 +227,37 @@ type Bme280 struct {
 	Temp float64 `json:"temp"`
 	Hum  float64 `json:"humi"`
 	Pres float64 `json:"pres"`
+
+	dev *bme280.Device
 }
 
-func (bme *Bme280) read(bus *smbus.Conn, i2c, addr uint8, ch uint8) error {
+func (bme *Bme280) read(bus *smbus.Conn, i2c, addr uint8, ch uint8, tx *int64) error {
+	*tx++
 	err := bus.WriteReg(addr, 0x04, ch)
 	if err != nil {
 		log.Printf("write-reg error: %v", err)
 		return err
 	}
 
-	if i2c == 0 {
-		i2c = bme280.I2CAddr
-	}
-	dev, err := bme280.Open(bus, i2c, bme280.OpSample8)
-	if err != nil {
-		log.Printf("open-bus error (i2c-addr=0x%x): %v", i2c, err)
-		return err
+	if bme.dev == nil {
+		if i2c == 0 {
+			i2c = bme280.I2CAddr
+		}
+		dev, err := bme280.Open(bus, i2c, bme280.OpSample8)
+		if err != nil {
+			log.Printf("open-bus error (i2c-addr=0x%x): %v", i2c, err)
+			return err
+		}
+		*tx += bme280OpenTx
+		bme.dev = dev
 	}
 
-	h, p, t, err := dev.Sample()
+	h, p, t, err := bme.dev.Sample()
 	if err != nil {
 		log.Printf("sample error: %v", err)
 		return err
 	}
+	*tx += bme280SampleTx
 
 	const HPa = 1.0 / 100.0
 	bme.Hum = h
@@ -258,30 +270,38 @@ func (bme *Bme280) read(bus *smbus.Conn, i2c, addr uint8, ch uint8) error {
 type ADC101x struct {
 	Count   int     `json:"adc"`
 	Voltage float64 `json:"voltage"`
+
+	dev *adc101x.Device
 }
 
-func (adc *ADC101x) read(bus *smbus.Conn, i2c, daddr uint8, ch uint8, frange int, vdd float64) error {
+func (adc *ADC101x) read(bus *smbus.Conn, i2c, daddr uint8, ch uint8, frange int, vdd float64, tx *int64) error {
+	*tx++
 	err := bus.WriteReg(daddr, 0x04, ch)
 	if err != nil {
 		log.Printf("adc101x-write-reg error: %v", err)
 		return err
 	}
 
-	dev, err := adc101x.Open(bus, i2c, frange, vdd)
-	if err != nil {
-		log.Printf("adc101x-open-bus error: %v", err)
-		return err
+	if adc.dev == nil {
+		dev, err := adc101x.Open(bus, i2c, frange, vdd)
+		if err != nil {
+			log.Printf("adc101x-open-bus error: %v", err)
+			return err
+		}
+		*tx += adc101xOpenTx
+		adc.dev = dev
 	}
 
-	count, err := dev.ADC()
+	count, err := adc.dev.ADC()
 	if err != nil {
 		return err
 	}
 
-	voltage, err := dev.Voltage()
+	voltage, err := adc.dev.Voltage()
 	if err != nil {
 		return err
 	}
+	*tx += adc101xSampleTx
 
 	adc.Count = count
 	adc.Voltage = voltage
@@ -290,31 +310,39 @@ func (adc *ADC101x) read(bus *smbus.Conn, i2c, daddr uint8, ch uint8, frange int
 
 type At30tse75x struct {
 	Temp float64 `json:"temp"`
+
+	dev *at30tse75x.Device
 }
 
-func (at30 *At30tse75x) read(bus *smbus.Conn, i2c, daddr uint8, ch uint8) error {
+func (at30 *At30tse75x) read(bus *smbus.Conn, i2c, daddr uint8, ch uint8, tx *int64) error {
+	*tx++
 	err := bus.WriteReg(daddr, 0x04, ch)
 	if err != nil {
 		log.Printf("at30tse-write-reg error: %v", err)
 		return err
 	}
 
-	dev, err := at30tse75x.Open(
-		bus,
-		at30tse75x.I2CAddr(i2c),
-		at30tse75x.DevAddr(daddr),
-		at30tse75x.EEPROM(4),
-	)
-	if err != nil {
-		log.Printf("at30tse-open-bus error: %v", err)
-		return err
+	if at30.dev == nil {
+		dev, err := at30tse75x.Open(
+			bus,
+			at30tse75x.I2CAddr(i2c),
+			at30tse75x.DevAddr(daddr),
+			at30tse75x.EEPROM(4),
+		)
+		if err != nil {
+			log.Printf("at30tse-open-bus error: %v", err)
+			return err
+		}
+		*tx += at30tse75xOpenTx
+		at30.dev = dev
 	}
 
-	t, err := dev.T()
+	t, err := at30.dev.T()
 	if err != nil {
 		log.Printf("at30tse-sample error: %v", err)
 		return err
 	}
+	*tx += at30tse75xSampleTx
 	at30.Temp = t
 	return nil
 }
@@ -322,26 +350,34 @@ func (at30 *At30tse75x) read(bus *smbus.Conn, i2c, daddr uint8, ch uint8) error
 type Hts221 struct {
 	Temp float64 `json:"temp"`
 	Humi float64 `json:"humi"`
+
+	dev *hts221.Device
 }
 
-func (hts *Hts221) read(bus *smbus.Conn, addr uint8, ch uint8) error {
+func (hts *Hts221) read(bus *smbus.Conn, addr uint8, ch uint8, tx *int64) error {
+	*tx++
 	err := bus.WriteReg(addr, 0x04, ch)
 	if err != nil {
 		log.Printf("hts221-write-reg error: %v", err)
 		return err
 	}
 
-	dev, err := hts221.Open(bus, hts221.SlaveAddr)
-	if err != nil {
-		log.Printf("hts221-open-bus error: %v", err)
-		return err
+	if hts.dev == nil {
+		dev, err := hts221.Open(bus, hts221.SlaveAddr)
+		if err != nil {
+			log.Printf("hts221-open-bus error: %v", err)
+			return err
+		}
+		*tx += hts221OpenTx
+		hts.dev = dev
 	}
 
-	h, t, err := dev.Sample()
+	h, t, err := hts.dev.Sample()
 	if err != nil {
 		log.Printf("hts221-sample error: %v", err)
 		return err
 	}
+	*tx += hts221SampleTx
 	hts.Temp = t
 	hts.Humi = h
 	return nil
@@ -349,17 +385,32 @@ func (hts *Hts221) read(bus *smbus.Conn, addr uint8, ch uint8) error {
 
 type Table []Sensors
 
+// Len returns the number of snapshots in the table.
+func (tbl Table) Len() int { return len(tbl) }
+
+// Span returns the time interval covered by the table.
+func (tbl Table) Span() (beg, end time.Time) {
+	if len(tbl) == 0 {
+		return beg, end
+	}
+	return tbl[0].Timestamp, tbl[len(tbl)-1].Timestamp
+}
+
+// Data returns the time series of the sensor label for the given type.
+// Snapshots where that sensor was not sampled are skipped.
 func (tbl Table) Data(typ Type, label string) (float64, float64, plotter.XYs) {
 	min := +math.MaxFloat64
 	max := -math.MaxFloat64
-	data := make(plotter.XYs, len(tbl))
-	for i, v := range tbl {
+	data := make(plotter.XYs, 0, len(tbl))
+	for _, v := range tbl {
 		for _, sensor := range v.Sensors {
 			if sensor.Type != typ || sensor.Name != label {
 				continue
 			}
-			data[i].X = float64(v.Timestamp.UTC().Unix())
-			data[i].Y = sensor.Value
+			data = append(data, plotter.XY{
+				X: float64(v.Timestamp.UnixNano()) * 1e-9,
+				Y: sensor.Value,
+			})
 			min = math.Min(min, sensor.Value)
 			max = math.Max(max, sensor.Value)
 		}
@@ -367,14 +418,92 @@ func (tbl Table) Data(typ Type, label string) (float64, float64, plotter.XYs) {
 	return min, max, data
 }
 
+// Segments returns the time series of the sensor label for the given type,
+// split into contiguous segments.
+// A new segment starts whenever the time between two consecutive samples
+// exceeds gapFactor times the typical (median) sampling period of that
+// sensor, e.g. when the sensor failed or was removed for a while.
+func (tbl Table) Segments(typ Type, label string) (float64, float64, []plotter.XYs) {
+	min, max, data := tbl.Data(typ, label)
+	if len(data) < 3 {
+		return min, max, []plotter.XYs{data}
+	}
+	return min, max, SplitGaps(data, Gap(data))
+}
+
+// gapFactor is the number of typical sampling periods without any sample
+// after which a time series is considered interrupted.
+const gapFactor = 2.5
+
+// Gap returns the distance between two consecutive X values of data above
+// which the time series is considered interrupted: gapFactor times the
+// median distance between consecutive values.
+// Gap returns 0 when data holds less than two values.
+func Gap(data plotter.XYs) float64 {
+	if len(data) < 2 {
+		return 0
+	}
+	dts := make([]float64, len(data)-1)
+	for i := range dts {
+		dts[i] = data[i+1].X - data[i].X
+	}
+	sort.Float64s(dts)
+	return gapFactor * dts[len(dts)/2]
+}
+
+// SplitGaps splits data into segments wherever the distance between two
+// consecutive X values exceeds gap.
+func SplitGaps(data plotter.XYs, gap float64) []plotter.XYs {
+	var (
+		segs []plotter.XYs
+		beg  = 0
+	)
+	for i := 1; i < len(data); i++ {
+		if data[i].X-data[i-1].X > gap {
+			segs = append(segs, data[beg:i])
+			beg = i
+		}
+	}
+	return append(segs, data[beg:])
+}
+
+// Labels returns the names of all the sensors of the given type
+// present in the table.
 func (tbl Table) Labels(typ Type) []string {
-	var labels []string
-	for k, v := range tbl[0].Labels {
-		for _, t := range v {
-			if typ == t {
-				labels = append(labels, k)
+	var (
+		labels []string
+		set    = make(map[string]struct{})
+	)
+	for _, row := range tbl {
+		for k, v := range row.Labels {
+			if _, dup := set[k]; dup {
+				continue
+			}
+			for _, t := range v {
+				if typ == t {
+					labels = append(labels, k)
+					set[k] = struct{}{}
+					break
+				}
 			}
 		}
 	}
 	return labels
 }
+
+// Types returns the types of all the quantities present in the table.
+func (tbl Table) Types() []Type {
+	set := make(map[Type]bool)
+	for _, row := range tbl {
+		for _, v := range row.Sensors {
+			set[v.Type] = true
+		}
+	}
+	var types []Type
+	for _, t := range AllTypes() {
+		if set[t] {
+			types = append(types, t)
+		}
+	}
+	return types
+}
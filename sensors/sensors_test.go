@@ -0,0 +1,60 @@
+// Copyright 2018 The solid-mon-rpi Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sensors
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTableSegments(t *testing.T) {
+	t0 := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	var tbl Table
+	for i := 0; i < 20; i++ {
+		row := Sensors{
+			Timestamp: t0.Add(time.Duration(i) * time.Second),
+			Labels:    map[string][]Type{"t1": {Temperature}},
+			Sensors:   []Data{{Name: "t1", Type: Temperature, Value: float64(i)}},
+		}
+		switch {
+		case i == 3:
+			// a single missed sample does not break the line.
+			row.Sensors = nil
+		case i >= 8 && i < 12:
+			// t1 failed for a while.
+			row.Sensors = nil
+		case i >= 15:
+			// t2 was plugged in, t1 was unplugged.
+			row.Labels = map[string][]Type{"t2": {Temperature}}
+			row.Sensors = []Data{{Name: "t2", Type: Temperature, Value: float64(i)}}
+		}
+		tbl = append(tbl, row)
+	}
+
+	if got, want := tbl.Labels(Temperature), []string{"t1", "t2"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("invalid labels: got=%v, want=%v", got, want)
+	}
+
+	for _, tc := range []struct {
+		label string
+		lens  []int
+	}{
+		{"t1", []int{7, 3}},
+		{"t2", []int{5}},
+		{"t3", []int{0}},
+	} {
+		t.Run(tc.label, func(t *testing.T) {
+			_, _, segs := tbl.Segments(Temperature, tc.label)
+			lens := make([]int, len(segs))
+			for i, seg := range segs {
+				lens[i] = len(seg)
+			}
+			if !reflect.DeepEqual(lens, tc.lens) {
+				t.Fatalf("invalid segments: got=%v, want=%v", lens, tc.lens)
+			}
+		})
+	}
+}
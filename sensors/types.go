@@ -0,0 +1,125 @@
+// Copyright 2018 The solid-mon-rpi Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sensors
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Type describes the type of data sensor (H,P,T,L,V,AH)
+type Type uint8
+
+const (
+	InvalidType Type = iota
+	Humidity
+	Pressure
+	Temperature
+	Luminosity
+	Voltage
+	AbsHumidity
+)
+
+// TypeInfo describes the physical quantity measured by a sensor type.
+type TypeInfo struct {
+	Name      string  `json:"name"`
+	Unit      string  `json:"unit"`
+	Precision int     `json:"precision"` // number of decimals to display
+	Min       float64 `json:"min"`       // valid physical range
+	Max       float64 `json:"max"`
+}
+
+var typeInfos = [...]TypeInfo{
+	InvalidType: {Name: "invalid"},
+	Humidity:    {Name: "humidity", Unit: "%RH", Precision: 1, Min: 0, Max: 100},
+	Pressure:    {Name: "pressure", Unit: "hPa", Precision: 1, Min: 300, Max: 1100},
+	Temperature: {Name: "temperature", Unit: "°C", Precision: 2, Min: -55, Max: 125},
+	Luminosity:  {Name: "luminosity", Unit: "lux", Precision: 1, Min: 0, Max: 88000},
+	Voltage:     {Name: "voltage", Unit: "V", Precision: 3, Min: 0, Max: 5.5},
+	AbsHumidity: {Name: "abs-humidity", Unit: "g/m³", Precision: 2, Min: 0, Max: 200},
+}
+
+// AllTypes returns the list of all valid sensor types.
+func AllTypes() []Type {
+	types := make([]Type, 0, len(typeInfos)-1)
+	for i := range typeInfos[1:] {
+		types = append(types, Type(i+1))
+	}
+	return types
+}
+
+// Info returns the description of the quantity measured by a sensor type.
+func (t Type) Info() TypeInfo {
+	if int(t) >= len(typeInfos) {
+		panic(fmt.Errorf("unknown sensor type %d", t))
+	}
+	return typeInfos[t]
+}
+
+func (t Type) String() string {
+	return t.Info().Name
+}
+
+// Title returns the name of the type, with its first letter upper-cased.
+func (t Type) Title() string {
+	name := t.String()
+	r, n := utf8.DecodeRuneInString(name)
+	return string(unicode.ToUpper(r)) + name[n:]
+}
+
+// Unit returns the unit in which values of that type are expressed.
+func (t Type) Unit() string {
+	return t.Info().Unit
+}
+
+// Format formats the value v with the display precision of the type,
+// followed by its unit.
+func (t Type) Format(v float64) string {
+	info := t.Info()
+	return fmt.Sprintf("%.*f %s", info.Precision, v, info.Unit)
+}
+
+// Valid returns whether v lies within the valid physical range of the type.
+func (t Type) Valid(v float64) bool {
+	info := t.Info()
+	return info.Min <= v && v <= info.Max
+}
+
+// ParseType returns the sensor type named s.
+func ParseType(s string) (Type, error) {
+	for _, t := range AllTypes() {
+		if strings.EqualFold(s, t.String()) {
+			return t, nil
+		}
+	}
+	return InvalidType, fmt.Errorf("sensors: invalid sensor type %q", s)
+}
+
+func (t Type) MarshalJSON() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	err := json.NewEncoder(buf).Encode(t.String())
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (t *Type) UnmarshalJSON(p []byte) error {
+	var name string
+	err := json.Unmarshal(p, &name)
+	if err != nil {
+		return err
+	}
+	v, err := ParseType(name)
+	if err != nil {
+		return err
+	}
+	*t = v
+	return nil
+}
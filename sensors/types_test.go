@@ -0,0 +1,72 @@
+// Copyright 2018 The solid-mon-rpi Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sensors
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSensorsJSON(t *testing.T) {
+	want := Sensors{
+		Timestamp: time.Date(2018, 1, 2, 3, 4, 5, 6, time.UTC),
+		Sensors: []Data{
+			{Name: "hts", Type: Humidity, Value: 41.5},
+			{Name: "hts", Type: Temperature, Value: 31.2},
+			{Name: "onboard", Type: Pressure, Value: 968.4},
+		},
+		Labels: map[string][]Type{
+			"hts":     {Humidity, Temperature},
+			"onboard": {Pressure},
+		},
+	}
+
+	raw, err := json.Marshal(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, v := range []string{
+		`"type":"temperature","value":31.2,"unit":"°C"`,
+		`"pressure":{"name":"pressure","unit":"hPa","precision":1,"min":300,"max":1100}`,
+	} {
+		if !strings.Contains(string(raw), v) {
+			t.Fatalf("missing %s in JSON payload:\n%s", v, raw)
+		}
+	}
+
+	var got Sensors
+	err = json.Unmarshal(raw, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("round-trip failed:\ngot= %+v\nwant=%+v", got, want)
+	}
+
+	var typ Type
+	err = json.Unmarshal([]byte(`"foo"`), &typ)
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+}
+
+func TestTypeTitle(t *testing.T) {
+	for _, tc := range []struct {
+		typ  Type
+		want string
+	}{
+		{Temperature, "Temperature"},
+		{AbsHumidity, "Abs-humidity"},
+	} {
+		if got := tc.typ.Title(); got != tc.want {
+			t.Fatalf("invalid title for %v: got=%q, want=%q", tc.typ, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,257 @@
+// Copyright 2018 The solid-mon-rpi Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"image/color"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/sbinet-solid/solid-mon-rpi/sensors"
+	"go-hep.org/x/hep/hbook"
+	"go-hep.org/x/hep/hplot"
+	gstat "gonum.org/v1/gonum/stat"
+	"gonum.org/v1/plot/plotter"
+	"gonum.org/v1/plot/vg"
+	"gonum.org/v1/plot/vg/draw"
+	"gonum.org/v1/plot/vg/vgsvg"
+)
+
+// statsBins is the number of bins of the value distribution histograms.
+const statsBins = 50
+
+// statsQuantiles are the percentiles reported for each quantity.
+var statsQuantiles = []float64{0.05, 0.25, 0.50, 0.75, 0.95}
+
+// sensorStats holds the summary statistics of a quantity measured by a
+// sensor over a time window.
+type sensorStats struct {
+	Name        string       `json:"name"`
+	Type        sensors.Type `json:"type"`
+	Unit        string       `json:"unit"`
+	Entries     int64        `json:"entries"`
+	Mean        float64      `json:"mean"`
+	RMS         float64      `json:"rms"`
+	StdDev      float64      `json:"stddev"`
+	Min         float64      `json:"min"`
+	Max         float64      `json:"max"`
+	Percentiles []percentile `json:"percentiles"`
+
+	hist  *hbook.H1D  // distribution of the values
+	color color.Color // color of the sensor in the plots
+}
+
+type percentile struct {
+	P     float64 `json:"p"` // in %
+	Value float64 `json:"value"`
+}
+
+// samples accumulates the (weighted) values of a quantity.
+type samples struct {
+	xs, ws   []float64
+	min, max float64
+}
+
+func (s *samples) add(x, w, min, max float64) {
+	if len(s.xs) == 0 {
+		s.min = min
+		s.max = max
+	}
+	s.xs = append(s.xs, x)
+	s.ws = append(s.ws, w)
+	s.min = math.Min(s.min, min)
+	s.max = math.Max(s.max, max)
+}
+
+func (s *samples) Len() int           { return len(s.xs) }
+func (s *samples) Less(i, j int) bool { return s.xs[i] < s.xs[j] }
+func (s *samples) Swap(i, j int) {
+	s.xs[i], s.xs[j] = s.xs[j], s.xs[i]
+	s.ws[i], s.ws[j] = s.ws[j], s.ws[i]
+}
+
+// stats computes the statistics of all the quantities within the selection,
+// and returns them together with a description of the data source.
+//
+// Short time windows are served from the raw samples of the fast table.
+// Longer ones are served from the finest trend covering the time window,
+// where each bucket contributes its mean value, weighted by its number of
+// samples: the mean is exact, the spread and percentiles are those of the
+// bucket means.
+func (hist history) stats(sel selection) (string, []sensorStats) {
+	set := make(map[sensors.Input]*samples)
+	get := func(in sensors.Input) *samples {
+		s := set[in]
+		if s == nil {
+			s = new(samples)
+			set[in] = s
+		}
+		return s
+	}
+
+	var src string
+	switch i := hist.source(sel); i {
+	case -1:
+		src = "raw samples"
+		for _, row := range sel.table(hist.fast) {
+			for _, v := range row.Sensors {
+				get(sensors.Input{Name: v.Name, Type: v.Type}).add(v.Value, 1, v.Value, v.Value)
+			}
+		}
+	default:
+		tbl := sel.trend(hist.trends[i])
+		src = fmt.Sprintf("%v trend", tbl.width)
+		for _, b := range tbl.buckets {
+			for in, st := range b.Stats {
+				get(in).add(st.Mean(), float64(st.N), st.Min, st.Max)
+			}
+		}
+	}
+
+	o := make([]sensorStats, 0, len(set))
+	for in, s := range set {
+		o = append(o, s.stats(in))
+	}
+	sort.Slice(o, func(i, j int) bool {
+		if o[i].Type != o[j].Type {
+			return o[i].Type < o[j].Type
+		}
+		return o[i].Name < o[j].Name
+	})
+	return src, o
+}
+
+func (s *samples) stats(in sensors.Input) sensorStats {
+	sort.Sort(s)
+
+	pad := histPad(s.min, s.max)
+	h := hbook.NewH1D(statsBins, s.min-pad, s.max+pad)
+	for i, x := range s.xs {
+		h.Fill(x, s.ws[i])
+	}
+
+	st := sensorStats{
+		Name:    in.Name,
+		Type:    in.Type,
+		Unit:    in.Type.Unit(),
+		Entries: h.Entries(),
+		Mean:    h.XMean(),
+		RMS:     h.XRMS(),
+		StdDev:  h.XStdDev(),
+		Min:     s.min,
+		Max:     s.max,
+		hist:    h,
+	}
+	if math.IsNaN(st.StdDev) {
+		// a single entry.
+		st.StdDev = 0
+	}
+	for _, p := range statsQuantiles {
+		st.Percentiles = append(st.Percentiles, percentile{
+			P:     100 * p,
+			Value: gstat.Quantile(p, gstat.Empirical, s.xs, s.ws),
+		})
+	}
+	return st
+}
+
+// Plot renders the distribution of the values as an SVG image.
+func (st sensorStats) Plot() template.HTML {
+	p := hplot.New()
+	p.Title.Text = fmt.Sprintf("%s (%v)", st.Name, st.Type)
+	p.X.Label.Text = st.Type.Info().Name
+	if st.Unit != "" {
+		p.X.Label.Text += " [" + st.Unit + "]"
+	}
+	p.Y.Label.Text = "Entries"
+
+	h := hplot.NewH1D(st.hist)
+	if c := st.color; c != nil {
+		h.LineStyle.Color = c
+	}
+	h.FillColor = bandColor(h.LineStyle.Color)
+	p.Add(h, plotter.NewGrid())
+
+	const (
+		width  = 12 * vg.Centimeter
+		height = width / math.Phi
+	)
+	canvas := vgsvg.New(width, height)
+	p.Draw(draw.New(canvas))
+	out := new(bytes.Buffer)
+	_, err := canvas.WriteTo(out)
+	if err != nil {
+		return template.HTML(template.HTMLEscapeString(err.Error()))
+	}
+	return template.HTML(out.String())
+}
+
+// Format formats v with the precision and unit of the quantity.
+func (st sensorStats) Format(v float64) string {
+	return st.Type.Format(v)
+}
+
+// statsHandler serves the statistics of the sensors quantities over a time
+// window, selected with the same query parameters than the plot images
+// (from/to/last/sensor, default: last=24h), as an HTML page or as JSON
+// (format=json).
+func (srv *server) statsHandler(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return errorf(http.StatusMethodNotAllowed, "invalid HTTP request (got=%v, want=%v)", r.Method, http.MethodGet)
+	}
+
+	q := r.URL.Query()
+	if q.Get("from") == "" && q.Get("last") == "" {
+		q.Set("last", "24h")
+	}
+	sel, err := parseSelection(q)
+	if err != nil {
+		return err
+	}
+
+	hist, err := srv.history()
+	if err != nil {
+		return err
+	}
+	src, stats := hist.stats(sel)
+	for i := range stats {
+		stats[i].color = srv.colors[stats[i].Name]
+	}
+
+	switch format := q.Get("format"); format {
+	case "json":
+		w.Header().Set("Content-Type", "application/json")
+		return json.NewEncoder(w).Encode(struct {
+			Beg    time.Time     `json:"from"`
+			End    time.Time     `json:"to"`
+			Source string        `json:"source"`
+			Stats  []sensorStats `json:"stats"`
+		}{sel.beg, sel.end, src, stats})
+	case "", "html":
+		buf := new(bytes.Buffer)
+		err = srv.web.execute(buf, "stats.html", struct {
+			Last    string
+			Beg     time.Time
+			End     time.Time
+			Source  string
+			Stats   []sensorStats
+			Version string
+		}{q.Get("last"), sel.beg, sel.end, src, stats, Version})
+		if err != nil {
+			return err
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, err = w.Write(buf.Bytes())
+		return err
+	default:
+		return errorf(http.StatusBadRequest, "invalid 'format' parameter %q", format)
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright 2018 The solid-mon-rpi Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sbinet-solid/solid-mon-rpi/sensors"
+)
+
+func TestStats(t *testing.T) {
+	t0 := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	table := newTestTable(t0)
+	tr := newTrend(2*time.Second, time.Hour)
+	for _, row := range table {
+		tr.add(row)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		beg    time.Time
+		fast   int // first sample held in the fast table
+		src    string
+		median float64
+	}{
+		{"raw", t0, 0, "raw samples", 24},
+		// server up for less than the time window.
+		{"uptime", t0.Add(-time.Hour), 0, "raw samples", 24},
+		// oldest samples evicted from the fast table.
+		{"trend", t0, 5, "2s trend", 24.5},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			hist := history{
+				fast:   sensors.Table(table[tc.fast:]),
+				trends: []trendTable{tr.table()},
+				start:  t0,
+			}
+			src, stats := hist.stats(selection{
+				beg:   tc.beg,
+				names: map[string]bool{"temp-0": true, "adc": true},
+			})
+			if src != tc.src {
+				t.Fatalf("invalid source: got=%q, want=%q", src, tc.src)
+			}
+			if got, want := len(stats), 2; got != want {
+				t.Fatalf("invalid number of stats: got=%d, want=%d", got, want)
+			}
+
+			// temperatures come first.
+			st := stats[0]
+			if st.Name != "temp-0" || st.Type != sensors.Temperature {
+				t.Fatalf("invalid stats ordering: got=%s (%v)", st.Name, st.Type)
+			}
+			if st.Mean != 24.5 || st.Min != 20 || st.Max != 29 {
+				t.Fatalf("invalid stats: mean=%v min=%v max=%v", st.Mean, st.Min, st.Max)
+			}
+			if got, want := st.Entries, int64(10); src == "raw samples" && got != want {
+				t.Fatalf("invalid entries: got=%d, want=%d", got, want)
+			}
+			if got, want := st.Percentiles[2], (percentile{P: 50, Value: tc.median}); got != want {
+				t.Fatalf("invalid median: got=%+v, want=%+v", got, want)
+			}
+
+			st = stats[1]
+			if st.Name != "adc" || math.Abs(st.Mean-3.2) > 1e-12 || st.StdDev > 1e-6 {
+				t.Fatalf("invalid stats: %+v", st)
+			}
+		})
+	}
+}
+
+func TestStatsHandler(t *testing.T) {
+	t0 := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	srv := newTestServer(t, newTestTable(t0))
+
+	for _, tc := range []struct {
+		url  string
+		code int
+		want string
+	}{
+		{"/stats?from=2018-01-01T00:00:00Z", http.StatusOK, "temp-11 (temperature)"},
+		{"/stats", http.StatusOK, "No data for the requested time window."},
+		{"/stats?from=2018-01-01T00:00:00Z&sensor=adc&format=json", http.StatusOK, `"name":"adc"`},
+		{"/stats?format=xml", http.StatusBadRequest, ""},
+		{"/stats?last=-1h", http.StatusBadRequest, ""},
+	} {
+		t.Run(tc.url, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, tc.url, nil)
+			srv.wrap(srv.statsHandler)(w, r)
+			if got, want := w.Code, tc.code; got != want {
+				t.Fatalf("invalid status code: got=%d, want=%d (%s)", got, want, w.Body.String())
+			}
+			if !strings.Contains(w.Body.String(), tc.want) {
+				t.Fatalf("missing %q in response:\n%s", tc.want, w.Body.String())
+			}
+			if strings.Contains(tc.url, "format=json") && !json.Valid(w.Body.Bytes()) {
+				t.Fatalf("invalid JSON response")
+			}
+		})
+	}
+}
@@ -0,0 +1,320 @@
+// Copyright 2018 The solid-mon-rpi Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// latencyBounds are the upper bounds of the latency histogram buckets.
+var latencyBounds = [...]time.Duration{
+	1 * time.Millisecond,
+	2 * time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	20 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	200 * time.Millisecond,
+	500 * time.Millisecond,
+	1 * time.Second,
+	2 * time.Second,
+	5 * time.Second,
+}
+
+// latencyHist is a histogram of durations, with logarithmic buckets.
+type latencyHist struct {
+	n      int64
+	sum    time.Duration
+	min    time.Duration
+	max    time.Duration
+	last   time.Duration
+	counts [len(latencyBounds) + 1]int64 // one bucket per bound, and the overflow bucket
+}
+
+func (h *latencyHist) add(d time.Duration) {
+	if h.n == 0 || d < h.min {
+		h.min = d
+	}
+	if d > h.max {
+		h.max = d
+	}
+	h.n++
+	h.sum += d
+	h.last = d
+	i := sort.Search(len(latencyBounds), func(i int) bool { return d <= latencyBounds[i] })
+	h.counts[i]++
+}
+
+func (h *latencyHist) mean() time.Duration {
+	if h.n == 0 {
+		return 0
+	}
+	return h.sum / time.Duration(h.n)
+}
+
+// latencyJSON is the JSON representation of a latencyHist, in seconds.
+type latencyJSON struct {
+	Count    int64        `json:"count"`
+	Mean     float64      `json:"mean"`
+	Min      float64      `json:"min"`
+	Max      float64      `json:"max"`
+	Last     float64      `json:"last"`
+	Buckets  []bucketJSON `json:"buckets"`
+	Overflow int64        `json:"overflow"` // number of durations above the last bucket
+}
+
+type bucketJSON struct {
+	Le    float64 `json:"le"` // upper bound of the bucket
+	Count int64   `json:"count"`
+}
+
+func (h *latencyHist) json() latencyJSON {
+	o := latencyJSON{
+		Count:    h.n,
+		Mean:     h.mean().Seconds(),
+		Min:      h.min.Seconds(),
+		Max:      h.max.Seconds(),
+		Last:     h.last.Seconds(),
+		Buckets:  make([]bucketJSON, len(latencyBounds)),
+		Overflow: h.counts[len(latencyBounds)],
+	}
+	for i, le := range latencyBounds {
+		o.Buckets[i] = bucketJSON{Le: le.Seconds(), Count: h.counts[i]}
+	}
+	return o
+}
+
+// readTiming is the timing of a sensor reading.
+type readTiming struct {
+	name   string
+	dur    time.Duration
+	failed bool
+	init   bool  // whether the reading (re)initialized the device drivers
+	xfers  int64 // SMBus transactions issued by the reading (estimated)
+}
+
+// busTiming are the acquisition statistics of a bus.
+type busTiming struct {
+	acq    latencyHist // duration of the acquisitions
+	reads  int64       // sensor readings
+	errors int64       // failed sensor readings
+	inits  int64       // device drivers (re)initializations
+	xfers  int64       // SMBus transactions (estimated)
+}
+
+// sensorTiming are the acquisition statistics of a sensor.
+type sensorTiming struct {
+	bus     string
+	latency latencyHist
+	reads   int64
+	errors  int64
+	inits   int64
+	xfers   int64
+}
+
+// daqStats tracks the timing of the data acquisition: duration of each
+// acquisition tick, overruns (ticks longer than the polling period),
+// per-bus and per-sensor reading latencies and counts (readings, failures,
+// drivers initializations and SMBus transactions.)
+//
+// As the health of the server, it is guarded by a mutex: it is updated by
+// the acquisition goroutines and read by the HTTP handlers.
+type daqStats struct {
+	period time.Duration // polling period
+	start  time.Time
+
+	mu          sync.Mutex
+	ticks       latencyHist // duration of the acquisition ticks
+	overruns    int64
+	lastOverrun time.Time
+	buses       map[string]*busTiming
+	sensors     map[string]*sensorTiming
+}
+
+func newDAQStats(period time.Duration) *daqStats {
+	return &daqStats{
+		period:  period,
+		start:   time.Now().UTC(),
+		buses:   make(map[string]*busTiming),
+		sensors: make(map[string]*sensorTiming),
+	}
+}
+
+// acquired records the timings of an acquisition on a bus.
+func (st *daqStats) acquired(v busData) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	name := v.bus.String()
+	bus, ok := st.buses[name]
+	if !ok {
+		bus = new(busTiming)
+		st.buses[name] = bus
+	}
+	if len(v.timings) > 0 {
+		bus.acq.add(v.dur)
+	}
+	bus.xfers += v.resets
+	for _, rt := range v.timings {
+		s, ok := st.sensors[rt.name]
+		if !ok {
+			s = &sensorTiming{bus: name}
+			st.sensors[rt.name] = s
+		}
+		s.latency.add(rt.dur)
+		s.reads++
+		bus.reads++
+		if rt.failed {
+			s.errors++
+			bus.errors++
+		}
+		if rt.init {
+			s.inits++
+			bus.inits++
+		}
+		s.xfers += rt.xfers
+		bus.xfers += rt.xfers
+	}
+}
+
+// tick records the duration of an acquisition tick, and returns whether it
+// overran the polling period.
+func (st *daqStats) tick(now time.Time, dur time.Duration) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.ticks.add(dur)
+	if dur <= st.period {
+		return false
+	}
+	st.overruns++
+	st.lastOverrun = now
+	return true
+}
+
+// summary returns a one-line summary of the acquisition timings.
+func (st *daqStats) summary() string {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	o := fmt.Sprintf(
+		"ticks=%d mean=%v max=%v overruns=%d (period=%v)",
+		st.ticks.n, st.ticks.mean().Round(time.Microsecond),
+		st.ticks.max.Round(time.Microsecond), st.overruns, st.period,
+	)
+	var xfers int64
+	for _, bus := range st.buses {
+		xfers += bus.xfers
+	}
+	o += fmt.Sprintf(", transactions=%d", xfers)
+
+	var (
+		slowest string
+		mean    time.Duration
+	)
+	for name, s := range st.sensors {
+		if m := s.latency.mean(); m > mean || (m == mean && name < slowest) {
+			slowest, mean = name, m
+		}
+	}
+	if slowest != "" {
+		o += fmt.Sprintf(", slowest sensor: %q (mean=%v)", slowest, mean.Round(time.Microsecond))
+	}
+	return o
+}
+
+// daqStatsJSON is the response of the acquisition statistics API.
+// Durations are in seconds.
+type daqStatsJSON struct {
+	Period      float64                     `json:"period"` // polling period
+	Uptime      float64                     `json:"uptime"`
+	Ticks       latencyJSON                 `json:"ticks"` // duration of the acquisition ticks
+	Overruns    int64                       `json:"overruns"`
+	LastOverrun *time.Time                  `json:"last_overrun,omitempty"`
+	Buses       map[string]busTimingJSON    `json:"buses"`
+	Sensors     map[string]sensorTimingJSON `json:"sensors"`
+}
+
+type busTimingJSON struct {
+	Acquisitions latencyJSON `json:"acquisitions"` // duration of the acquisitions
+	Reads        int64       `json:"reads"`
+	Errors       int64       `json:"errors"`
+	Inits        int64       `json:"inits"`
+	Transactions int64       `json:"transactions"` // SMBus transactions (estimated)
+}
+
+type sensorTimingJSON struct {
+	Bus          string      `json:"bus"`
+	Latency      latencyJSON `json:"latency"`
+	Reads        int64       `json:"reads"`
+	Errors       int64       `json:"errors"`
+	Inits        int64       `json:"inits"`
+	Transactions int64       `json:"transactions"` // SMBus transactions (estimated)
+}
+
+func (st *daqStats) json(now time.Time) daqStatsJSON {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	o := daqStatsJSON{
+		Period:   st.period.Seconds(),
+		Uptime:   now.Sub(st.start).Seconds(),
+		Ticks:    st.ticks.json(),
+		Overruns: st.overruns,
+		Buses:    make(map[string]busTimingJSON, len(st.buses)),
+		Sensors:  make(map[string]sensorTimingJSON, len(st.sensors)),
+	}
+	if !st.lastOverrun.IsZero() {
+		t := st.lastOverrun
+		o.LastOverrun = &t
+	}
+	for name, bus := range st.buses {
+		o.Buses[name] = busTimingJSON{
+			Acquisitions: bus.acq.json(),
+			Reads:        bus.reads,
+			Errors:       bus.errors,
+			Inits:        bus.inits,
+			Transactions: bus.xfers,
+		}
+	}
+	for name, s := range st.sensors {
+		o.Sensors[name] = sensorTimingJSON{
+			Bus:          s.bus,
+			Latency:      s.latency.json(),
+			Reads:        s.reads,
+			Errors:       s.errors,
+			Inits:        s.inits,
+			Transactions: s.xfers,
+		}
+	}
+	return o
+}
+
+// daqStatsHandler serves the acquisition statistics:
+//
+//	/api/stats
+//
+// Sensor readings are timed from the selection of the multiplexer channel
+// to the end of the reading.
+// Readings, failures, drivers (re)initializations (which reconfigure the
+// chips and read their calibration) and SMBus transactions are counted.
+// Transactions are those of the multiplexer (channel selections and
+// resets) and those of the device drivers, estimated from the number of
+// transactions each driver issues to open and sample a chip.
+func (srv *server) daqStatsHandler(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return errorf(http.StatusMethodNotAllowed, "invalid HTTP request (got=%v, want=%v)", r.Method, http.MethodGet)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	return json.NewEncoder(w).Encode(srv.stats.json(time.Now().UTC()))
+}
@@ -0,0 +1,120 @@
+// Copyright 2018 The solid-mon-rpi Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLatencyHist(t *testing.T) {
+	var h latencyHist
+	for _, d := range []time.Duration{
+		500 * time.Microsecond,
+		time.Millisecond, // upper bounds are inclusive.
+		3 * time.Millisecond,
+		150 * time.Millisecond,
+		10 * time.Second,
+	} {
+		h.add(d)
+	}
+
+	o := h.json()
+	if got, want := o.Count, int64(5); got != want {
+		t.Fatalf("invalid count: got=%d, want=%d", got, want)
+	}
+	if got, want := o.Min, 0.0005; got != want {
+		t.Fatalf("invalid min: got=%v, want=%v", got, want)
+	}
+	if got, want := o.Max, 10.0; got != want {
+		t.Fatalf("invalid max: got=%v, want=%v", got, want)
+	}
+	if got, want := o.Last, 10.0; got != want {
+		t.Fatalf("invalid last: got=%v, want=%v", got, want)
+	}
+	if got, want := o.Mean, 2.0309; got != want {
+		t.Fatalf("invalid mean: got=%v, want=%v", got, want)
+	}
+
+	want := map[float64]int64{0.001: 2, 0.005: 1, 0.2: 1}
+	for _, b := range o.Buckets {
+		if got := b.Count; got != want[b.Le] {
+			t.Fatalf("invalid bucket le=%v: got=%d, want=%d", b.Le, got, want[b.Le])
+		}
+	}
+	if got, want := o.Overflow, int64(1); got != want {
+		t.Fatalf("invalid overflow: got=%d, want=%d", got, want)
+	}
+}
+
+func TestDAQStats(t *testing.T) {
+	srv := &server{stats: newDAQStats(time.Second)}
+	bus := &i2cBus{id: 1}
+
+	srv.stats.acquired(busData{
+		bus: bus,
+		dur: 30 * time.Millisecond,
+		timings: []readTiming{
+			{name: "temp-1", dur: 10 * time.Millisecond, init: true, xfers: 3},
+			{name: "hum-1", dur: 20 * time.Millisecond, failed: true, init: true, xfers: 1},
+		},
+	})
+	srv.stats.acquired(busData{
+		bus: bus,
+		dur: 5 * time.Millisecond,
+		timings: []readTiming{
+			{name: "temp-1", dur: 5 * time.Millisecond, xfers: 2},
+		},
+	})
+	// no sensor due.
+	srv.stats.acquired(busData{bus: bus})
+	// bus recovered: the multiplexer is reset.
+	srv.stats.acquired(busData{bus: bus, resets: 1})
+
+	t0 := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	if srv.stats.tick(t0, 30*time.Millisecond) {
+		t.Fatalf("unexpected overrun")
+	}
+	if !srv.stats.tick(t0.Add(time.Second), 1500*time.Millisecond) {
+		t.Fatalf("expected an overrun")
+	}
+
+	sum := srv.stats.summary()
+	for _, want := range []string{"ticks=2", "max=1.5s", "overruns=1", "transactions=7", `slowest sensor: "hum-1" (mean=20ms)`} {
+		if !strings.Contains(sum, want) {
+			t.Fatalf("invalid summary %q: missing %q", sum, want)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	srv.wrap(srv.daqStatsHandler)(rec, httptest.NewRequest(http.MethodGet, "/api/stats", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("invalid status code: %d", rec.Code)
+	}
+	var o daqStatsJSON
+	err := json.Unmarshal(rec.Body.Bytes(), &o)
+	if err != nil {
+		t.Fatalf("could not decode stats: %+v", err)
+	}
+
+	if o.Overruns != 1 || o.LastOverrun == nil || !o.LastOverrun.Equal(t0.Add(time.Second)) {
+		t.Fatalf("invalid overruns: %d (last=%v)", o.Overruns, o.LastOverrun)
+	}
+	if got, want := o.Ticks.Count, int64(2); got != want {
+		t.Fatalf("invalid number of ticks: got=%d, want=%d", got, want)
+	}
+	b := o.Buses["/dev/i2c-1"]
+	if b.Acquisitions.Count != 2 || b.Reads != 3 || b.Errors != 1 || b.Inits != 2 || b.Transactions != 7 {
+		t.Fatalf("invalid bus stats: %+v", b)
+	}
+	s := o.Sensors["temp-1"]
+	if s.Bus != "/dev/i2c-1" || s.Reads != 2 || s.Errors != 0 || s.Inits != 1 || s.Transactions != 5 || s.Latency.Mean != 0.0075 {
+		t.Fatalf("invalid sensor stats: %+v", s)
+	}
+}
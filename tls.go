@@ -0,0 +1,174 @@
+// Copyright 2018 The solid-mon-rpi Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// selfSignedValidity is the validity period of the generated self-signed
+// certificates.
+const selfSignedValidity = 10 * 365 * 24 * time.Hour
+
+// tlsConfig returns the TLS configuration of the server, using the
+// certificate and key files.
+// If selfSigned is true and neither file exists, a self-signed certificate
+// is generated and persisted, so clients only have to trust it once.
+func tlsConfig(certFile, keyFile, addr string, selfSigned bool) (*tls.Config, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("tls: certificate and key files are both required")
+	}
+
+	if selfSigned {
+		switch certOK, keyOK := exists(certFile), exists(keyFile); {
+		case !certOK && !keyOK:
+			err := generateCert(certFile, keyFile, certHosts(addr))
+			if err != nil {
+				return nil, err
+			}
+			log.Printf("tls: generated self-signed certificate %q", certFile)
+		case certOK != keyOK:
+			return nil, fmt.Errorf("tls: only one of certificate %q and key %q exists", certFile, keyFile)
+		}
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("tls: could not load certificate: %w", err)
+	}
+	sum := sha256.Sum256(cert.Certificate[0])
+	log.Printf("tls: certificate %q (SHA-256 fingerprint: %s)", certFile, fingerprint(sum[:]))
+
+	return &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	}, nil
+}
+
+func exists(fname string) bool {
+	_, err := os.Stat(fname)
+	return !errors.Is(err, fs.ErrNotExist)
+}
+
+// fingerprint formats a certificate hash the way browsers display it.
+func fingerprint(sum []byte) string {
+	o := make([]string, len(sum))
+	for i, b := range sum {
+		o[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(o, ":")
+}
+
+// certHosts returns the host names and IP addresses the server may be
+// reached at, listening on addr.
+func certHosts(addr string) []string {
+	hosts := []string{"localhost"}
+	if name, err := os.Hostname(); err == nil {
+		hosts = append(hosts, name)
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil && host != "" {
+		hosts = append(hosts, host)
+	}
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, a := range addrs {
+			if ip, ok := a.(*net.IPNet); ok {
+				hosts = append(hosts, ip.IP.String())
+			}
+		}
+	}
+	return hosts
+}
+
+// generateCert generates a self-signed certificate for the provided hosts,
+// and writes it and its private key (PEM encoded) to certFile and keyFile.
+func generateCert(certFile, keyFile string, hosts []string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("tls: could not generate private key: %w", err)
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return fmt.Errorf("tls: could not generate serial number: %w", err)
+	}
+
+	now := time.Now()
+	tmpl := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"SoLid"}, CommonName: "solid-mon-rpi"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	seen := make(map[string]bool)
+	for _, h := range hosts {
+		if seen[h] {
+			continue
+		}
+		seen[h] = true
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+			continue
+		}
+		tmpl.DNSNames = append(tmpl.DNSNames, h)
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, &key.PublicKey, key)
+	if err != nil {
+		return fmt.Errorf("tls: could not create certificate: %w", err)
+	}
+	rawKey, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("tls: could not marshal private key: %w", err)
+	}
+
+	err = writePEM(keyFile, "PRIVATE KEY", rawKey, 0600)
+	if err != nil {
+		return err
+	}
+	err = writePEM(certFile, "CERTIFICATE", der, 0644)
+	if err != nil {
+		os.Remove(keyFile)
+		return err
+	}
+	return nil
+}
+
+func writePEM(fname, typ string, raw []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(fname, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return fmt.Errorf("tls: could not create %q: %w", fname, err)
+	}
+	defer f.Close()
+
+	err = pem.Encode(f, &pem.Block{Type: typ, Bytes: raw})
+	if err != nil {
+		return fmt.Errorf("tls: could not write %q: %w", fname, err)
+	}
+	err = f.Close()
+	if err != nil {
+		return fmt.Errorf("tls: could not close %q: %w", fname, err)
+	}
+	return nil
+}
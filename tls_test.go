@@ -0,0 +1,96 @@
+// Copyright 2018 The solid-mon-rpi Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTLSSelfSigned(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "srv.crt")
+	keyFile := filepath.Join(dir, "srv.key")
+
+	_, err := tlsConfig(certFile, keyFile, "127.0.0.1:8443", false)
+	if err == nil {
+		t.Fatalf("expected an error loading missing certificate")
+	}
+
+	cfg, err := tlsConfig(certFile, keyFile, "127.0.0.1:8443", true)
+	if err != nil {
+		t.Fatalf("could not generate certificate: %+v", err)
+	}
+	fi, err := os.Stat(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := fi.Mode().Perm(); perm != 0600 {
+		t.Fatalf("invalid key file permissions: %v", perm)
+	}
+
+	raw, err := os.ReadFile(certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the persisted certificate is reused.
+	cfg2, err := tlsConfig(certFile, keyFile, "127.0.0.1:8443", true)
+	if err != nil {
+		t.Fatalf("could not reload certificate: %+v", err)
+	}
+	if !bytes.Equal(cfg.Certificates[0].Certificate[0], cfg2.Certificates[0].Certificate[0]) {
+		t.Fatalf("certificate was regenerated")
+	}
+
+	cert, err := x509.ParseCertificate(cfg.Certificates[0].Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cert.VerifyHostname("localhost"); err != nil {
+		t.Fatalf("invalid certificate hosts: %+v", err)
+	}
+	if err := cert.VerifyHostname("127.0.0.1"); err != nil {
+		t.Fatalf("invalid certificate hosts: %+v", err)
+	}
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	ts.TLS = cfg
+	ts.StartTLS()
+	defer ts.Close()
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(raw) {
+		t.Fatalf("could not parse PEM certificate")
+	}
+	cli := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	_, port, _ := net.SplitHostPort(ts.Listener.Addr().String())
+	resp, err := cli.Get("https://localhost:" + port)
+	if err != nil {
+		t.Fatalf("could not connect: %+v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if got, want := string(body), "ok"; got != want {
+		t.Fatalf("invalid response: got=%q, want=%q", got, want)
+	}
+
+	// a missing key for an existing certificate is an error.
+	os.Remove(keyFile)
+	_, err = tlsConfig(certFile, keyFile, "127.0.0.1:8443", true)
+	if err == nil {
+		t.Fatalf("expected an error with a missing key")
+	}
+}
@@ -0,0 +1,296 @@
+// Copyright 2018 The solid-mon-rpi Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"github.com/sbinet-solid/solid-mon-rpi/sensors"
+	"gonum.org/v1/plot/plotter"
+)
+
+// trendBuckets are the widths of the trend buckets and the time window
+// over which they are kept.
+// The time window of the first (finest) buckets is configurable.
+var trendBuckets = [...]struct {
+	width  time.Duration
+	window time.Duration
+}{
+	{time.Minute, 7 * 24 * time.Hour},
+	{time.Hour, 31 * 24 * time.Hour},
+	{24 * time.Hour, 366 * 24 * time.Hour},
+}
+
+// stat holds the summary statistics of a quantity over a time bucket.
+type stat struct {
+	Min float64
+	Max float64
+	Sum float64
+	N   int64
+}
+
+func (st *stat) add(v float64) {
+	if st.N == 0 {
+		st.Min = v
+		st.Max = v
+	}
+	st.Min = math.Min(st.Min, v)
+	st.Max = math.Max(st.Max, v)
+	st.Sum += v
+	st.N++
+}
+
+// merge accumulates the values summarized by o.
+func (st *stat) merge(o stat) {
+	if st.N == 0 {
+		*st = o
+		return
+	}
+	st.Min = math.Min(st.Min, o.Min)
+	st.Max = math.Max(st.Max, o.Max)
+	st.Sum += o.Sum
+	st.N += o.N
+}
+
+// Mean returns the mean of the values accumulated in the bucket.
+func (st stat) Mean() float64 {
+	return st.Sum / float64(st.N)
+}
+
+// bucket holds the statistics of all the quantities sampled during a
+// time interval.
+type bucket struct {
+	Beg   time.Time
+	Stats map[sensors.Input]*stat
+}
+
+// trend aggregates sensors data into time buckets of fixed width.
+type trend struct {
+	width   time.Duration
+	buckets *ring[bucket] // closed buckets
+	cur     bucket        // bucket being filled
+}
+
+func newTrend(width, window time.Duration) *trend {
+	return &trend{
+		width: width,
+		buckets: newRing(window, int(window/width), func(b *bucket) time.Time {
+			return b.Beg
+		}),
+	}
+}
+
+// newTrends returns the trends for all the bucket widths.
+// window is the time window of the finest buckets (0: use the default.)
+func newTrends(window time.Duration) []*trend {
+	trends := make([]*trend, len(trendBuckets))
+	for i, b := range trendBuckets {
+		if i == 0 && window > 0 {
+			b.window = window
+		}
+		trends[i] = newTrend(b.width, b.window)
+	}
+	return trends
+}
+
+// add accumulates the sensors data into the bucket containing its
+// timestamp, closing the current bucket if needed.
+func (tr *trend) add(data sensors.Sensors) {
+	beg := data.Timestamp.Truncate(tr.width)
+	if !beg.Equal(tr.cur.Beg) {
+		if tr.cur.Stats != nil {
+			tr.buckets.add(tr.cur)
+		}
+		tr.cur = bucket{
+			Beg:   beg,
+			Stats: make(map[sensors.Input]*stat),
+		}
+	}
+
+	for _, v := range data.Sensors {
+		in := sensors.Input{Name: v.Name, Type: v.Type}
+		st := tr.cur.Stats[in]
+		if st == nil {
+			st = new(stat)
+			tr.cur.Stats[in] = st
+		}
+		st.add(v.Value)
+	}
+}
+
+// table returns the closed buckets, followed by the bucket being filled.
+func (tr *trend) table() trendTable {
+	tbl := trendTable{
+		width:   tr.width,
+		buckets: make([]bucket, tr.buckets.Len(), tr.buckets.Len()+1),
+	}
+	tr.buckets.copy(tbl.buckets)
+	if tr.cur.Stats != nil {
+		tbl.buckets = append(tbl.buckets, tr.cur.clone())
+	}
+	return tbl
+}
+
+func (b bucket) clone() bucket {
+	o := bucket{
+		Beg:   b.Beg,
+		Stats: make(map[sensors.Input]*stat, len(b.Stats)),
+	}
+	for k, v := range b.Stats {
+		st := *v
+		o.Stats[k] = &st
+	}
+	return o
+}
+
+// trendTable is a time series of trend buckets.
+type trendTable struct {
+	width   time.Duration
+	buckets []bucket
+}
+
+// Len returns the number of buckets in the table.
+func (tbl trendTable) Len() int { return len(tbl.buckets) }
+
+// Span returns the time interval covered by the table.
+func (tbl trendTable) Span() (beg, end time.Time) {
+	if len(tbl.buckets) == 0 {
+		return beg, end
+	}
+	return tbl.buckets[0].Beg, tbl.buckets[len(tbl.buckets)-1].Beg.Add(tbl.width)
+}
+
+// downsample returns the table with consecutive buckets merged into wider
+// ones, so that it holds at most n buckets.
+// Merged buckets are aligned on multiples of their width, as the trend
+// buckets are.
+func (tbl trendTable) downsample(n int) trendTable {
+	if n < 2 || len(tbl.buckets) <= n {
+		return tbl
+	}
+	beg, end := tbl.Span()
+	// alignment may add a partial bucket at each end.
+	k := (end.Sub(beg)/tbl.width + time.Duration(n) - 2) / time.Duration(n-1)
+	o := trendTable{
+		width:   time.Duration(k) * tbl.width,
+		buckets: make([]bucket, 0, n),
+	}
+	for _, b := range tbl.buckets {
+		beg := b.Beg.Truncate(o.width)
+		if len(o.buckets) == 0 || !o.buckets[len(o.buckets)-1].Beg.Equal(beg) {
+			o.buckets = append(o.buckets, bucket{
+				Beg:   beg,
+				Stats: make(map[sensors.Input]*stat, len(b.Stats)),
+			})
+		}
+		cur := o.buckets[len(o.buckets)-1].Stats
+		for in, st := range b.Stats {
+			v := cur[in]
+			if v == nil {
+				v = new(stat)
+				cur[in] = v
+			}
+			v.merge(*st)
+		}
+	}
+	return o
+}
+
+// Types returns the types of all the quantities present in the table.
+func (tbl trendTable) Types() []sensors.Type {
+	set := make(map[sensors.Type]bool)
+	for _, b := range tbl.buckets {
+		for in := range b.Stats {
+			set[in.Type] = true
+		}
+	}
+	var types []sensors.Type
+	for _, typ := range sensors.AllTypes() {
+		if set[typ] {
+			types = append(types, typ)
+		}
+	}
+	return types
+}
+
+// Labels returns the names of all the sensors of the given type
+// present in the table.
+func (tbl trendTable) Labels(typ sensors.Type) []string {
+	set := make(map[string]bool)
+	for _, b := range tbl.buckets {
+		for in := range b.Stats {
+			if in.Type == typ {
+				set[in.Name] = true
+			}
+		}
+	}
+	labels := make([]string, 0, len(set))
+	for k := range set {
+		labels = append(labels, k)
+	}
+	sort.Strings(labels)
+	return labels
+}
+
+// Data returns the time series of the mean values of the sensor label for
+// the given type, together with the overall minimum and maximum values.
+func (tbl trendTable) Data(typ sensors.Type, label string) (float64, float64, plotter.XYs) {
+	min := +math.MaxFloat64
+	max := -math.MaxFloat64
+	data := make(plotter.XYs, 0, len(tbl.buckets))
+	tbl.each(typ, label, func(x float64, st *stat) {
+		data = append(data, plotter.XY{X: x, Y: st.Mean()})
+		min = math.Min(min, st.Min)
+		max = math.Max(max, st.Max)
+	})
+	return min, max, data
+}
+
+// Segments returns the time series of the mean values of the sensor label,
+// split into contiguous segments of buckets.
+func (tbl trendTable) Segments(typ sensors.Type, label string) (float64, float64, []plotter.XYs) {
+	min, max, data := tbl.Data(typ, label)
+	return min, max, sensors.SplitGaps(data, tbl.gap(data))
+}
+
+// Band returns the time series of the minimum and maximum values of the
+// sensor label for the given type, split into contiguous segments of
+// buckets.
+func (tbl trendTable) Band(typ sensors.Type, label string) (lo, hi []plotter.XYs) {
+	los := make(plotter.XYs, 0, len(tbl.buckets))
+	his := make(plotter.XYs, 0, len(tbl.buckets))
+	tbl.each(typ, label, func(x float64, st *stat) {
+		los = append(los, plotter.XY{X: x, Y: st.Min})
+		his = append(his, plotter.XY{X: x, Y: st.Max})
+	})
+	gap := tbl.gap(los)
+	return sensors.SplitGaps(los, gap), sensors.SplitGaps(his, gap)
+}
+
+// gap returns the time (in seconds) between two consecutive buckets of the
+// time series data above which it is considered interrupted.
+// As for sensors.Table, it is derived from the typical spacing of the
+// buckets of that sensor (e.g. a sensor polled every 5 minutes only fills
+// one bucket of 1 minute out of 5), and is at least the bucket width.
+func (tbl trendTable) gap(data plotter.XYs) float64 {
+	return math.Max(sensors.Gap(data), tbl.width.Seconds())
+}
+
+// each calls fct with the center of each bucket and the statistics of
+// the sensor label for the given type, for all buckets where that sensor
+// was sampled.
+func (tbl trendTable) each(typ sensors.Type, label string, fct func(x float64, st *stat)) {
+	in := sensors.Input{Name: label, Type: typ}
+	for _, b := range tbl.buckets {
+		st, ok := b.Stats[in]
+		if !ok {
+			continue
+		}
+		x := float64(b.Beg.Add(tbl.width/2).UnixNano()) * 1e-9
+		fct(x, st)
+	}
+}
@@ -0,0 +1,162 @@
+// Copyright 2018 The solid-mon-rpi Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/sbinet-solid/solid-mon-rpi/sensors"
+	"gonum.org/v1/plot/plotter"
+)
+
+func TestTrend(t *testing.T) {
+	t0 := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	tr := newTrend(time.Minute, time.Hour)
+	for i, v := range []float64{1, 5, 3, 10, 20} {
+		tr.add(sensors.Sensors{
+			Timestamp: t0.Add(time.Duration(i) * 20 * time.Second),
+			Sensors: []sensors.Data{
+				{Name: "t1", Type: sensors.Temperature, Value: v},
+			},
+		})
+	}
+
+	tbl := tr.table()
+	if got, want := tbl.Len(), 2; got != want {
+		t.Fatalf("invalid number of buckets: got=%d, want=%d", got, want)
+	}
+	if got, want := tr.buckets.Len(), 1; got != want {
+		t.Fatalf("invalid number of closed buckets: got=%d, want=%d", got, want)
+	}
+
+	min, max, mean := tbl.Data(sensors.Temperature, "t1")
+	if min != 1 || max != 20 {
+		t.Fatalf("invalid range: got=[%v, %v], want=[1, 20]", min, max)
+	}
+	x0 := float64(t0.Add(30*time.Second).UnixNano()) * 1e-9
+	x1 := x0 + 60
+	if got, want := mean, (plotter.XYs{{X: x0, Y: 3}, {X: x1, Y: 15}}); !reflect.DeepEqual(got, want) {
+		t.Fatalf("invalid means:\ngot= %v\nwant=%v", got, want)
+	}
+
+	lo, hi := tbl.Band(sensors.Temperature, "t1")
+	if got, want := lo, ([]plotter.XYs{{{X: x0, Y: 1}, {X: x1, Y: 10}}}); !reflect.DeepEqual(got, want) {
+		t.Fatalf("invalid minima:\ngot= %v\nwant=%v", got, want)
+	}
+	if got, want := hi, ([]plotter.XYs{{{X: x0, Y: 5}, {X: x1, Y: 20}}}); !reflect.DeepEqual(got, want) {
+		t.Fatalf("invalid maxima:\ngot= %v\nwant=%v", got, want)
+	}
+
+	if got, want := tbl.Labels(sensors.Temperature), []string{"t1"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("invalid labels: got=%v, want=%v", got, want)
+	}
+
+	// a sensor missing for several buckets interrupts the trend.
+	for _, m := range []time.Duration{2, 3, 10} {
+		tr.add(sensors.Sensors{
+			Timestamp: t0.Add(m * time.Minute),
+			Sensors: []sensors.Data{
+				{Name: "t1", Type: sensors.Temperature, Value: 2},
+			},
+		})
+	}
+	_, _, segs := tr.table().Segments(sensors.Temperature, "t1")
+	if got, want := len(segs), 2; got != want {
+		t.Fatalf("invalid number of segments: got=%d, want=%d (%v)", got, want, segs)
+	}
+}
+
+func TestTrendSegmentsSlowSensor(t *testing.T) {
+	t0 := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	tr := newTrend(time.Minute, 24*time.Hour)
+	for i := 0; i < 60; i++ {
+		row := sensors.Sensors{
+			Timestamp: t0.Add(time.Duration(i) * time.Minute),
+			Sensors: []sensors.Data{
+				{Name: "fast", Type: sensors.Temperature, Value: float64(i)},
+			},
+		}
+		if i%5 == 0 && (i < 30 || i >= 45) {
+			// polled every 5 minutes, missing for a quarter of an hour.
+			row.Sensors = append(row.Sensors, sensors.Data{
+				Name: "slow", Type: sensors.Temperature, Value: float64(i),
+			})
+		}
+		tr.add(row)
+	}
+	tbl := tr.table()
+
+	for _, tc := range []struct {
+		label string
+		segs  int
+	}{
+		{"fast", 1},
+		{"slow", 2},
+	} {
+		_, _, segs := tbl.Segments(sensors.Temperature, tc.label)
+		if got, want := len(segs), tc.segs; got != want {
+			t.Fatalf("%s: invalid number of segments: got=%d, want=%d (%v)", tc.label, got, want, segs)
+		}
+		lo, hi := tbl.Band(sensors.Temperature, tc.label)
+		if len(lo) != tc.segs || len(hi) != tc.segs {
+			t.Fatalf("%s: invalid number of band segments: lo=%d, hi=%d, want=%d", tc.label, len(lo), len(hi), tc.segs)
+		}
+	}
+}
+
+func TestTrendDownsample(t *testing.T) {
+	// a week of 1-minute buckets.
+	t0 := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	tbl := trendTable{width: time.Minute}
+	in := sensors.Input{Name: "t1", Type: sensors.Temperature}
+	for i := 0; i < 7*24*60; i++ {
+		v := float64(i % 100)
+		tbl.buckets = append(tbl.buckets, bucket{
+			Beg:   t0.Add(time.Duration(i) * time.Minute),
+			Stats: map[sensors.Input]*stat{in: {Min: v - 1, Max: v + 1, Sum: 2 * v, N: 2}},
+		})
+	}
+
+	o := tbl.downsample(maxPlotPoints)
+	if got, want := o.width, 5*time.Minute; got != want {
+		t.Fatalf("invalid bucket width: got=%v, want=%v", got, want)
+	}
+	if n := o.Len(); n > maxPlotPoints {
+		t.Fatalf("too many buckets: %d > %d", n, maxPlotPoints)
+	}
+	if beg, end := o.Span(); !beg.Equal(t0) || !end.Equal(t0.Add(7*24*time.Hour)) {
+		t.Fatalf("invalid span: [%v, %v]", beg, end)
+	}
+
+	var n int64
+	for _, b := range o.buckets {
+		n += b.Stats[in].N
+	}
+	if got, want := n, int64(2*tbl.Len()); got != want {
+		t.Fatalf("invalid number of entries: got=%d, want=%d", got, want)
+	}
+	if st := o.buckets[0].Stats[in]; st.Min != -1 || st.Max != 5 || st.Mean() != 2 {
+		t.Fatalf("invalid merged bucket: %+v", *st)
+	}
+	if st := tbl.buckets[0].Stats[in]; st.N != 2 {
+		t.Fatalf("input table modified: %+v", *st)
+	}
+
+	// unaligned tables still fit.
+	unaligned := trendTable{width: time.Minute, buckets: tbl.buckets[7:]}
+	for _, n := range []int{2, 3, 100, maxPlotPoints - 1} {
+		if got := tbl.downsample(n).Len(); got > n {
+			t.Fatalf("too many buckets: %d > %d", got, n)
+		}
+		if got := unaligned.downsample(n).Len(); got > n {
+			t.Fatalf("too many buckets: %d > %d", got, n)
+		}
+	}
+	if got, want := tbl.downsample(tbl.Len()).Len(), tbl.Len(); got != want {
+		t.Fatalf("invalid number of buckets: got=%d, want=%d", got, want)
+	}
+}
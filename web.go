@@ -0,0 +1,283 @@
+// Copyright 2018 The solid-mon-rpi Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+//go:embed web
+var webFS embed.FS
+
+// webUI serves the HTML templates and the static assets (JS, CSS) of the
+// web interface, located under the web directory.
+//
+// By default, the assets embedded in the binary are served and cached by
+// the clients.
+// When serving from disk (during development), templates are reloaded on
+// each request and caching is disabled.
+type webUI struct {
+	fsys fs.FS
+	dev  bool // whether assets are served from disk
+
+	mu    sync.Mutex
+	tmpl  *template.Template
+	etags map[string]string // content hash of the embedded static assets
+}
+
+// newWebUI creates the web interface from the embedded assets, or from the
+// provided directory if not empty.
+func newWebUI(dir string) (*webUI, error) {
+	ui := &webUI{etags: make(map[string]string)}
+	switch dir {
+	case "":
+		sub, err := fs.Sub(webFS, "web")
+		if err != nil {
+			return nil, err
+		}
+		ui.fsys = sub
+	default:
+		fi, err := os.Stat(dir)
+		if err != nil {
+			return nil, fmt.Errorf("web: could not access web assets directory: %w", err)
+		}
+		if !fi.IsDir() {
+			return nil, fmt.Errorf("web: %q is not a directory", dir)
+		}
+		ui.fsys = os.DirFS(dir)
+		ui.dev = true
+	}
+
+	tmpl, err := ui.parse()
+	if err != nil {
+		return nil, err
+	}
+	ui.tmpl = tmpl
+	return ui, nil
+}
+
+func (ui *webUI) parse() (*template.Template, error) {
+	tmpl, err := template.New("web").Funcs(template.FuncMap{
+		"static": ui.static,
+	}).ParseFS(ui.fsys, "*.html")
+	if err != nil {
+		return nil, fmt.Errorf("web: could not parse templates: %w", err)
+	}
+	return tmpl, nil
+}
+
+// execute renders the named template into w.
+func (ui *webUI) execute(w io.Writer, name string, data interface{}) error {
+	tmpl := ui.tmpl
+	if ui.dev {
+		var err error
+		tmpl, err = ui.parse()
+		if err != nil {
+			return err
+		}
+	}
+	return tmpl.ExecuteTemplate(w, name, data)
+}
+
+// static returns the URL of the named static asset.
+// The URL of the embedded assets carries their content hash, so clients
+// can cache them for good.
+func (ui *webUI) static(name string) (string, error) {
+	url := "/static/" + name
+	if ui.dev {
+		return url, nil
+	}
+	etag, err := ui.etag(name)
+	if err != nil {
+		return "", err
+	}
+	return url + "?v=" + etag, nil
+}
+
+func (ui *webUI) etag(name string) (string, error) {
+	ui.mu.Lock()
+	defer ui.mu.Unlock()
+	if etag, ok := ui.etags[name]; ok {
+		return etag, nil
+	}
+	raw, err := fs.ReadFile(ui.fsys, path.Join("static", name))
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(raw)
+	etag := hex.EncodeToString(sum[:8])
+	ui.etags[name] = etag
+	return etag, nil
+}
+
+// staticHandler serves the static assets under /static/.
+func (ui *webUI) staticHandler(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return errorf(http.StatusMethodNotAllowed, "invalid HTTP request (got=%v, want=%v)", r.Method, http.MethodGet)
+	}
+
+	name := strings.TrimPrefix(path.Clean(r.URL.Path), "/static/")
+	if !fs.ValidPath(name) || strings.HasPrefix(name, "/") {
+		return errorf(http.StatusNotFound, "unknown asset %q", r.URL.Path)
+	}
+	raw, err := fs.ReadFile(ui.fsys, path.Join("static", name))
+	if err != nil {
+		return errorf(http.StatusNotFound, "unknown asset %q", r.URL.Path)
+	}
+
+	if ctype := mime.TypeByExtension(path.Ext(name)); ctype != "" {
+		w.Header().Set("Content-Type", ctype)
+	}
+	switch {
+	case ui.dev:
+		w.Header().Set("Cache-Control", "no-cache")
+	default:
+		etag, err := ui.etag(name)
+		if err != nil {
+			return err
+		}
+		w.Header().Set("ETag", `"`+etag+`"`)
+		if r.URL.Query().Get("v") == etag {
+			w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		} else {
+			w.Header().Set("Cache-Control", "no-cache")
+		}
+	}
+	http.ServeContent(w, r, name, time.Time{}, bytes.NewReader(raw))
+	return nil
+}
+
+// gzipHandler compresses the responses of h for the clients accepting it,
+// when their content is compressible (text, JSON, SVG...)
+// Websocket upgrades and range requests are passed through.
+func gzipHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(r) || r.Header.Get("Upgrade") != "" || r.Header.Get("Range") != "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		gw := &gzipWriter{ResponseWriter: w}
+		defer gw.Close()
+		h.ServeHTTP(gw, r)
+	})
+}
+
+func acceptsGzip(r *http.Request) bool {
+	for _, v := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		v, q, _ := strings.Cut(strings.TrimSpace(v), ";")
+		if strings.TrimSpace(v) == "gzip" && strings.ReplaceAll(q, " ", "") != "q=0" {
+			return true
+		}
+	}
+	return false
+}
+
+// compressible returns whether content of the provided MIME type benefits
+// from compression.
+func compressible(ctype string) bool {
+	ctype, _, _ = strings.Cut(ctype, ";")
+	switch ctype = strings.TrimSpace(ctype); {
+	case ctype == "text/event-stream":
+		// streamed: keep each event readable as soon as it is flushed.
+		return false
+	case strings.HasPrefix(ctype, "text/"):
+		return true
+	}
+	switch ctype {
+	case "application/json", "application/javascript", "image/svg+xml":
+		return true
+	}
+	return false
+}
+
+// gzipWriter compresses the response body, if its content type is
+// compressible.
+// The decision is made when the response header is written.
+type gzipWriter struct {
+	http.ResponseWriter
+	gz      *gzip.Writer
+	decided bool
+}
+
+var gzipPool = sync.Pool{
+	New: func() interface{} { return gzip.NewWriter(io.Discard) },
+}
+
+func (gw *gzipWriter) WriteHeader(code int) {
+	if gw.decided {
+		return
+	}
+	gw.decided = true
+	hdr := gw.Header()
+	if hdr.Get("Content-Encoding") == "" && code == http.StatusOK && compressible(hdr.Get("Content-Type")) {
+		hdr.Del("Content-Length")
+		hdr.Del("Accept-Ranges")
+		hdr.Set("Content-Encoding", "gzip")
+		if etag := hdr.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			// the compressed representation differs from the identity one.
+			hdr.Set("ETag", "W/"+etag)
+		}
+		gw.gz = gzipPool.Get().(*gzip.Writer)
+		gw.gz.Reset(gw.ResponseWriter)
+	}
+	gw.ResponseWriter.WriteHeader(code)
+}
+
+func (gw *gzipWriter) Write(p []byte) (int, error) {
+	if !gw.decided {
+		if gw.Header().Get("Content-Type") == "" {
+			gw.Header().Set("Content-Type", http.DetectContentType(p))
+		}
+		gw.WriteHeader(http.StatusOK)
+	}
+	if gw.gz == nil {
+		return gw.ResponseWriter.Write(p)
+	}
+	return gw.gz.Write(p)
+}
+
+// Flush flushes the compressed data written so far to the client.
+func (gw *gzipWriter) Flush() {
+	if !gw.decided {
+		gw.WriteHeader(http.StatusOK)
+	}
+	if gw.gz != nil {
+		gw.gz.Flush()
+	}
+	if f, ok := gw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap returns the underlying response writer, for http.ResponseController.
+func (gw *gzipWriter) Unwrap() http.ResponseWriter {
+	return gw.ResponseWriter
+}
+
+func (gw *gzipWriter) Close() error {
+	if gw.gz == nil {
+		return nil
+	}
+	err := gw.gz.Close()
+	gzipPool.Put(gw.gz)
+	gw.gz = nil
+	return err
+}
@@ -0,0 +1,386 @@
+// Copyright 2018 The solid-mon-rpi Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// charts displays the time series served by /api/history on canvas
+// elements, one per dashboard panel.
+// The time axis of all the charts is shared:
+//  - mouse wheel: zoom in/out around the cursor,
+//  - drag: pan,
+//  - double click: reset to the full time range.
+var charts = {
+	data:   null,  // latest /api/history response
+	x0:     0,     // displayed time range, in seconds
+	x1:     0,
+	zoomed: false, // whether the user changed the time range
+	hidden: {},    // names of the hidden sensors
+	list:   [],    // one chart per panel
+	drag:   null,
+	timer:  null,
+	margin: {left: 70, right: 15, top: 25, bottom: 45},
+
+	init: function() {
+		document.getElementById("charts-view").onchange = function() { charts.reset(); };
+		document.getElementById("charts-last").onchange = function() { charts.reset(); };
+		document.getElementById("charts-reload").onclick = function() { charts.fetch(); };
+		document.getElementById("charts-follow").onchange = function() { charts.follow(); };
+		window.onresize = function() { charts.draw(); };
+		window.onmousemove = function(e) { charts.pan(e); };
+		window.onmouseup = function() { charts.drag = null; };
+		charts.follow();
+		charts.fetch();
+	},
+
+	// reset discards the user time range and reloads the data.
+	reset: function() {
+		charts.zoomed = false;
+		charts.fetch();
+	},
+
+	// follow periodically reloads the data, while not zoomed.
+	follow: function() {
+		if (charts.timer !== null) {
+			clearInterval(charts.timer);
+			charts.timer = null;
+		}
+		if (!document.getElementById("charts-follow").checked) {
+			return;
+		}
+		charts.timer = setInterval(function() {
+			if (!charts.zoomed && charts.drag === null) {
+				charts.fetch();
+			}
+		}, 30000);
+	},
+
+	fetch: function() {
+		var q = "view="+encodeURIComponent(document.getElementById("charts-view").value);
+		if (charts.zoomed) {
+			q += "&from="+encodeURIComponent(charts.rfc3339(Math.floor(charts.x0)));
+			q += "&to="+encodeURIComponent(charts.rfc3339(Math.ceil(charts.x1)));
+		} else {
+			var last = document.getElementById("charts-last").value;
+			if (last !== "") {
+				q += "&last="+encodeURIComponent(last);
+			}
+		}
+		var status = document.getElementById("charts-status");
+		status.textContent = "loading...";
+		fetch("/api/history?"+q).then(function(resp) {
+			if (!resp.ok) {
+				return resp.text().then(function(msg) { throw new Error(msg); });
+			}
+			return resp.json();
+		}).then(function(data) {
+			status.textContent = "";
+			charts.load(data);
+		}).catch(function(err) {
+			status.textContent = "error: "+err.message;
+		});
+	},
+
+	load: function(data) {
+		charts.data = data;
+		if (!charts.zoomed) {
+			charts.x0 = data.from;
+			charts.x1 = data.to;
+		}
+		if (charts.x1 <= charts.x0) {
+			charts.x1 = charts.x0 + 1;
+		}
+
+		var root = document.getElementById("charts");
+		if (charts.list.length !== data.panels.length) {
+			root.innerHTML = "";
+			charts.list = [];
+			data.panels.forEach(function() {
+				var c = document.createElement("canvas");
+				c.className = "solid-chart-style";
+				root.appendChild(c);
+				var ch = {canvas: c};
+				charts.list.push(ch);
+				charts.listen(ch);
+			});
+		}
+		data.panels.forEach(function(panel, i) {
+			charts.list[i].panel = panel;
+		});
+		charts.legend();
+		charts.draw();
+	},
+
+	legend: function() {
+		var root = document.getElementById("charts-legend");
+		root.innerHTML = "";
+		var seen = {};
+		charts.data.panels.forEach(function(panel) {
+			panel.series.forEach(function(s) {
+				if (seen[s.name]) {
+					return;
+				}
+				seen[s.name] = true;
+				var label = document.createElement("label");
+				var box = document.createElement("input");
+				box.type = "checkbox";
+				box.checked = !charts.hidden[s.name];
+				box.onchange = function() {
+					charts.hidden[s.name] = !box.checked;
+					charts.draw();
+				};
+				var swatch = document.createElement("span");
+				swatch.className = "solid-swatch-style";
+				swatch.style.background = s.color;
+				label.appendChild(box);
+				label.appendChild(swatch);
+				label.appendChild(document.createTextNode(s.name));
+				root.appendChild(label);
+			});
+		});
+	},
+
+	listen: function(ch) {
+		var c = ch.canvas;
+		c.onwheel = function(e) {
+			e.preventDefault();
+			var x = charts.pixelToTime(c, e.offsetX);
+			var f = e.deltaY < 0 ? 0.8 : 1.25;
+			charts.x0 = x - (x-charts.x0)*f;
+			charts.x1 = x + (charts.x1-x)*f;
+			charts.zoomed = true;
+			charts.draw();
+		};
+		c.onmousedown = function(e) {
+			e.preventDefault();
+			charts.drag = {canvas: c, px: e.clientX, x0: charts.x0, x1: charts.x1};
+		};
+		c.onmousemove = function(e) {
+			charts.cursor(ch, e.offsetX, e.offsetY);
+		};
+		c.ondblclick = function() {
+			charts.reset();
+		};
+	},
+
+	pan: function(e) {
+		var d = charts.drag;
+		if (d === null) {
+			return;
+		}
+		var w = d.canvas.clientWidth - charts.margin.left - charts.margin.right;
+		var dx = (e.clientX - d.px) * (d.x1 - d.x0) / w;
+		charts.x0 = d.x0 - dx;
+		charts.x1 = d.x1 - dx;
+		charts.zoomed = true;
+		charts.draw();
+	},
+
+	pixelToTime: function(c, px) {
+		var w = c.clientWidth - charts.margin.left - charts.margin.right;
+		return charts.x0 + (px - charts.margin.left) * (charts.x1 - charts.x0) / w;
+	},
+
+	cursor: function(ch, px, py) {
+		if (ch.y0 === undefined) {
+			return;
+		}
+		var c = ch.canvas;
+		var h = c.clientHeight - charts.margin.top - charts.margin.bottom;
+		var y = ch.y1 - (py - charts.margin.top) * (ch.y1 - ch.y0) / h;
+		if (ch.log) {
+			y = Math.pow(10, y);
+		}
+		document.getElementById("charts-cursor").textContent =
+			ch.panel.title+": "+charts.rfc3339(charts.pixelToTime(c, px))+
+			", "+y.toPrecision(5)+" "+ch.panel.unit;
+	},
+
+	draw: function() {
+		if (charts.data === null) {
+			return;
+		}
+		charts.list.forEach(charts.drawChart);
+	},
+
+	visible: function(panel) {
+		return panel.series.filter(function(s) { return !charts.hidden[s.name]; });
+	},
+
+	// yRange returns the range of the values displayed in the panel.
+	yRange: function(panel) {
+		if (panel.min < panel.max) {
+			return [panel.min, panel.max];
+		}
+		var lo = Infinity, hi = -Infinity;
+		var scan = function(segs) {
+			(segs || []).forEach(function(seg) {
+				seg.forEach(function(p) {
+					if (p[1] === null || p[0] < charts.x0 || p[0] > charts.x1) {
+						return;
+					}
+					lo = Math.min(lo, p[1]);
+					hi = Math.max(hi, p[1]);
+				});
+			});
+		};
+		charts.visible(panel).forEach(function(s) {
+			scan(s.segments);
+			scan(s.lo);
+			scan(s.hi);
+		});
+		if (lo > hi) {
+			return [0, 1];
+		}
+		if (lo === hi) {
+			return [lo-0.5, hi+0.5];
+		}
+		var pad = 0.05*(hi-lo);
+		return [lo-pad, hi+pad];
+	},
+
+	drawChart: function(ch) {
+		var c = ch.canvas, panel = ch.panel, m = charts.margin;
+		var dpr = window.devicePixelRatio || 1;
+		c.width = c.clientWidth * dpr;
+		c.height = c.clientHeight * dpr;
+		var ctx = c.getContext("2d");
+		ctx.setTransform(dpr, 0, 0, dpr, 0, 0);
+		ctx.clearRect(0, 0, c.clientWidth, c.clientHeight);
+
+		var w = c.clientWidth - m.left - m.right;
+		var h = c.clientHeight - m.top - m.bottom;
+
+		// log-scale axes can only display strictly positive values.
+		var yr = charts.yRange(panel);
+		ch.log = panel.log && yr[0] > 0;
+		var ty = function(v) { return ch.log ? Math.log(v)/Math.LN10 : v; };
+		ch.y0 = ty(yr[0]);
+		ch.y1 = ty(yr[1]);
+
+		var px = function(x) { return m.left + (x-charts.x0)*w/(charts.x1-charts.x0); };
+		var py = function(y) { return m.top + (ch.y1-ty(y))*h/(ch.y1-ch.y0); };
+
+		// title, axes and grid.
+		ctx.fillStyle = "#000";
+		ctx.font = "bold 13px sans-serif";
+		ctx.textAlign = "center";
+		ctx.fillText(panel.title, m.left+w/2, 15);
+		ctx.font = "11px sans-serif";
+		ctx.strokeStyle = "#ddd";
+		ctx.lineWidth = 1;
+
+		var xstep = charts.timeStep(charts.x1-charts.x0);
+		for (var x = Math.ceil(charts.x0/xstep)*xstep; x <= charts.x1; x += xstep) {
+			ctx.beginPath();
+			ctx.moveTo(px(x), m.top);
+			ctx.lineTo(px(x), m.top+h);
+			ctx.stroke();
+			ctx.fillText(charts.formatTime(x, xstep), px(x), m.top+h+14);
+		}
+		ctx.fillText("UTC", m.left+w/2, m.top+h+36);
+
+		ctx.textAlign = "right";
+		var ystep = charts.niceStep((ch.y1-ch.y0)/5);
+		for (var y = Math.ceil(ch.y0/ystep)*ystep; y <= ch.y1; y += ystep) {
+			var v = ch.log ? Math.pow(10, y) : y;
+			ctx.beginPath();
+			ctx.moveTo(m.left, py(v));
+			ctx.lineTo(m.left+w, py(v));
+			ctx.stroke();
+			ctx.fillText(ch.log ? v.toExponential(0) : +v.toPrecision(6), m.left-5, py(v)+4);
+		}
+		ctx.save();
+		ctx.translate(14, m.top+h/2);
+		ctx.rotate(-Math.PI/2);
+		ctx.textAlign = "center";
+		ctx.fillText("["+panel.unit+"]", 0, 0);
+		ctx.restore();
+
+		ctx.strokeStyle = "#000";
+		ctx.strokeRect(m.left, m.top, w, h);
+
+		// data: min/max bands (trends), then one line per segment.
+		ctx.save();
+		ctx.beginPath();
+		ctx.rect(m.left, m.top, w, h);
+		ctx.clip();
+		charts.visible(panel).forEach(function(s) {
+			ctx.fillStyle = s.color;
+			ctx.strokeStyle = s.color;
+			ctx.lineWidth = 1.5;
+			(s.lo || []).forEach(function(lo, i) {
+				var hi = s.hi[i];
+				ctx.globalAlpha = 0.25;
+				ctx.beginPath();
+				hi.forEach(function(p) { ctx.lineTo(px(p[0]), py(p[1])); });
+				lo.slice().reverse().forEach(function(p) { ctx.lineTo(px(p[0]), py(p[1])); });
+				ctx.closePath();
+				ctx.fill();
+				ctx.globalAlpha = 1;
+			});
+			s.segments.forEach(function(seg) {
+				if (seg.length === 1) {
+					// isolated sample.
+					ctx.fillRect(px(seg[0][0])-1.5, py(seg[0][1])-1.5, 3, 3);
+					return;
+				}
+				ctx.beginPath();
+				var pen = false;
+				seg.forEach(function(p) {
+					if (p[1] === null) {
+						pen = false;
+						return;
+					}
+					if (pen) {
+						ctx.lineTo(px(p[0]), py(p[1]));
+					} else {
+						ctx.moveTo(px(p[0]), py(p[1]));
+						pen = true;
+					}
+				});
+				ctx.stroke();
+			});
+		});
+		ctx.restore();
+	},
+
+	niceStep: function(raw) {
+		if (!(raw > 0)) {
+			return 1;
+		}
+		var p = Math.pow(10, Math.floor(Math.log(raw)/Math.LN10));
+		var f = raw/p;
+		return (f < 1.5 ? 1 : f < 3 ? 2 : f < 7 ? 5 : 10)*p;
+	},
+
+	// timeSteps are the spacings of the time axis ticks, in seconds.
+	timeSteps: [
+		1, 2, 5, 10, 15, 30,
+		60, 120, 300, 600, 900, 1800,
+		3600, 7200, 10800, 21600, 43200,
+		86400, 2*86400, 7*86400, 14*86400, 30*86400, 91*86400, 365*86400
+	],
+
+	timeStep: function(span) {
+		for (var i = 0; i < charts.timeSteps.length; i++) {
+			if (charts.timeSteps[i] >= span/6) {
+				return charts.timeSteps[i];
+			}
+		}
+		return charts.timeSteps[charts.timeSteps.length-1];
+	},
+
+	formatTime: function(x, step) {
+		var s = new Date(x*1000).toISOString();
+		if (step >= 86400) {
+			return s.substring(0, 10);
+		}
+		if (step >= 60) {
+			return s.substring(5, 10)+" "+s.substring(11, 16);
+		}
+		return s.substring(11, 19);
+	},
+
+	rfc3339: function(x) {
+		return new Date(x*1000).toISOString().substring(0, 19)+"Z";
+	}
+};
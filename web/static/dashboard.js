@@ -0,0 +1,34 @@
+// Copyright 2017 The solid-mon-rpi Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+var sock = null;
+
+function update(data) {
+	var p = null;
+
+	p = document.getElementById("update-message");
+	p.innerHTML = "Last Update: <code>"+data.update+"</code>";
+
+	p = document.getElementById("sensor-plot");
+	p.innerHTML = data.plot;
+
+	p = document.getElementById("fast-data");
+	p.innerHTML = "<pre>"+data.data+"</pre>";
+
+	// trend plots are only sent when they changed.
+	if (data.trends !== undefined) {
+		p = document.getElementById("sensor-plot-trends");
+		p.innerHTML = data.trends;
+	}
+};
+
+window.onload = function() {
+	var proto = location.protocol === "https:" ? "wss://" : "ws://";
+	sock = new WebSocket(proto+location.host+"/data");
+	sock.onmessage = function(event) {
+		var data = JSON.parse(event.data);
+		update(data);
+	};
+	charts.init();
+};
@@ -0,0 +1,141 @@
+// Copyright 2018 The solid-mon-rpi Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWebUI(t *testing.T) {
+	srv := newTestServer(t, newTestTable(time.Now()))
+	ts := httptest.NewServer(gzipHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/static/"):
+			srv.wrap(srv.web.staticHandler)(w, r)
+		default:
+			srv.ServeHTTP(w, r)
+		}
+	})))
+	defer ts.Close()
+
+	get := func(url string, hdr map[string]string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodGet, ts.URL+url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range hdr {
+			req.Header.Set(k, v)
+		}
+		// disable the transparent decompression of the client.
+		resp, err := (&http.Transport{DisableCompression: true}).RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	resp := get("/", map[string]string{"Accept-Encoding": "gzip"})
+	if got, want := resp.Header.Get("Content-Encoding"), "gzip"; got != want {
+		t.Fatalf("invalid content-encoding: got=%q, want=%q", got, want)
+	}
+	zr, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		t.Fatalf("could not open gzip body: %+v", err)
+	}
+	page, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("could not read gzip body: %+v", err)
+	}
+	etag, err := srv.web.etag("charts.js")
+	if err != nil {
+		t.Fatalf("could not compute etag: %+v", err)
+	}
+	url := "/static/charts.js?v=" + etag
+	if !strings.Contains(string(page), url) {
+		t.Fatalf("index page does not refer to %q:\n%s", url, page)
+	}
+
+	resp = get(url, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("invalid status code: %d", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Cache-Control"); !strings.Contains(got, "max-age=31536000") {
+		t.Fatalf("invalid cache-control: %q", got)
+	}
+	if got := resp.Header.Get("Content-Encoding"); got != "" {
+		t.Fatalf("unexpected content-encoding: %q", got)
+	}
+
+	resp = get("/static/charts.js", map[string]string{"If-None-Match": `"` + etag + `"`})
+	if got, want := resp.StatusCode, http.StatusNotModified; got != want {
+		t.Fatalf("invalid status code: got=%d, want=%d", got, want)
+	}
+	if got, want := resp.Header.Get("Cache-Control"), "no-cache"; got != want {
+		t.Fatalf("invalid cache-control: got=%q, want=%q", got, want)
+	}
+
+	for _, url := range []string{"/static/not-there.js", "/static/../main.go", "/static/"} {
+		resp = get(url, nil)
+		if got, want := resp.StatusCode, http.StatusNotFound; got != want {
+			t.Fatalf("invalid status code for %q: got=%d, want=%d", url, got, want)
+		}
+	}
+}
+
+func TestWebUIDev(t *testing.T) {
+	dir := t.TempDir()
+	err := os.MkdirAll(filepath.Join(dir, "static"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write := func(name, content string) {
+		t.Helper()
+		err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("index.html", `v1 {{static "app.js"}}`)
+	write("static/app.js", "var x = 1;")
+
+	ui, err := newWebUI(dir)
+	if err != nil {
+		t.Fatalf("could not create web UI: %+v", err)
+	}
+
+	render := func() string {
+		t.Helper()
+		o := new(strings.Builder)
+		err := ui.execute(o, "index.html", nil)
+		if err != nil {
+			t.Fatalf("could not render template: %+v", err)
+		}
+		return o.String()
+	}
+	if got, want := render(), "v1 /static/app.js"; got != want {
+		t.Fatalf("invalid page: got=%q, want=%q", got, want)
+	}
+
+	// templates are reloaded from disk.
+	write("index.html", `v2`)
+	if got, want := render(), "v2"; got != want {
+		t.Fatalf("invalid page: got=%q, want=%q", got, want)
+	}
+
+	_, err = newWebUI(filepath.Join(dir, "not-there"))
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+}